@@ -0,0 +1,197 @@
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/term"
+	"github.com/harche/runvm/hypervisor"
+	"github.com/harche/runvm/libcontainer"
+	"github.com/urfave/cli"
+	"golang.org/x/sys/unix"
+)
+
+const defaultDetachKeys = "ctrl-p,ctrl-q"
+
+var errDetached = errors.New("detached")
+
+var attachCommand = cli.Command{
+	Name:  "attach",
+	Usage: "attach to the console of a detached container",
+	ArgsUsage: `<container-id>
+
+Where "<container-id>" is the name for the instance of the container.`,
+	Description: `The attach command connects the terminal, or standard input and output, to
+the application console of a container started with --detach. The console
+output buffered while nobody was attached is printed first. A terminal is put
+in raw mode and its size is passed on to the container. Type the detach keys
+to leave the container running and return.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "detach-keys",
+			Value: defaultDetachKeys,
+			Usage: `keys that detach from the container, as a comma separated list of "ctrl-<key>" and characters, "" for none`,
+		},
+		cli.BoolFlag{
+			Name:  "no-stdin",
+			Usage: "do not send standard input to the container",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if err := checkArgs(context, 1, exactArgs); err != nil {
+			return err
+		}
+		keys, err := parseDetachKeys(context.String("detach-keys"))
+		if err != nil {
+			return err
+		}
+		container, err := getContainer(context)
+		if err != nil {
+			return err
+		}
+		status, err := container.Status()
+		if err != nil {
+			return err
+		}
+		if status == libcontainer.Stopped {
+			return fmt.Errorf("container %s is not running", container.ID())
+		}
+		hyperVisor, err := loadHypervisor(context)
+		if err != nil {
+			return err
+		}
+		console, err := hyperVisor.AttachConsole(container.ID())
+		if err != nil {
+			return err
+		}
+		defer console.Close()
+
+		stdin := os.Stdin.Fd()
+		if term.IsTerminal(stdin) && !context.Bool("no-stdin") {
+			state, err := term.SetRawTerminal(stdin)
+			if err != nil {
+				return err
+			}
+			defer term.RestoreTerminal(stdin, state)
+			winch := make(chan os.Signal, 1)
+			signal.Notify(winch, unix.SIGWINCH)
+			defer signal.Stop(winch)
+			go resizeConsole(console, stdin, winch)
+			winch <- unix.SIGWINCH
+		}
+
+		done := make(chan error, 2)
+		if !context.Bool("no-stdin") {
+			go func() {
+				err := copyInput(console, os.Stdin, keys)
+				if err == io.EOF {
+					// Keep printing the output of the container.
+					return
+				}
+				done <- err
+			}()
+		}
+		go func() {
+			_, err := io.Copy(os.Stdout, console)
+			done <- err
+		}()
+		if err := <-done; err != nil && err != errDetached {
+			return err
+		}
+		return nil
+	},
+}
+
+// resizeConsole passes the size of the terminal fd on to console every
+// time it changes.
+func resizeConsole(console *hypervisor.ConsoleAttachment, fd uintptr, winch <-chan os.Signal) {
+	for range winch {
+		ws, err := term.GetWinsize(fd)
+		if err != nil {
+			logrus.Debugf("terminal size: %v", err)
+			continue
+		}
+		if err := console.Resize(ws.Height, ws.Width); err != nil {
+			logrus.Debugf("resize console: %v", err)
+		}
+	}
+}
+
+// parseDetachKeys parses a detach key sequence such as "ctrl-p,ctrl-q".
+func parseDetachKeys(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var keys []byte
+	for _, key := range strings.Split(s, ",") {
+		switch {
+		case len(key) == 1:
+			keys = append(keys, key[0])
+		case len(key) == 6 && strings.HasPrefix(strings.ToLower(key), "ctrl-"):
+			c := key[5]
+			switch {
+			case c >= 'a' && c <= 'z':
+				keys = append(keys, c-'a'+1)
+			case c >= 'A' && c <= 'Z':
+				keys = append(keys, c-'A'+1)
+			case c >= '@' && c <= '_':
+				keys = append(keys, c-'@')
+			default:
+				return nil, fmt.Errorf("invalid detach key %q", key)
+			}
+		default:
+			return nil, fmt.Errorf("invalid detach key %q", key)
+		}
+	}
+	return keys, nil
+}
+
+// copyInput copies in to w until keys are read in a row, then returns
+// errDetached. Input matching the start of keys is held back until it is
+// known not to be the detach sequence.
+func copyInput(w io.Writer, in io.Reader, keys []byte) error {
+	buf := make([]byte, 1024)
+	matched := 0
+	for {
+		n, err := in.Read(buf)
+		out := make([]byte, 0, n+len(keys))
+		for _, b := range buf[:n] {
+			if len(keys) == 0 {
+				out = append(out, b)
+				continue
+			}
+			if b == keys[matched] {
+				matched++
+				if matched == len(keys) {
+					if len(out) > 0 {
+						w.Write(out)
+					}
+					return errDetached
+				}
+				continue
+			}
+			out = append(out, keys[:matched]...)
+			matched = 0
+			if b == keys[0] {
+				matched = 1
+				continue
+			}
+			out = append(out, b)
+		}
+		if len(out) > 0 {
+			if _, err := w.Write(out); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
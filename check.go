@@ -0,0 +1,136 @@
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/harche/runvm/hypervisor"
+	"github.com/harche/runvm/libcontainer/apparmor"
+	"github.com/harche/runvm/libcontainer/cgroups"
+	"github.com/harche/runvm/libcontainer/seccomp"
+	"github.com/urfave/cli"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// checkSubsystems are the cgroup controllers the resources of containers
+// are applied through.
+var checkSubsystems = []string{"cpu", "cpuset", "memory", "hugetlb", "devices"}
+
+var checkCommand = cli.Command{
+	Name:  "check",
+	Usage: "check that the host can run containers in virtual machines",
+	ArgsUsage: `
+
+Runs every check and reports whether it passed. It exits with an error if
+any of them failed.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format, f",
+			Value: "table",
+			Usage: `select one of: ` + formatOptions,
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if err := checkArgs(context, 0, exactArgs); err != nil {
+			return err
+		}
+		var results []hypervisor.CheckResult
+		hyperVisor, err := loadHypervisor(context)
+		if err != nil {
+			results = append(results, hypervisor.CheckResult{
+				Name:   "configuration",
+				Status: hypervisor.CheckFail,
+				Detail: err.Error(),
+			})
+		} else {
+			results = append(results, hyperVisor.Check()...)
+		}
+		results = append(results, checkNetwork(), checkCgroups(), checkSeccomp(), checkAppArmor())
+
+		switch context.String("format") {
+		case "table":
+			w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+			fmt.Fprint(w, "CHECK\tSTATUS\tDETAIL\n")
+			for _, result := range results {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", result.Name, result.Status, result.Detail)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		case "json":
+			if err := json.NewEncoder(os.Stdout).Encode(results); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("invalid format option")
+		}
+
+		failed := 0
+		for _, result := range results {
+			if result.Status == hypervisor.CheckFail {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d checks failed", failed, len(results))
+		}
+		return nil
+	},
+}
+
+// checkNetwork creates and deletes a veth pair and a bridge, as the
+// network setup of containers does.
+func checkNetwork() hypervisor.CheckResult {
+	const name = "network"
+	prefix := fmt.Sprintf("rvchk%d", os.Getpid())
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: prefix + "a"},
+		PeerName:  prefix + "b",
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return hypervisor.CheckResult{Name: name, Status: hypervisor.CheckFail, Detail: fmt.Sprintf("create veth: %v", err)}
+	}
+	netlink.LinkDel(veth)
+	bridge := &netlink.Bridge{
+		LinkAttrs: netlink.LinkAttrs{Name: prefix + "br"},
+	}
+	if err := netlink.LinkAdd(bridge); err != nil {
+		return hypervisor.CheckResult{Name: name, Status: hypervisor.CheckFail, Detail: fmt.Sprintf("create bridge: %v", err)}
+	}
+	netlink.LinkDel(bridge)
+	return hypervisor.CheckResult{Name: name, Status: hypervisor.CheckPass, Detail: "veth and bridge devices can be created"}
+}
+
+func checkCgroups() hypervisor.CheckResult {
+	const name = "cgroups"
+	for _, subsystem := range checkSubsystems {
+		mountpoint, err := cgroups.FindCgroupMountpoint(subsystem)
+		if err != nil {
+			return hypervisor.CheckResult{Name: name, Status: hypervisor.CheckFail, Detail: err.Error()}
+		}
+		if err := unix.Access(mountpoint, unix.W_OK); err != nil {
+			return hypervisor.CheckResult{Name: name, Status: hypervisor.CheckFail, Detail: fmt.Sprintf("%s: %v", mountpoint, err)}
+		}
+	}
+	return hypervisor.CheckResult{Name: name, Status: hypervisor.CheckPass, Detail: fmt.Sprintf("%v are mounted and writable", checkSubsystems)}
+}
+
+func checkSeccomp() hypervisor.CheckResult {
+	if !seccomp.IsEnabled() {
+		return hypervisor.CheckResult{Name: "seccomp", Status: hypervisor.CheckFail, Detail: "the kernel does not support seccomp filters"}
+	}
+	return hypervisor.CheckResult{Name: "seccomp", Status: hypervisor.CheckPass, Detail: "supported by the kernel"}
+}
+
+func checkAppArmor() hypervisor.CheckResult {
+	if !apparmor.IsEnabled() {
+		// Hosts confining containers with SELinux do without.
+		return hypervisor.CheckResult{Name: "apparmor", Status: hypervisor.CheckWarn, Detail: "not enabled"}
+	}
+	return hypervisor.CheckResult{Name: "apparmor", Status: hypervisor.CheckPass, Detail: "enabled"}
+}
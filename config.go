@@ -0,0 +1,38 @@
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/harche/runvm/hypervisor"
+	"github.com/urfave/cli"
+)
+
+var configCommand = cli.Command{
+	Name:  "config",
+	Usage: "inspect the hypervisor configuration",
+	Description: `The hypervisor configuration is layered: the built-in defaults, then
+` + hypervisor.SystemConfigFile + `, then the file given with
+--hypervisor-config, then ` + hypervisor.ConfigEnvPrefix + `* environment variables such as
+` + hypervisor.ConfigEnvPrefix + `NUM_CPU for "NumCPU".`,
+	Subcommands: []cli.Command{
+		{
+			Name:  "show",
+			Usage: "print the effective hypervisor configuration as JSON",
+			Action: func(context *cli.Context) error {
+				if err := checkArgs(context, 0, exactArgs); err != nil {
+					return err
+				}
+				config, err := hypervisor.ParseConfig()
+				if err != nil {
+					return err
+				}
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(config)
+			},
+		},
+	},
+}
@@ -0,0 +1,161 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/harche/runvm/hypervisor"
+	"github.com/harche/runvm/libcontainer"
+	"github.com/urfave/cli"
+)
+
+var cpCommand = cli.Command{
+	Name:  "cp",
+	Usage: "copy files between a container and the host",
+	ArgsUsage: `<src> <dst>
+
+Where one of "<src>" and "<dst>" is "<container-id>:<path>", a path in the
+container, and the other a path on the host, or "-" for a tar archive on
+standard input or output.
+
+EXAMPLE:
+To copy the file config.yaml into the directory /etc/app of container app1:
+
+       # runvm cp config.yaml app1:/etc/app`,
+	Description: `The cp command copies <src>, and everything below it if it is a directory,
+into the directory <dst>. Files are streamed as a tar archive through the
+guest agent of the virtual machine, so that paths only the guest sees, such as
+a tmpfs, can be copied and nothing races with the caches of the guest.
+Ownership, modes and extended attributes are kept. The processes of a paused
+container stay stopped during the copy.
+
+Files copied out of a container come from its guest, which is not trusted:
+device nodes are refused and setuid, setgid and sticky bits are dropped unless
+--keep-setid is given.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "keep-setid",
+			Usage: "keep the setuid, setgid and sticky bits of files copied out of the container",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if err := checkArgs(context, 2, exactArgs); err != nil {
+			return err
+		}
+		src, dst := context.Args().Get(0), context.Args().Get(1)
+		srcID, srcPath := splitCopyPath(src)
+		dstID, dstPath := splitCopyPath(dst)
+		id := srcID
+		switch {
+		case srcID != "" && dstID != "":
+			return fmt.Errorf("copying between containers is not supported")
+		case srcID == "" && dstID == "":
+			return fmt.Errorf("one of source and destination must be <container-id>:<path>")
+		case dstID != "":
+			id = dstID
+		}
+		factory, err := loadFactory(context)
+		if err != nil {
+			return err
+		}
+		unlock, err := lockContainer(factory, id)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		container, err := factory.Load(id)
+		if err != nil {
+			return err
+		}
+		status, err := container.Status()
+		if err != nil {
+			return err
+		}
+		freeze := false
+		switch status {
+		case libcontainer.Stopped:
+			return fmt.Errorf("container %s is not running", id)
+		case libcontainer.Paused:
+			// The guest has to run to copy, while the agent keeps the
+			// processes of the container stopped.
+			if err := container.Resume(); err != nil {
+				return err
+			}
+			defer container.Pause()
+			freeze = true
+		}
+		hyperVisor, err := loadHypervisor(context)
+		if err != nil {
+			return err
+		}
+		if dstID != "" {
+			return copyToContainer(hyperVisor, id, srcPath, dstPath, freeze)
+		}
+		return copyFromContainer(hyperVisor, id, srcPath, dstPath, freeze, context.Bool("keep-setid"))
+	},
+}
+
+// splitCopyPath splits "<container-id>:<path>" in its parts. Host paths
+// have no container id.
+func splitCopyPath(arg string) (string, string) {
+	i := strings.IndexByte(arg, ':')
+	if i <= 0 || strings.ContainsRune(arg[:i], '/') {
+		return "", arg
+	}
+	return arg[:i], arg[i+1:]
+}
+
+func copyToContainer(h hypervisor.Hypervisor, id, src, dst string, freeze bool) error {
+	if src == "-" {
+		return h.CopyToVM(id, dst, freeze, os.Stdin)
+	}
+	if _, err := os.Lstat(src); err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(hypervisor.WriteArchive(pw, src))
+	}()
+	err := h.CopyToVM(id, dst, freeze, pr)
+	pr.CloseWithError(err)
+	return err
+}
+
+func copyFromContainer(h hypervisor.Hypervisor, id, src, dst string, freeze, keepSetid bool) error {
+	// The guest names the archive after the last component of src.
+	name := path.Base(path.Clean("/" + src))
+	if name == "/" {
+		return fmt.Errorf("cannot copy the root of container %s", id)
+	}
+	if dst == "-" {
+		return h.CopyFromVM(id, src, freeze, os.Stdout)
+	}
+	if fi, err := os.Stat(dst); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dst)
+	}
+	pr, pw := io.Pipe()
+	extracted := make(chan error, 1)
+	go func() {
+		err := hypervisor.ExtractArchive(pr, dst, name, keepSetid)
+		if err == nil {
+			// The archive may be padded past its end.
+			_, err = io.Copy(ioutil.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		extracted <- err
+	}()
+	err := h.CopyFromVM(id, src, freeze, pw)
+	pw.CloseWithError(err)
+	if xerr := <-extracted; err == nil {
+		err = xerr
+	}
+	return err
+}
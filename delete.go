@@ -44,11 +44,24 @@ var deleteCommand = cli.Command{
 
 		id := context.Args().First()
 		force := context.Bool("force")
-		container, err := getContainer(context)
+		factory, err := loadFactory(context)
+		if err != nil {
+			return err
+		}
+		unlock, err := lockContainer(factory, id)
+		if err != nil {
+			if lerr, ok := err.(libcontainer.Error); ok && lerr.Code() == libcontainer.ContainerNotExists && force {
+				return nil
+			}
+			return err
+		}
+		defer unlock()
+		container, err := factory.Load(id)
 		if err != nil {
 			if lerr, ok := err.(libcontainer.Error); ok && lerr.Code() == libcontainer.ContainerNotExists {
 				// if there was an aborted start or something of the sort then the container's directory could exist but
 				// libcontainer does not see it because the state.json file inside that directory was never created.
+				// The lock keeps this from racing with a create that is under way.
 				path := filepath.Join(context.GlobalString("root"), id)
 				if e := os.RemoveAll(path); e != nil {
 					fmt.Fprintf(os.Stderr, "remove %s: %v\n", path, e)
@@ -0,0 +1,48 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/harche/runvm/libcontainer"
+	"github.com/urfave/cli"
+)
+
+var dumpCommand = cli.Command{
+	Name:  "dump",
+	Usage: "save the guest memory of a container's virtual machine for post-mortem debugging",
+	ArgsUsage: `<container-id>
+
+Where "<container-id>" is the name for the instance of the container.`,
+	Description: `The dump command writes the guest memory of the virtual machine, its domain
+XML and its serial console log to a new directory under "CrashDumpDir" of the
+hypervisor configuration, and prints that directory. The guest is paused
+while its memory is written, then resumes.`,
+	Action: func(context *cli.Context) error {
+		if err := checkArgs(context, 1, exactArgs); err != nil {
+			return err
+		}
+		container, err := getContainer(context)
+		if err != nil {
+			return err
+		}
+		status, err := container.Status()
+		if err != nil {
+			return err
+		}
+		if status == libcontainer.Stopped {
+			return fmt.Errorf("container %s is not running", container.ID())
+		}
+		hyperVisor, err := loadHypervisor(context)
+		if err != nil {
+			return err
+		}
+		dir, err := hyperVisor.DumpVM(container.ID(), "requested")
+		if err != nil {
+			return err
+		}
+		fmt.Println(dir)
+		return nil
+	},
+}
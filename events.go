@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/harche/runvm/hypervisor"
 	"github.com/harche/runvm/libcontainer"
 	"github.com/harche/runvm/libcontainer/cgroups"
 	"github.com/urfave/cli"
@@ -93,6 +94,9 @@ type memory struct {
 	Kernel    memoryEntry       `json:"kernel,omitempty"`
 	KernelTCP memoryEntry       `json:"kernelTCP,omitempty"`
 	Raw       map[string]uint64 `json:"raw,omitempty"`
+	// Balloon is the memory of the virtual machine as seen by its
+	// balloon driver.
+	Balloon *hypervisor.MemoryStats `json:"balloon,omitempty"`
 }
 
 var eventsCommand = cli.Command{
@@ -126,6 +130,10 @@ information is displayed once every 5 seconds.`,
 		if status == libcontainer.Stopped {
 			return fmt.Errorf("container with id %s is not running", container.ID())
 		}
+		hyperVisor, err := loadHypervisor(context)
+		if err != nil {
+			return err
+		}
 		var (
 			stats  = make(chan *libcontainer.Stats, 1)
 			events = make(chan *event, 1024)
@@ -146,7 +154,7 @@ information is displayed once every 5 seconds.`,
 			if err != nil {
 				return err
 			}
-			events <- &event{Type: "stats", ID: container.ID(), Data: convertLibcontainerStats(s)}
+			events <- &event{Type: "stats", ID: container.ID(), Data: vmStats(hyperVisor, container.ID(), s)}
 			close(events)
 			group.Wait()
 			return nil
@@ -165,6 +173,11 @@ information is displayed once every 5 seconds.`,
 		if err != nil {
 			return err
 		}
+		restarts, err := hyperVisor.Restarts(container.ID())
+		if err != nil {
+			return err
+		}
+		seen := len(restarts)
 		for {
 			select {
 			case _, ok := <-n:
@@ -177,7 +190,15 @@ information is displayed once every 5 seconds.`,
 					n = nil
 				}
 			case s := <-stats:
-				events <- &event{Type: "stats", ID: container.ID(), Data: convertLibcontainerStats(s)}
+				events <- &event{Type: "stats", ID: container.ID(), Data: vmStats(hyperVisor, container.ID(), s)}
+				restarts, err := hyperVisor.Restarts(container.ID())
+				if err != nil {
+					logrus.Error(err)
+					break
+				}
+				for ; seen < len(restarts); seen++ {
+					events <- &event{Type: "restart", ID: container.ID(), Data: restarts[seen]}
+				}
 			}
 			if n == nil {
 				close(events)
@@ -189,6 +210,22 @@ information is displayed once every 5 seconds.`,
 	},
 }
 
+// vmStats returns the stats of the container, with the balloon statistics
+// of its virtual machine when they are available.
+func vmStats(h hypervisor.Hypervisor, id string, ls *libcontainer.Stats) *stats {
+	s := convertLibcontainerStats(ls)
+	if s == nil {
+		return nil
+	}
+	balloon, err := h.MemoryStats(id)
+	if err != nil {
+		logrus.Debugf("balloon stats of %s: %v", id, err)
+		return s
+	}
+	s.Memory.Balloon = balloon
+	return s
+}
+
 func convertLibcontainerStats(ls *libcontainer.Stats) *stats {
 	cg := ls.CgroupStats
 	if cg == nil {
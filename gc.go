@@ -0,0 +1,178 @@
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/harche/runvm/hypervisor"
+	"github.com/harche/runvm/libcontainer"
+	"github.com/urfave/cli"
+)
+
+// defaultOrphanAge is how old state must be before it is taken for an
+// orphan, so that containers being created are left alone.
+const defaultOrphanAge = time.Minute
+
+// gcResult is what gc did with an orphan.
+type gcResult struct {
+	hypervisor.Orphan
+	Removed bool   `json:"removed"`
+	Error   string `json:"error,omitempty"`
+}
+
+var gcCommand = cli.Command{
+	Name:  "gc",
+	Usage: "remove what is left of virtual machines no container owns",
+	ArgsUsage: `
+
+Where the containers are those under the given root, specified via the global
+option "--root".`,
+	Description: `The gc command finds the libvirt domains, pooled guests, veth interfaces and
+state directories that were left behind when runvm died while it created or
+destroyed a container, and removes them. With --dry-run they are only
+reported. The list command reports them too.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "report the orphans without removing them",
+		},
+		cli.DurationFlag{
+			Name:  "min-age",
+			Value: defaultOrphanAge,
+			Usage: "ignore state directories younger than this, which may belong to containers being created",
+		},
+		cli.StringFlag{
+			Name:  "format, f",
+			Value: "table",
+			Usage: `select one of: ` + formatOptions,
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if err := checkArgs(context, 0, exactArgs); err != nil {
+			return err
+		}
+		s, unloaded, err := loadContainers(context)
+		if err != nil {
+			return err
+		}
+		// What a container that cannot be loaded owns would look orphaned.
+		if len(unloaded) > 0 {
+			return fmt.Errorf("could not load containers %s, nothing was removed", strings.Join(unloaded, ", "))
+		}
+		factory, err := loadFactory(context)
+		if err != nil {
+			return err
+		}
+		hyperVisor, err := loadHypervisor(context)
+		if err != nil {
+			return err
+		}
+		orphans, err := hyperVisor.Orphans(ownedContainers(s), context.Duration("min-age"))
+		if err != nil {
+			return err
+		}
+
+		results := make([]gcResult, 0, len(orphans))
+		failed := 0
+		for _, orphan := range orphans {
+			result := gcResult{Orphan: orphan}
+			if !context.Bool("dry-run") {
+				removed, err := removeOrphan(factory, hyperVisor, orphan)
+				if err != nil {
+					result.Error = err.Error()
+					failed++
+				} else if !removed {
+					continue
+				}
+				result.Removed = removed
+			}
+			results = append(results, result)
+		}
+
+		switch context.String("format") {
+		case "table":
+			w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+			fmt.Fprint(w, "KIND\tNAME\tPATH\tSTATUS\n")
+			for _, result := range results {
+				status := "orphan"
+				switch {
+				case result.Error != "":
+					status = "error: " + result.Error
+				case result.Removed:
+					status = "removed"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.Kind, result.Name, result.Path, status)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		case "json":
+			if err := json.NewEncoder(os.Stdout).Encode(results); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("invalid format option")
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d orphans could not be removed", failed, len(orphans))
+		}
+		return nil
+	},
+}
+
+// ownedContainers maps the containers in s to the pids of their init
+// processes, which own the veths of their virtual machines.
+func ownedContainers(s []containerState) map[string]int {
+	owned := make(map[string]int, len(s))
+	for _, item := range s {
+		owned[item.ID] = item.InitProcessPid
+	}
+	return owned
+}
+
+// removeOrphan removes orphan unless it belongs to a container again, and
+// reports whether it did. Domains and state dirs are named after the
+// container that left them, whose lock is held while they are removed so
+// that no runvm process creates the container meanwhile.
+func removeOrphan(factory libcontainer.Factory, h hypervisor.Hypervisor, orphan hypervisor.Orphan) (bool, error) {
+	if orphan.Kind == hypervisor.OrphanDomain || orphan.Kind == hypervisor.OrphanStateDir {
+		unlock, err := lockContainer(factory, orphan.Name)
+		if err == nil {
+			defer unlock()
+			_, err = factory.Load(orphan.Name)
+			if err == nil {
+				return false, nil
+			}
+		}
+		// Without a state, or a directory, there is no container.
+		if lerr, ok := err.(libcontainer.Error); !ok || lerr.Code() != libcontainer.ContainerNotExists {
+			return false, err
+		}
+	}
+	return true, h.RemoveOrphan(orphan)
+}
+
+// reportOrphans warns about the orphans left next to the containers in s,
+// without removing them.
+func reportOrphans(context *cli.Context, s []containerState) {
+	hyperVisor, err := loadHypervisor(context)
+	if err != nil {
+		logrus.Debugf("looking for orphans: %v", err)
+		return
+	}
+	orphans, err := hyperVisor.Orphans(ownedContainers(s), defaultOrphanAge)
+	if err != nil {
+		logrus.Debugf("looking for orphans: %v", err)
+		return
+	}
+	for _, orphan := range orphans {
+		fmt.Fprintf(os.Stderr, "orphan %s, remove it with runvm gc\n", orphan)
+	}
+}
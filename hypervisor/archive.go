@@ -0,0 +1,341 @@
+package hypervisor
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/harche/runvm/libcontainer/xattr"
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of path, none where the
+// filesystem does not support them.
+func readXattrs(path string) (map[string]string, error) {
+	names, err := xattr.Listxattr(path)
+	if err != nil {
+		if err == unix.ENOTSUP {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	attrs := make(map[string]string, len(names))
+	for _, name := range names {
+		value, err := xattr.Getxattr(path, name)
+		if err != nil {
+			return nil, err
+		}
+		attrs[name] = value
+	}
+	return attrs, nil
+}
+
+// WriteArchive writes path, and everything below it if it is a directory,
+// to w as a tar archive whose entries are named from the base name of path.
+// Ownership is kept as numeric ids, along with modes, times and extended
+// attributes, as GNU tar does with --xattrs --numeric-owner in the guest.
+func WriteArchive(w io.Writer, path string) error {
+	path = filepath.Clean(path)
+	base := filepath.Dir(path)
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(path, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(base, file)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uname, hdr.Gname = "", ""
+		if hdr.Xattrs, err = readXattrs(file); err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// archiveTarget returns where the entry name of an archive is extracted in
+// dir. Entries cannot leave dir, neither through their name nor through a
+// symlink extracted before them.
+func archiveTarget(dir, name string) (string, error) {
+	clean := filepath.Clean("/" + name)
+	if clean == "/" {
+		return dir, nil
+	}
+	target := filepath.Join(dir, clean)
+	parent, err := filepath.EvalSymlinks(filepath.Dir(target))
+	if err != nil {
+		return "", err
+	}
+	if parent != dir && !strings.HasPrefix(parent, dir+"/") {
+		return "", fmt.Errorf("archive entry %s is outside of %s", name, dir)
+	}
+	return filepath.Join(parent, filepath.Base(target)), nil
+}
+
+// checkEntryName refuses the entry entry of the archive of name unless it
+// is name or below it.
+func checkEntryName(entry, name string) error {
+	clean := path.Clean("/" + entry)
+	if clean != "/"+name && !strings.HasPrefix(clean, "/"+name+"/") {
+		return fmt.Errorf("archive entry %s is not part of %s", entry, name)
+	}
+	return nil
+}
+
+// removeEntryTarget removes what is at target before an entry of an
+// archive is extracted there, so that nothing is written through a
+// symlink of an earlier entry. Directories are kept, as an entry cannot
+// replace them.
+func removeEntryTarget(name, target string) error {
+	fi, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("archive entry %s would replace the directory %s", name, target)
+	}
+	return os.Remove(target)
+}
+
+// extractFile writes the regular file of hdr, read from r, to target,
+// with its owner, mode and extended attributes set through the open file.
+func extractFile(hdr *tar.Header, r io.Reader, target string) error {
+	if err := removeEntryTarget(hdr.Name, target); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL|unix.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	if err := setFileAttrs(f, hdr); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// extractDir creates the directory of hdr at target, replacing anything
+// else there, and sets its owner, mode and extended attributes.
+func extractDir(hdr *tar.Header, target string) error {
+	fi, err := os.Lstat(target)
+	if err == nil && !fi.IsDir() {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(target, os.FileMode(hdr.Mode).Perm()); err != nil && !os.IsExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return setFileAttrs(f, hdr)
+}
+
+// setFileAttrs sets the owner and mode of hdr on the open file f, and its
+// extended attributes on the path of f without following it. Changing the owner clears setuid bits and file
+// capabilities, so the mode and extended attributes come after it.
+func setFileAttrs(f *os.File, hdr *tar.Header) error {
+	if err := f.Chown(hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if err := f.Chmod(os.FileMode(hdr.Mode)&os.ModePerm | setidBits(hdr.Mode)); err != nil {
+		return err
+	}
+	for name, value := range hdr.Xattrs {
+		if err := xattr.Setxattr(f.Name(), name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setTimes sets the modification time of target, not of what it links to.
+func setTimes(target string, mtime time.Time) error {
+	ts := unix.NsecToTimespec(mtime.UnixNano())
+	return unix.UtimesNanoAt(unix.AT_FDCWD, target, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// ExtractArchive extracts the tar archive of name, as written by
+// WriteArchive, read from r into the directory dir, restoring ownership,
+// modes, times and extended attributes. The archive may come from an
+// untrusted guest: entries other than name and what is below it are
+// refused, as are device nodes, nothing is extracted outside of dir and no
+// symlink is followed, whether it was there before or extracted from the
+// archive. Setuid, setgid and sticky bits are only kept with keepSetid.
+func ExtractArchive(r io.Reader, dir, name string, keepSetid bool) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return fmt.Errorf("invalid archive name %q", name)
+	}
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	type dirTimes struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTimes
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkEntryName(hdr.Name, name); err != nil {
+			return err
+		}
+		if !keepSetid {
+			hdr.Mode &^= 07000
+		}
+		target, err := archiveTarget(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := extractDir(hdr, target); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirTimes{target, hdr.ModTime})
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+			if err := extractFile(hdr, tr, target); err != nil {
+				return err
+			}
+			if err := setTimes(target, hdr.ModTime); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeSymlink:
+			if err := removeEntryTarget(hdr.Name, target); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			if err := checkEntryName(hdr.Linkname, name); err != nil {
+				return err
+			}
+			source, err := archiveTarget(dir, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := removeEntryTarget(hdr.Name, target); err != nil {
+				return err
+			}
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+		case tar.TypeChar, tar.TypeBlock:
+			// A device node would give access to the device of the host.
+			return fmt.Errorf("archive entry %s is a device", hdr.Name)
+		case tar.TypeFifo:
+			if err := removeEntryTarget(hdr.Name, target); err != nil {
+				return err
+			}
+			if err := unix.Mkfifo(target, uint32(mode)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("archive entry %s has unsupported type %q", hdr.Name, hdr.Typeflag)
+		}
+		// Links and fifos are not opened to set their attributes.
+		// Hard links may be to symlinks, so they are checked first.
+		if err := unix.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+		fi, err := os.Lstat(target)
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			if err := os.Chmod(target, mode|setidBits(hdr.Mode)); err != nil {
+				return err
+			}
+			for name, value := range hdr.Xattrs {
+				if err := xattr.Setxattr(target, name, value); err != nil {
+					return err
+				}
+			}
+		}
+		if err := setTimes(target, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	// Directories get their times last, once nothing is written in them.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setTimes(dirs[i].path, dirs[i].mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setidBits converts the setuid, setgid and sticky bits of a tar mode to
+// an os.FileMode.
+func setidBits(mode int64) os.FileMode {
+	var m os.FileMode
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
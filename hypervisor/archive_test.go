@@ -0,0 +1,236 @@
+package hypervisor
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/harche/runvm/libcontainer/xattr"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	src, err := ioutil.TempDir("", "runvm-archive-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "runvm-archive-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	dir := filepath.Join(src, "app")
+	if err := os.MkdirAll(filepath.Join(dir, "conf"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "conf", "app.yaml")
+	if err := ioutil.WriteFile(file, []byte("port: 80\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("conf/app.yaml", filepath.Join(dir, "app.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	withXattr := xattr.XattrEnabled(file)
+	if withXattr {
+		if err := xattr.Setxattr(file, "user.origin", "host"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var archive bytes.Buffer
+	if err := WriteArchive(&archive, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExtractArchive(&archive, dst, "app", false); err != nil {
+		t.Fatal(err)
+	}
+
+	copied := filepath.Join(dst, "app", "conf", "app.yaml")
+	data, err := ioutil.ReadFile(copied)
+	if err != nil || string(data) != "port: 80\n" {
+		t.Fatalf("Unexpected content %q: %v", data, err)
+	}
+	fi, err := os.Stat(copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("Expected mode 0640 and time %v, got %v %v", mtime, fi.Mode(), fi.ModTime())
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "app", "conf")); err != nil || fi.Mode().Perm() != 0750 {
+		t.Errorf("Expected directory mode 0750, got %v %v", fi, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "app", "app.yaml")); err != nil || link != "conf/app.yaml" {
+		t.Errorf("Expected the symlink to be kept, got %q %v", link, err)
+	}
+	if withXattr {
+		if value, err := xattr.Getxattr(copied, "user.origin"); err != nil || value != "host" {
+			t.Errorf("Expected the extended attribute to be kept, got %q %v", value, err)
+		}
+	}
+}
+
+func TestExtractArchiveEscape(t *testing.T) {
+	dst, err := ioutil.TempDir("", "runvm-archive-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	for _, c := range []struct {
+		name    string
+		headers []*tar.Header
+		refused bool
+	}{
+		// Names are kept inside the directory.
+		{"escaped", []*tar.Header{{Name: "../escaped", Typeflag: tar.TypeReg, Mode: 0644}}, false},
+		{"out", []*tar.Header{
+			{Name: "out", Typeflag: tar.TypeSymlink, Linkname: "/tmp", Mode: 0777},
+			{Name: "out/escaped", Typeflag: tar.TypeReg, Mode: 0644},
+		}, true},
+	} {
+		headers := c.headers
+		var archive bytes.Buffer
+		tw := tar.NewWriter(&archive)
+		for _, hdr := range headers {
+			hdr.Uid, hdr.Gid = os.Getuid(), os.Getgid()
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tw.Close()
+		err := ExtractArchive(&archive, dst, c.name, false)
+		last := headers[len(headers)-1].Name
+		if (err != nil) != c.refused {
+			t.Errorf("Expected %s to be refused: %v, got %v", last, c.refused, err)
+		}
+		if _, err := os.Lstat(filepath.Join(filepath.Dir(dst), "escaped")); err == nil {
+			t.Errorf("%s was extracted outside of %s", last, dst)
+		}
+		if _, err := os.Lstat("/tmp/escaped"); err == nil {
+			t.Errorf("%s was extracted outside of %s", last, dst)
+		}
+	}
+}
+
+func TestExtractArchiveSymlinkReplaced(t *testing.T) {
+	dst, err := ioutil.TempDir("", "runvm-archive-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	host, err := ioutil.TempDir("", "runvm-archive-host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(host)
+	passwd := filepath.Join(host, "passwd")
+	if err := ioutil.WriteFile(passwd, []byte("root:x:0:0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file entry replaces the symlink before it instead of writing to
+	// what it points to.
+	content := "guest\n"
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, hdr := range []*tar.Header{
+		{Name: "x", Typeflag: tar.TypeSymlink, Linkname: passwd, Mode: 0777},
+		{Name: "x", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))},
+	} {
+		hdr.Uid, hdr.Gid = os.Getuid(), os.Getgid()
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	if err := ExtractArchive(&archive, dst, "x", false); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(passwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "root:x:0:0\n" {
+		t.Errorf("Expected %s to be left alone, got %q", passwd, data)
+	}
+	x := filepath.Join(dst, "x")
+	fi, err := os.Lstat(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.Mode().IsRegular() {
+		t.Fatalf("Expected %s to be a regular file, got %s", x, fi.Mode())
+	}
+	if data, err := ioutil.ReadFile(x); err != nil || string(data) != content {
+		t.Errorf("Expected %s to contain %q, got %q %v", x, content, data, err)
+	}
+}
+
+func TestExtractArchiveUntrusted(t *testing.T) {
+	dst, err := ioutil.TempDir("", "runvm-archive-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	archiveOf := func(headers ...*tar.Header) *bytes.Buffer {
+		var archive bytes.Buffer
+		tw := tar.NewWriter(&archive)
+		for _, hdr := range headers {
+			hdr.Uid, hdr.Gid = os.Getuid(), os.Getgid()
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tw.Close()
+		return &archive
+	}
+
+	for _, c := range []struct {
+		name string
+		hdr  *tar.Header
+	}{
+		{"dev", &tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3}},
+		{"dev", &tar.Header{Name: "dev/sda", Typeflag: tar.TypeBlock, Mode: 0666, Devmajor: 8}},
+		{"app", &tar.Header{Name: "other", Typeflag: tar.TypeReg, Mode: 0644}},
+		{"app", &tar.Header{Name: "app/../other", Typeflag: tar.TypeReg, Mode: 0644}},
+		{"app", &tar.Header{Name: "app/passwd", Typeflag: tar.TypeLink, Linkname: "other"}},
+	} {
+		if err := ExtractArchive(archiveOf(c.hdr), dst, c.name, false); err == nil {
+			t.Errorf("Expected %s to be refused in the archive of %s", c.hdr.Name, c.name)
+		}
+	}
+	for _, name := range []string{"dev/null", "dev/sda", "other", "app/passwd"} {
+		if _, err := os.Lstat(filepath.Join(dst, name)); err == nil {
+			t.Errorf("Expected %s not to be extracted", name)
+		}
+	}
+
+	for _, keep := range []bool{false, true} {
+		hdr := &tar.Header{Name: "su", Typeflag: tar.TypeReg, Mode: 04755}
+		if err := ExtractArchive(archiveOf(hdr), dst, "su", keep); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(filepath.Join(dst, "su"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if setuid := fi.Mode()&os.ModeSetuid != 0; setuid != keep {
+			t.Errorf("Expected setuid %v with keepSetid %v, got %s", keep, keep, fi.Mode())
+		}
+	}
+}
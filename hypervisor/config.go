@@ -0,0 +1,338 @@
+package hypervisor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	// ConfigVersion is the version of the configuration schema. Files
+	// that do not give a Version are read as this version.
+	ConfigVersion = 1
+
+	// SystemConfigFile is layered over the defaults when it exists.
+	SystemConfigFile = "/etc/runvm/config.json"
+
+	// ConfigEnvPrefix prefixes the environment variables that override a
+	// field of the configuration, e.g. RUNVM_NUM_CPU for NumCPU. Lists
+	// are given as JSON.
+	ConfigEnvPrefix = "RUNVM_"
+)
+
+// ConfigError is an invalid configuration. Field names the offending
+// field and Source the file or environment variable it came from, if
+// known.
+type ConfigError struct {
+	Source string
+	Field  string
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	msg := "hypervisor config"
+	if e.Source != "" {
+		msg += " " + e.Source
+	}
+	if e.Field != "" {
+		msg += ": " + e.Field
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func configErrorf(field, format string, args ...interface{}) error {
+	return &ConfigError{Field: field, Err: fmt.Errorf(format, args...)}
+}
+
+// DefaultConfig returns the configuration used where neither a file nor
+// the environment set a field.
+func DefaultConfig() *Configuration {
+	return &Configuration{
+		Version:            ConfigVersion,
+		Name:               KVM,
+		URI:                DefaultURI,
+		OriginalDiskPath:   OriginalDiskPath,
+		ConsoleLogMaxSize:  DefaultConsoleLogMaxSize,
+		ConsoleLogMaxFiles: DefaultConsoleLogMaxFiles,
+		NumCPU:             NumCPU,
+		DefaultMaxCpus:     DefaultMaxCpus,
+		DefaultMaxMem:      DefaultMaxMem,
+		DefaultMem:         DefaultMem,
+		MemoryOverhead:     DefaultMemoryOverhead,
+		PoolRefill:         PoolRefillAuto,
+		TemplateDir:        DefaultTemplateDir,
+		BalloonReserve:     DefaultBalloonReserve,
+		WatchdogAction:     WatchdogReset,
+		RestartPolicy:      RestartNever,
+		CrashDumpDir:       DefaultCrashDumpDir,
+		CrashDumpFormat:    CrashDumpELF,
+		Graphics:           GraphicsNone,
+	}
+}
+
+// LoadConfig returns the effective configuration. It starts from
+// DefaultConfig and layers SystemConfigFile, if it exists, then file, if
+// not empty, then the RUNVM_* environment. Each layer only changes the
+// fields it sets.
+func LoadConfig(file string) (*Configuration, error) {
+	config := DefaultConfig()
+	if err := config.mergeFile(SystemConfigFile, true); err != nil {
+		return nil, err
+	}
+	if file != "" {
+		if err := config.mergeFile(file, false); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.mergeEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// mergeFile layers the configuration file path over c. A missing file is
+// skipped if optional.
+func (c *Configuration) mergeFile(path string, optional bool) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if optional && os.IsNotExist(err) {
+			return nil
+		}
+		return &ConfigError{Source: path, Err: err}
+	}
+	if err := c.merge(data); err != nil {
+		err.(*ConfigError).Source = path
+		return err
+	}
+	return nil
+}
+
+// merge layers the JSON configuration data over c. Unknown fields are
+// rejected so that typos do not silently fall back to the defaults.
+func (c *Configuration) merge(data []byte) error {
+	version := c.Version
+	c.Version = 0
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		switch e := err.(type) {
+		case *json.UnmarshalTypeError:
+			return &ConfigError{Field: e.Field, Err: fmt.Errorf("expected %s, got %s", e.Type, e.Value)}
+		case *json.SyntaxError:
+			return &ConfigError{Err: fmt.Errorf("%v at offset %d", e, e.Offset)}
+		default:
+			if field := strings.TrimPrefix(err.Error(), "json: unknown field "); field != err.Error() {
+				field, _ = strconv.Unquote(field)
+				return &ConfigError{Field: field, Err: fmt.Errorf("unknown field")}
+			}
+			return &ConfigError{Err: err}
+		}
+	}
+	switch c.Version {
+	case 0:
+		c.Version = version
+	case ConfigVersion:
+	default:
+		return configErrorf("Version", "unsupported version %d, expected %d", c.Version, ConfigVersion)
+	}
+	return nil
+}
+
+// configEnvName returns the environment variable of field, e.g.
+// RUNVM_NUM_CPU for NumCPU and RUNVM_URI for URI.
+func configEnvName(field string) string {
+	runes := []rune(field)
+	var name []rune
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) &&
+			(unicode.IsLower(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			name = append(name, '_')
+		}
+		name = append(name, unicode.ToUpper(r))
+	}
+	return ConfigEnvPrefix + string(name)
+}
+
+// mergeEnv layers the RUNVM_* variables of environ over c.
+func (c *Configuration) mergeEnv(environ []string) error {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i).Name
+		if field == "Version" {
+			continue
+		}
+		name := configEnvName(field)
+		value, ok := env[name]
+		if !ok {
+			continue
+		}
+		if err := setField(v.Field(i), value); err != nil {
+			return &ConfigError{Source: name, Field: field, Err: err}
+		}
+	}
+	return nil
+}
+
+func setField(f reflect.Value, value string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		f.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		f.SetBool(b)
+	default:
+		decoder := json.NewDecoder(strings.NewReader(value))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(f.Addr().Interface()); err != nil {
+			return fmt.Errorf("invalid JSON value: %v", err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the fields of c, naming the first invalid one.
+func (c *Configuration) Validate() error {
+	if c.Version != ConfigVersion {
+		return configErrorf("Version", "unsupported version %d, expected %d", c.Version, ConfigVersion)
+	}
+	if c.Name != KVM {
+		return configErrorf("Name", "unknown hypervisor %q", c.Name)
+	}
+	if c.URI == "" {
+		return configErrorf("URI", "must not be empty")
+	}
+	if !filepath.IsAbs(c.OriginalDiskPath) {
+		return configErrorf("OriginalDiskPath", "must be an absolute path, got %q", c.OriginalDiskPath)
+	}
+	for _, f := range []struct {
+		name  string
+		value int
+		min   int
+	}{
+		{"ConsoleLogMaxSize", c.ConsoleLogMaxSize, 1},
+		{"ConsoleLogMaxFiles", c.ConsoleLogMaxFiles, 1},
+		{"NumCPU", c.NumCPU, 1},
+		{"DefaultMaxCpus", c.DefaultMaxCpus, 1},
+		{"DefaultMem", c.DefaultMem, 1},
+		{"DefaultMaxMem", c.DefaultMaxMem, 1},
+		{"MemoryOverhead", c.MemoryOverhead, 0},
+		{"PoolSize", c.PoolSize, 0},
+		{"BalloonReserve", c.BalloonReserve, 0},
+	} {
+		if f.value < f.min {
+			return configErrorf(f.name, "must be at least %d, got %d", f.min, f.value)
+		}
+	}
+	if c.QemuUser != "" {
+		if parts := strings.Split(c.QemuUser, ":"); len(parts) > 2 || parts[0] == "" {
+			return configErrorf("QemuUser", "must be \"user\" or \"user:group\", got %q", c.QemuUser)
+		}
+	}
+	names := make(map[string]bool)
+	for i, class := range c.PoolClasses {
+		field := fmt.Sprintf("PoolClasses[%d]", i)
+		if class.Name == "" || strings.ContainsRune(class.Name, '/') {
+			return configErrorf(field+".Name", "invalid pool class name %q", class.Name)
+		}
+		if names[class.Name] {
+			return configErrorf(field+".Name", "duplicate pool class %q", class.Name)
+		}
+		names[class.Name] = true
+		if class.NumCPU < 1 {
+			return configErrorf(field+".NumCPU", "must be at least 1, got %d", class.NumCPU)
+		}
+		if class.Memory < 1 {
+			return configErrorf(field+".Memory", "must be at least 1, got %d", class.Memory)
+		}
+	}
+	switch c.PoolRefill {
+	case PoolRefillAuto, PoolRefillManual:
+	default:
+		return configErrorf("PoolRefill", "must be %q or %q, got %q", PoolRefillAuto, PoolRefillManual, c.PoolRefill)
+	}
+	switch c.WatchdogModel {
+	case "", "i6300esb", "ib700", "itco", "diag288":
+	default:
+		return configErrorf("WatchdogModel", "unknown watchdog model %q", c.WatchdogModel)
+	}
+	switch c.WatchdogAction {
+	case WatchdogReset, WatchdogPoweroff, WatchdogDump:
+	default:
+		return configErrorf("WatchdogAction", "must be %q, %q or %q, got %q", WatchdogReset, WatchdogPoweroff, WatchdogDump, c.WatchdogAction)
+	}
+	if _, err := ParseRestartPolicy(c.RestartPolicy); err != nil {
+		return &ConfigError{Field: "RestartPolicy", Err: err}
+	}
+	if !filepath.IsAbs(c.TemplateDir) {
+		return configErrorf("TemplateDir", "must be an absolute path, got %q", c.TemplateDir)
+	}
+	if !filepath.IsAbs(c.CrashDumpDir) {
+		return configErrorf("CrashDumpDir", "must be an absolute path, got %q", c.CrashDumpDir)
+	}
+	if _, ok := crashDumpFormats[c.CrashDumpFormat]; !ok {
+		return configErrorf("CrashDumpFormat", "unknown format %q", c.CrashDumpFormat)
+	}
+	switch c.Graphics {
+	case GraphicsNone, GraphicsVNCSocket, GraphicsSpice:
+	default:
+		return configErrorf("Graphics", "must be %q, %q or %q, got %q", GraphicsNone, GraphicsVNCSocket, GraphicsSpice, c.Graphics)
+	}
+	return nil
+}
+
+// The configuration is loaded once per invocation of runvm and shared by
+// every hypervisor created during it.
+var current struct {
+	sync.Mutex
+	file   string
+	config *Configuration
+	err    error
+	loaded bool
+}
+
+// SetConfigFile sets the file layered over SystemConfigFile, as given
+// with --hypervisor-config. It must be called before ParseConfig.
+func SetConfigFile(file string) {
+	current.Lock()
+	defer current.Unlock()
+	current.file = file
+}
+
+// ParseConfig returns the configuration of this invocation, loading it
+// on first use. Callers must not modify it.
+func ParseConfig() (*Configuration, error) {
+	current.Lock()
+	defer current.Unlock()
+	if !current.loaded {
+		current.config, current.err = LoadConfig(current.file)
+		current.loaded = true
+	}
+	return current.config, current.err
+}
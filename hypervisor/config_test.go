@@ -0,0 +1,122 @@
+package hypervisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDefaultConfigValid(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigMergeKeepsDefaults(t *testing.T) {
+	config := DefaultConfig()
+	if err := config.merge([]byte(`{"NumCPU": 2, "PoolSize": 0}`)); err != nil {
+		t.Fatal(err)
+	}
+	if config.NumCPU != 2 || config.DefaultMem != DefaultMem || config.URI != DefaultURI {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	if config.Version != ConfigVersion {
+		t.Errorf("Expected version %d, got %d", ConfigVersion, config.Version)
+	}
+}
+
+func TestConfigMergeErrors(t *testing.T) {
+	for data, field := range map[string]string{
+		`{"NumCPUs": 2}`:     "NumCPUs",
+		`{"NumCPU": "two"}`:  "NumCPU",
+		`{"Version": 2}`:     "Version",
+		`{"PoolClasses": 1}`: "PoolClasses",
+	} {
+		err := DefaultConfig().merge([]byte(data))
+		cerr, ok := err.(*ConfigError)
+		if !ok || cerr.Field != field {
+			t.Errorf("Expected an error naming %s for %s, got %v", field, data, err)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for field, set := range map[string]func(*Configuration){
+		"Name":                  func(c *Configuration) { c.Name = "xen" },
+		"NumCPU":                func(c *Configuration) { c.NumCPU = 0 },
+		"DefaultMem":            func(c *Configuration) { c.DefaultMem = 0 },
+		"OriginalDiskPath":      func(c *Configuration) { c.OriginalDiskPath = "disk.img" },
+		"PoolRefill":            func(c *Configuration) { c.PoolRefill = "" },
+		"PoolClasses[1].Name":   func(c *Configuration) { c.PoolClasses = []PoolClass{testClasses[0], testClasses[0]} },
+		"PoolClasses[0].Memory": func(c *Configuration) { c.PoolClasses = []PoolClass{{Name: "small", NumCPU: 1}} },
+		"Graphics":              func(c *Configuration) { c.Graphics = "vnc" },
+	} {
+		config := DefaultConfig()
+		set(config)
+		err := config.Validate()
+		if cerr, ok := err.(*ConfigError); !ok || cerr.Field != field {
+			t.Errorf("Expected an error naming %s, got %v", field, err)
+		}
+	}
+}
+
+func TestConfigEnvName(t *testing.T) {
+	for field, name := range map[string]string{
+		"URI":               "RUNVM_URI",
+		"NumCPU":            "RUNVM_NUM_CPU",
+		"DefaultMaxCpus":    "RUNVM_DEFAULT_MAX_CPUS",
+		"ConsoleLogMaxSize": "RUNVM_CONSOLE_LOG_MAX_SIZE",
+	} {
+		if got := configEnvName(field); got != name {
+			t.Errorf("Expected %s for %s, got %s", name, field, got)
+		}
+	}
+}
+
+func TestConfigMergeEnv(t *testing.T) {
+	config := DefaultConfig()
+	err := config.mergeEnv([]string{
+		"RUNVM_NUM_CPU=4",
+		"RUNVM_POOL_PAUSED=true",
+		`RUNVM_POOL_CLASSES=[{"Name":"small","NumCPU":1,"Memory":512}]`,
+		"PATH=/bin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.NumCPU != 4 || !config.PoolPaused || len(config.PoolClasses) != 1 {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	err = config.mergeEnv([]string{"RUNVM_NUM_CPU=four"})
+	if cerr, ok := err.(*ConfigError); !ok || cerr.Field != "NumCPU" || cerr.Source != "RUNVM_NUM_CPU" {
+		t.Errorf("Expected an error naming NumCPU, got %v", err)
+	}
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runvm-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(file, []byte(`{"Version": 1, "NumCPU": 2, "DefaultMem": 2048}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("RUNVM_NUM_CPU", "3")
+	defer os.Unsetenv("RUNVM_NUM_CPU")
+
+	config, err := LoadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.NumCPU != 3 || config.DefaultMem != 2048 {
+		t.Errorf("Expected the environment over the file, got %+v", config)
+	}
+	if _, err := LoadConfig(filepath.Join(dir, "missing.json")); err == nil || !strings.Contains(err.Error(), "missing.json") {
+		t.Errorf("Expected an error naming the missing file, got %v", err)
+	}
+}
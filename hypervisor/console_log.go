@@ -0,0 +1,154 @@
+package hypervisor
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// DefaultConsoleLogMaxSize is the size in MiB at which a console log
+	// is rotated.
+	DefaultConsoleLogMaxSize = 1
+	// DefaultConsoleLogMaxFiles is the number of rotated console logs
+	// kept next to the current one.
+	DefaultConsoleLogMaxFiles = 3
+)
+
+// Consoles of a virtual machine. Each has a socket and a log file named
+// after it in the VM state dir.
+const (
+	SerialConsole = "serial"
+	AppConsole    = "app"
+)
+
+func consoleSockPath(dir, name string) string {
+	return filepath.Join(dir, name+".sock")
+}
+
+// ConsoleLogPath returns the log file of console name for the virtual
+// machine whose state dir is dir.
+func ConsoleLogPath(dir, name string) string {
+	return filepath.Join(dir, name+".log")
+}
+
+// ConsoleLogFiles returns the existing files of the console log at path,
+// oldest first and ending with the current file.
+func ConsoleLogFiles(path string) []string {
+	var rotated []string
+	for i := 1; ; i++ {
+		name := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(name); err != nil {
+			break
+		}
+		rotated = append([]string{name}, rotated...)
+	}
+	if _, err := os.Stat(path); err == nil {
+		rotated = append(rotated, path)
+	}
+	return rotated
+}
+
+type logConfig struct {
+	maxSize  int64
+	maxFiles int
+}
+
+// rotatingFile is a log file that is rotated once it reaches maxSize bytes.
+// Rotated files are kept as path.1 (newest) to path.<maxFiles> (oldest).
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	if r.maxFiles == 0 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return r.open()
+	}
+	for i := r.maxFiles; i > 0; i-- {
+		src := r.path
+		if i > 1 {
+			src = fmt.Sprintf("%s.%d", r.path, i-1)
+		}
+		if err := os.Rename(src, fmt.Sprintf("%s.%d", r.path, i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
+
+// openConsoleLog opens the log file of console name in dir.
+func (c *logConfig) openConsoleLog(dir, name string) (*rotatingFile, error) {
+	return openRotatingFile(ConsoleLogPath(dir, name), c.maxSize, c.maxFiles)
+}
+
+// logConsole copies the output of console name in dir to its log file
+// until the virtual machine closes the console.
+func (c *logConfig) logConsole(dir, name string) error {
+	conn, err := net.DialTimeout("unix", consoleSockPath(dir, name), 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log, err := c.openConsoleLog(dir, name)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	_, err = io.Copy(log, conn)
+	return err
+}
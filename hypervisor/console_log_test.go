@@ -0,0 +1,75 @@
+package hypervisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	log, err := openRotatingFile(path, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"aaa\n", "bbb\n", "ccc\n", "ddd\n"} {
+		if _, err := log.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := ConsoleLogFiles(path)
+	expected := []string{path + ".2", path + ".1", path}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("Expected %v, got %v", expected, files)
+	}
+	var content string
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content += string(data)
+	}
+	if content != "bbb\nccc\nddd\n" {
+		t.Errorf("Expected the oldest file to be dropped, got %q", content)
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "serial.log")
+	for _, line := range []string{"a\n", "b\n"} {
+		log, err := openRotatingFile(path, 1024, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := log.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		log.Close()
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "a\nb\n" {
+		t.Errorf("Expected a\\nb\\n, got %q", data)
+	}
+}
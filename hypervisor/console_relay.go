@@ -0,0 +1,316 @@
+package hypervisor
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// consoleBufferSize is how much of the latest output of the
+	// application console is replayed to a client when it attaches.
+	consoleBufferSize = 64 << 10
+
+	// attachWriteTimeout is how long the relay waits for a client to take
+	// output before it drops the client, so that a stuck client cannot
+	// stall the guest.
+	attachWriteTimeout = 5 * time.Second
+
+	// Messages sent by attached clients, as a type byte, a big endian
+	// uint32 length and the payload. The relay sends the console output
+	// as it is.
+	attachInput  = 'i'
+	attachResize = 'r'
+)
+
+func attachSockPath(dir string) string {
+	return filepath.Join(dir, "attach.sock")
+}
+
+// ringBuffer keeps the last size bytes written to it.
+type ringBuffer struct {
+	data []byte
+	size int
+}
+
+func (r *ringBuffer) Write(p []byte) (int, error) {
+	r.data = append(r.data, p...)
+	if over := len(r.data) - r.size; over > 0 {
+		r.data = append(r.data[:0], r.data[over:]...)
+	}
+	return len(p), nil
+}
+
+func (r *ringBuffer) Bytes() []byte {
+	return r.data
+}
+
+// consoleRelay drains the application console of a detached virtual
+// machine, so that the guest never blocks on it, and shares it with the
+// clients attached to it.
+type consoleRelay struct {
+	dir     string
+	console net.Conn
+	log     io.Writer
+
+	mu      sync.Mutex
+	buffer  ringBuffer
+	clients map[net.Conn]bool
+}
+
+// relayConsole relays the application console of the virtual machine in
+// dir until the virtual machine closes it. Its output also goes to log.
+func relayConsole(dir string, log io.Writer) error {
+	console, err := net.DialTimeout("unix", consoleSockPath(dir, AppConsole), 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer console.Close()
+	path := attachSockPath(dir)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	defer l.Close()
+
+	r := &consoleRelay{
+		dir:     dir,
+		console: console,
+		log:     log,
+		buffer:  ringBuffer{size: consoleBufferSize},
+		clients: make(map[net.Conn]bool),
+	}
+	go r.accept(l)
+	defer r.closeClients()
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := console.Read(buf)
+		if n > 0 {
+			r.output(buf[:n])
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// output logs and buffers p and sends it to the attached clients.
+func (r *consoleRelay) output(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.log.Write(p)
+	r.buffer.Write(p)
+	for client := range r.clients {
+		client.SetWriteDeadline(time.Now().Add(attachWriteTimeout))
+		if _, err := client.Write(p); err != nil {
+			logrus.Debugf("dropping console client: %v", err)
+			client.Close()
+			delete(r.clients, client)
+		}
+	}
+}
+
+func (r *consoleRelay) accept(l net.Listener) {
+	for {
+		client, err := l.Accept()
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		client.SetWriteDeadline(time.Now().Add(attachWriteTimeout))
+		if _, err := client.Write(r.buffer.Bytes()); err != nil {
+			client.Close()
+		} else {
+			r.clients[client] = true
+			go r.serve(client)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// serve forwards the input and terminal size of client to the guest.
+func (r *consoleRelay) serve(client net.Conn) {
+	reader := bufio.NewReader(client)
+	for {
+		kind, payload, err := readAttachMessage(reader)
+		if err == nil {
+			switch kind {
+			case attachInput:
+				_, err = r.console.Write(payload)
+			case attachResize:
+				if len(payload) != 4 {
+					err = fmt.Errorf("invalid resize message")
+					break
+				}
+				err = resizeConsole(r.dir, binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:]))
+			default:
+				err = fmt.Errorf("unknown message %q", kind)
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				logrus.Debugf("console client: %v", err)
+			}
+			r.mu.Lock()
+			delete(r.clients, client)
+			r.mu.Unlock()
+			client.Close()
+			return
+		}
+	}
+}
+
+func (r *consoleRelay) closeClients() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for client := range r.clients {
+		client.Close()
+		delete(r.clients, client)
+	}
+}
+
+func writeAttachMessage(w io.Writer, kind byte, payload []byte) error {
+	msg := make([]byte, 5+len(payload))
+	msg[0] = kind
+	binary.BigEndian.PutUint32(msg[1:5], uint32(len(payload)))
+	copy(msg[5:], payload)
+	_, err := w.Write(msg)
+	return err
+}
+
+func readAttachMessage(reader *bufio.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > 1<<20 {
+		return 0, nil, fmt.Errorf("message of %d bytes is too large", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// resizeRequest asks the guest agent to set the size of the terminal of
+// the application console.
+type resizeRequest struct {
+	Resize struct {
+		Rows uint16 `json:"rows"`
+		Cols uint16 `json:"cols"`
+	} `json:"resize"`
+}
+
+func resizeConsole(dir string, rows, cols uint16) error {
+	var req resizeRequest
+	req.Resize.Rows, req.Resize.Cols = rows, cols
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	conn, err := dialAgent(dir, agentTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return readAgentReply(bufio.NewReader(conn))
+}
+
+// ConsoleAttachment is a client of the console relay of a virtual
+// machine. Reads return the output of the application console, replaying
+// what the relay buffered first, and writes send input to it.
+type ConsoleAttachment struct {
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+func (k *KVMHypervisor) AttachConsole(id string) (*ConsoleAttachment, error) {
+	conn, err := net.Dial("unix", attachSockPath(StateDir(k.root, id)))
+	if err != nil {
+		return nil, fmt.Errorf("console of vm %s is not relayed, only detached containers can be attached to: %v", id, err)
+	}
+	return &ConsoleAttachment{conn: conn}, nil
+}
+
+func (a *ConsoleAttachment) Read(p []byte) (int, error) {
+	return a.conn.Read(p)
+}
+
+func (a *ConsoleAttachment) Write(p []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := writeAttachMessage(a.conn, attachInput, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Resize sets the terminal size of the application console.
+func (a *ConsoleAttachment) Resize(rows, cols uint16) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint16(payload, rows)
+	binary.BigEndian.PutUint16(payload[2:], cols)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return writeAttachMessage(a.conn, attachResize, payload)
+}
+
+func (a *ConsoleAttachment) Close() error {
+	return a.conn.Close()
+}
+
+// ServeConsoles logs the serial console of the virtual machine id when
+// console logging is enabled, and relays its application console, until
+// the virtual machine closes them. It is used while no runvm process is
+// attached to the virtual machine.
+func (k *KVMHypervisor) ServeConsoles(id string) error {
+	dir := StateDir(k.root, id)
+	errs := make(chan error, 2)
+	go func() {
+		if k.consoleLog == nil {
+			errs <- nil
+			return
+		}
+		errs <- k.consoleLog.logConsole(dir, SerialConsole)
+	}()
+	go func() {
+		var log io.Writer = ioutil.Discard
+		if k.consoleLog != nil {
+			f, err := k.consoleLog.openConsoleLog(dir, AppConsole)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer f.Close()
+			log = f
+		}
+		errs <- relayConsole(dir, log)
+	}()
+	err := <-errs
+	if rerr := <-errs; err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+package hypervisor
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRingBuffer(t *testing.T) {
+	r := ringBuffer{size: 8}
+	r.Write([]byte("hello"))
+	if string(r.Bytes()) != "hello" {
+		t.Errorf("Unexpected buffer %q", r.Bytes())
+	}
+	r.Write([]byte(" world"))
+	if string(r.Bytes()) != "lo world" {
+		t.Errorf("Expected the last 8 bytes, got %q", r.Bytes())
+	}
+}
+
+func TestAttachMessage(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeAttachMessage(&b, attachInput, []byte("ls\n")); err != nil {
+		t.Fatal(err)
+	}
+	kind, payload, err := readAttachMessage(bufio.NewReader(&b))
+	if err != nil || kind != attachInput || string(payload) != "ls\n" {
+		t.Errorf("Unexpected message %q %q %v", kind, payload, err)
+	}
+}
+
+func TestRelayConsole(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runvm-relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", consoleSockPath(dir, AppConsole))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var log bytes.Buffer
+	relayed := make(chan error, 1)
+	go func() {
+		relayed <- relayConsole(dir, &log)
+	}()
+	guest, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Output while nobody is attached is drained and buffered.
+	if _, err := guest.Write([]byte("booted\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("unix", attachSockPath(dir)); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &ConsoleAttachment{conn: conn}
+	defer client.Close()
+	reader := bufio.NewReader(client)
+	if line, err := reader.ReadString('\n'); err != nil || line != "booted\n" {
+		t.Fatalf("Expected the buffered output, got %q %v", line, err)
+	}
+	if _, err := guest.Write([]byte("ready\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := reader.ReadString('\n'); err != nil || line != "ready\n" {
+		t.Fatalf("Expected the live output, got %q %v", line, err)
+	}
+	if _, err := client.Write([]byte("exit\n")); err != nil {
+		t.Fatal(err)
+	}
+	input := make([]byte, 5)
+	if _, err := io.ReadFull(guest, input); err != nil || string(input) != "exit\n" {
+		t.Fatalf("Expected the input in the guest, got %q %v", input, err)
+	}
+
+	guest.Close()
+	if err := <-relayed; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("Expected the client to be closed with the console, got %v", err)
+	}
+	if log.String() != "booted\nready\n" {
+		t.Errorf("Unexpected log %q", log.String())
+	}
+	if _, err := os.Stat(attachSockPath(dir)); !os.IsNotExist(err) {
+		t.Errorf("Expected the attach socket to be removed, got %v", err)
+	}
+}
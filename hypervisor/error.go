@@ -0,0 +1,80 @@
+package hypervisor
+
+import "fmt"
+
+// ErrorCode identifies the step of a virtual machine operation that failed.
+type ErrorCode int
+
+// Hypervisor error codes.
+const (
+	// Connection errors
+	ConnectionFailed ErrorCode = iota
+
+	// Creation errors
+	StateDirFailed
+	DeltaDiskFailed
+	SeedImageFailed
+	DomainXmlFailed
+	DomainDefineFailed
+	DomainStartFailed
+	ConsoleFailed
+	SecurityFailed
+	PoolFailed
+	TemplateFailed
+	CgroupFailed
+
+	// Lookup errors
+	VMNotExists
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case ConnectionFailed:
+		return "Could not connect to hypervisor"
+	case StateDirFailed:
+		return "Could not create state directory"
+	case DeltaDiskFailed:
+		return "Could not create delta disk"
+	case SeedImageFailed:
+		return "Could not create seed image"
+	case DomainXmlFailed:
+		return "Could not create domain xml"
+	case DomainDefineFailed:
+		return "Could not define domain"
+	case DomainStartFailed:
+		return "Could not start domain"
+	case ConsoleFailed:
+		return "Could not connect to console"
+	case SecurityFailed:
+		return "Could not apply security settings"
+	case PoolFailed:
+		return "Could not use pooled guest"
+	case TemplateFailed:
+		return "Could not use template"
+	case CgroupFailed:
+		return "Could not move virtual machine into container cgroups"
+	case VMNotExists:
+		return "Virtual machine does not exist"
+	default:
+		return "Unknown error"
+	}
+}
+
+// Error is the error type returned by hypervisor operations. It records
+// which step failed and for which virtual machine.
+type Error struct {
+	Code ErrorCode
+	ID   string
+	Err  error
+}
+
+func newError(code ErrorCode, id string, err error) error {
+	return &Error{Code: code, ID: id, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.ID == "" {
+		return fmt.Sprintf("%s: %v", e.Code, e.Err)
+	}
+	return fmt.Sprintf("%s for vm %s: %v", e.Code, e.ID, e.Err)
+}
@@ -1,20 +1,55 @@
 package hypervisor
 
+import (
+	"fmt"
+)
 
 const (
 	KVM = "KVM"
+
+	DefaultURI = "qemu:///system"
 )
 
-func HypFactory() (hypervisor Hypervisor, err error){
+// HypFactory returns the configured hypervisor. root is the runvm state
+// directory; each virtual machine keeps its artifacts in StateDir(root, id).
+func HypFactory(root string) (hypervisor Hypervisor, err error){
 	config, err := ParseConfig()
 	if err != nil {
 		return nil, err
 	}
+	var consoleLog *logConfig
+	if config.ConsoleLog {
+		consoleLog = &logConfig{
+			maxSize:  int64(config.ConsoleLogMaxSize) << 20,
+			maxFiles: config.ConsoleLogMaxFiles,
+		}
+	}
+	var pool *poolConfig
+	if config.PoolSize > 0 {
+		pool = &poolConfig{
+			size:       config.PoolSize,
+			classes:    config.PoolClasses,
+			paused:     config.PoolPaused,
+			autoRefill: config.PoolAutoRefill(),
+		}
+	}
+	var balloon *balloonConfig
+	if config.BalloonPolicy {
+		balloon = &balloonConfig{reserve: uint64(config.BalloonReserve)}
+	}
+	dump := &dumpConfig{
+		dir:     config.CrashDumpDir,
+		format:  crashDumpFormats[config.CrashDumpFormat],
+		onCrash: config.CrashDump,
+	}
+	restartPolicy, err := ParseRestartPolicy(config.RestartPolicy)
+	if err != nil {
+		return nil, err
+	}
 	switch config.Name {
 	case KVM:
-		return new(KVMHypervisor), nil
+		return &KVMHypervisor{uri: config.URI, root: root, qemuUser: config.QemuUser, consoleLog: consoleLog, pool: pool, templateDir: config.TemplateDir, baseCfg: newBaseConfig(config), balloon: balloon, dump: dump, restartPolicy: restartPolicy}, nil
 	default:
-		return new(KVMHypervisor), nil
+		return nil, fmt.Errorf("unknown hypervisor %q", config.Name)
 	}
 }
-
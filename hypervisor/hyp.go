@@ -1,46 +1,92 @@
 package hypervisor
 
 import (
-	"path/filepath"
-	"os"
-	"encoding/json"
+	"io"
+	"net"
+	"time"
 
+	"github.com/harche/runvm/libcontainer/configs"
 )
 
+// Configuration is the hypervisor configuration, see LoadConfig. Zero
+// values are taken as given; fields left out keep their default.
 type Configuration struct {
+	// Version is the schema version, ConfigVersion.
+	Version int
 	Name string
+	// URI is the libvirt connection URI, e.g. qemu:///system or
+	// qemu:///session.
+	URI string
 	OriginalDiskPath string
+	// ConsoleLog enables logging of the serial and application consoles
+	// to files in the VM state dir, rotated at ConsoleLogMaxSize MiB with
+	// ConsoleLogMaxFiles old files kept.
+	ConsoleLog bool
+	ConsoleLogMaxSize int
+	ConsoleLogMaxFiles int
+	// QemuUser is the "user:group" QEMU runs as instead of root. The VM
+	// state dir is handed over to it.
+	QemuUser string
 	NumCPU int
 	DefaultMaxCpus int
 	DefaultMaxMem int
 	DefaultMem int
+	// MemoryOverhead is the memory in MiB left to QEMU when the guest is
+	// sized from the container's memory limit.
+	MemoryOverhead int
+	// PoolSize is the number of booted, idle guests kept for each of
+	// PoolClasses, or of a single class of the default size when none are
+	// given. Containers that fit a class start in one of them instead of
+	// booting a new guest. 0 disables the pool.
+	PoolSize int
+	PoolClasses []PoolClass
+	// PoolPaused keeps idle guests paused until they are handed out.
+	PoolPaused bool
+	// PoolRefill is PoolRefillAuto to top up the pool in the background
+	// after each container start, or PoolRefillManual to leave it to
+	// "runvm pool fill".
+	PoolRefill string
+	// TemplateDir holds the templates containers can be cloned from.
+	TemplateDir string
+	// BalloonPolicy resizes the memory balloon of running guests so that
+	// they keep BalloonReserve MiB free on top of what they use. It is off
+	// by default, leaving guests their full memory.
+	BalloonPolicy bool
+	BalloonReserve int
+	// WatchdogModel is the watchdog device of guests, "" for none, and
+	// WatchdogAction what it does when a hung guest stops feeding it:
+	// WatchdogReset, WatchdogPoweroff or WatchdogDump. Guests have no
+	// watchdog unless it is set, as arming it re-executes systemd in the
+	// guest.
+	WatchdogModel string
+	WatchdogAction string
+	// RestartPolicy is the default restart policy of containers, see
+	// ParseRestartPolicy.
+	RestartPolicy string
+	// CrashDump keeps guests that panic or whose watchdog fires until
+	// their memory is dumped to CrashDumpDir in CrashDumpFormat. The
+	// watchdog pauses the guest instead of taking WatchdogAction.
+	CrashDump       bool
+	CrashDumpDir    string
+	CrashDumpFormat string
+	// Graphics is the display of guests: GraphicsNone, GraphicsVNCSocket
+	// or GraphicsSpice.
+	Graphics string
 }
 
-
-func ParseConfig() (config *Configuration, err error) {
-	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
-	if err != nil {
-		return nil, err
-	}
-
-	file, err := os.Open(dir+"/hypervisor/config.json")
-	if err != nil {
-		file, err = os.Open("/etc/runvm/config.json")
-		if err != nil {
-			return nil, err
-		}
-	}
-	defer file.Close()
-
-	decoder := json.NewDecoder(file)
-	configuration := Configuration{}
-	err = decoder.Decode(&configuration)
-	if err != nil {
-		return nil, err
-	}
-	return &configuration, nil
+// PoolClass is a size of pooled guests. A container fits a class when its
+// resources give a guest of exactly NumCPU vCPUs and Memory MiB.
+type PoolClass struct {
+	Name   string
+	NumCPU int
+	Memory int
 }
 
+// PoolAutoRefill reports whether the pool is refilled after each container
+// start.
+func (c *Configuration) PoolAutoRefill() bool {
+	return c.PoolSize > 0 && c.PoolRefill == PoolRefillAuto
+}
 
 type VirtualMachine interface {
 	ID() string
@@ -51,6 +97,7 @@ type VirtualMachine interface {
 	Shutdown() error
 	Kill() error
 	Remove() error
+	IsRunning() (bool, error)
 }
 
 type NetInfo struct {
@@ -66,24 +113,256 @@ type VirtualMachineParams struct {
 	NetInfo NetInfo
         Detach  bool
 	Args    []string
-	Path    string
-	Env     map[string]string
+	Env     []string
 	Rootfs  string
 	DiskDir string
 	NetworkNSPath string
 	Mounts  map[string]string
+	// MountRelabels is the relabel option of the mounts that ask for
+	// one, by source: "z" to share the mount label with other containers,
+	// "Z" to keep it private, as in configs.Mount.
+	MountRelabels map[string]string
 	ResoveString []byte
 	HostsString []byte
 	CwD	string
+	// Terminal gives the process the application console as its
+	// terminal.
+	Terminal bool
 	Pid     string
+	// Security settings of the container, applied to QEMU and to the
+	// directories shared with the guest.
+	ProcessLabel    string
+	MountLabel      string
+	AppArmorProfile string
+	// QemuUser is the "+uid:+gid" QEMU runs as. It is set by the
+	// hypervisor from its configuration; empty means root.
+	QemuUser string
+	// CPU placement and bandwidth of the container, as in
+	// linux.resources.cpu.
+	CpusetCpus string
+	CpusetMems string
+	CpuQuota   int64
+	CpuPeriod  uint64
+	// Memory limits of the container in bytes, as in
+	// linux.resources.memory and linux.resources.hugepageLimits.
+	MemoryLimit       uint64
+	MemoryReservation uint64
+	HugepageLimits    []*configs.HugepageLimit
+	// CgroupPaths are the cgroups of the container by subsystem. QEMU is
+	// moved into them once the guest runs.
+	CgroupPaths map[string]string
+	// Template is the template the guest is cloned from instead of
+	// being booted, from the TemplateAnnotation of the container.
+	Template string
+
+	// watchdog arms the watchdog of the guest from its seed image.
+	watchdog bool
+	// displayPasswd is the SPICE password of the guest.
+	displayPasswd string
+}
+
+
+
+// EventType is a lifecycle change of a virtual machine.
+type EventType int
+
+const (
+	EventStarted EventType = iota
+	EventPaused
+	EventResumed
+	EventStopped
+	EventCrashed
+	// EventWatchdog is sent when the watchdog of the guest fires, before
+	// the guest stops.
+	EventWatchdog
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventStarted:
+		return "started"
+	case EventPaused:
+		return "paused"
+	case EventResumed:
+		return "resumed"
+	case EventStopped:
+		return "stopped"
+	case EventCrashed:
+		return "crashed"
+	case EventWatchdog:
+		return "watchdog"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is delivered by Hypervisor.Watch when a virtual machine changes state.
+type Event struct {
+	ID   string
+	Type EventType
+}
+
+// MemoryStats is the memory of a guest as reported by its balloon
+// driver. Sizes are in bytes.
+type MemoryStats struct {
+	// Maximum is the boot memory of the guest and Actual what the balloon
+	// leaves to it.
+	Maximum   uint64 `json:"maximum"`
+	Actual    uint64 `json:"actual"`
+	Unused    uint64 `json:"unused"`
+	Available uint64 `json:"available"`
+	Usable    uint64 `json:"usable"`
+	// Rss is the host memory used by QEMU.
+	Rss         uint64 `json:"rss"`
+	SwapIn      uint64 `json:"swapIn"`
+	SwapOut     uint64 `json:"swapOut"`
+	MajorFaults uint64 `json:"majorFaults"`
+	MinorFaults uint64 `json:"minorFaults"`
+}
+
+// DomainStats are the statistics libvirt keeps of a virtual machine.
+// Sizes are in bytes.
+type DomainStats struct {
+	State string `json:"state"`
+	VCpus uint   `json:"vcpus"`
+	// CpuTime is the CPU time used by the guest in nanoseconds.
+	CpuTime uint64 `json:"cpuTime"`
+	MaxMem  uint64 `json:"maxMemory"`
+	Memory  uint64 `json:"memory"`
+	// Balloon and Disks are only reported while the guest runs.
+	Balloon *MemoryStats `json:"balloon,omitempty"`
+	Disks   []DiskStats  `json:"disks,omitempty"`
+}
+
+// DiskStats are the I/O counters of a disk of a virtual machine.
+type DiskStats struct {
+	Device        string `json:"device"`
+	ReadBytes     uint64 `json:"readBytes"`
+	ReadRequests  uint64 `json:"readRequests"`
+	WriteBytes    uint64 `json:"writeBytes"`
+	WriteRequests uint64 `json:"writeRequests"`
+}
+
+// Restart records that the virtual machine of a container was restarted
+// by its restart policy.
+type Restart struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+}
+
+// Display is where the display of a virtual machine is served. Socket is
+// the VNC unix socket, Address the host and port of SPICE, whose password
+// is in PasswordFile.
+type Display struct {
+	Type         string `json:"type"`
+	Socket       string `json:"socket,omitempty"`
+	Address      string `json:"address,omitempty"`
+	PasswordFile string `json:"passwordFile,omitempty"`
 }
 
+// CheckStatus is the outcome of a host check.
+type CheckStatus string
+
+const (
+	CheckPass CheckStatus = "pass"
+	// CheckWarn is reported when a check cannot tell whether the host
+	// supports a feature.
+	CheckWarn CheckStatus = "warn"
+	CheckFail CheckStatus = "fail"
+)
 
+// CheckResult is the result of a host check run by "runvm check".
+type CheckResult struct {
+	Name   string      `json:"name"`
+	Status CheckStatus `json:"status"`
+	Detail string      `json:"detail"`
+}
 
 type Hypervisor interface {
 	GetConnection(url string) (conn interface{}, err error)
 	CreateVM(vmParams VirtualMachineParams) (vm VirtualMachine, err error)
 	GetVM(id string) (vm VirtualMachine, err error)
+	// DestroyVM stops and removes the virtual machine id with its state
+	// dir. It succeeds when there is no such virtual machine.
+	DestroyVM(id string) error
+	// Watch subscribes to lifecycle events of the virtual machine id. It may
+	// be called before the virtual machine is created. The channel is closed
+	// after the virtual machine stops or crashes, or when stop is called.
+	Watch(id string) (events <-chan Event, stop func(), err error)
+	// ServeConsoles copies the console output of the virtual machine id to
+	// its log files and relays its application console to the clients of
+	// AttachConsole, until the virtual machine stops.
+	ServeConsoles(id string) error
+	// AttachConsole connects to the application console of the virtual
+	// machine id while ServeConsoles relays it.
+	AttachConsole(id string) (*ConsoleAttachment, error)
+	// MemoryStats returns the balloon statistics of the virtual machine id.
+	MemoryStats(id string) (*MemoryStats, error)
+	// DomainStats returns the CPU, memory and disk statistics libvirt
+	// keeps of the virtual machine id.
+	DomainStats(id string) (*DomainStats, error)
+	// BalanceMemory resizes the balloon of the virtual machine id once,
+	// following the balloon policy. It is called every BalloonPeriod
+	// seconds while the virtual machine runs.
+	BalanceMemory(id string) error
+	// RestartVM boots the virtual machine id again after it failed for
+	// reason, placing it in cgroupPaths, and records the restart.
+	RestartVM(id string, cgroupPaths map[string]string, reason string) error
+	// Restarts returns the restarts of the virtual machine id.
+	Restarts(id string) ([]Restart, error)
+	// CopyToVM extracts the tar archive read from archive into the
+	// directory path of the container in the virtual machine id, and
+	// CopyFromVM writes path to archive as a tar archive named after its
+	// last component, which is not followed if it is a symlink. freeze
+	// stops the processes of the container during the copy.
+	CopyToVM(id, path string, freeze bool, archive io.Reader) error
+	CopyFromVM(id, path string, freeze bool, archive io.Writer) error
+	// DialGuest connects to port of the container in the virtual machine
+	// id over vsock, which works without a network, and ForwardPort
+	// relays the connections accepted on l to guestPort until l is closed.
+	DialGuest(id string, port int) (io.ReadWriteCloser, error)
+	ForwardPort(id string, l net.Listener, guestPort int) error
+	// VMState describes the virtual machine id to the hooks of its
+	// container: its domain, QEMU process, guest address and sockets.
+	VMState(id string) (*configs.VMState, error)
+	// WaitBooted waits until the guest of the virtual machine id has
+	// booted and its network interfaces are up.
+	WaitBooted(id string) error
+	// Display returns where the display of the virtual machine id is
+	// served, nil if guests have none.
+	Display(id string) (*Display, error)
+	// DumpVM saves the guest memory, domain XML and serial log of the
+	// virtual machine id for reason, and returns where.
+	DumpVM(id, reason string) (string, error)
+	// DumpsOnCrash reports whether virtual machines are dumped with
+	// DumpVM after the guest crashed or its watchdog fired.
+	DumpsOnCrash() bool
+	// RestartPolicy returns the restart policy of virtual machines whose
+	// container does not set RestartPolicyAnnotation.
+	RestartPolicy() RestartPolicy
+	// FillPool boots idle guests until every pool class is full, replacing
+	// guests of an outdated base image.
+	FillPool() error
+	// DrainPool removes all idle guests of the pool.
+	DrainPool() error
+	// PoolAutoRefill reports whether the pool is refilled after each
+	// container start.
+	PoolAutoRefill() bool
+	// CreateTemplate boots a guest of numCpu vCPUs and memory MiB up to
+	// the point where it would start a container and saves it as template
+	// name. 0 means the default size.
+	CreateTemplate(name string, numCpu, memory int) error
+	// RemoveTemplate deletes template name.
+	RemoveTemplate(name string) error
+	// Orphans returns what is left of virtual machines that none of
+	// containers, the ids of the containers under the runvm root and the
+	// pids of their init processes, owns. State younger than minAge, and
+	// the domains running from it, are kept for containers being created. RemoveOrphan removes an orphan.
+	Orphans(containers map[string]int, minAge time.Duration) ([]Orphan, error)
+	RemoveOrphan(o Orphan) error
+	// Check verifies that the host provides what the hypervisor needs to
+	// run virtual machines.
+	Check() []CheckResult
 }
 
 
@@ -1,12 +1,16 @@
 package hypervisor
 
 import (
+	"github.com/Sirupsen/logrus"
 	"github.com/libvirt/libvirt-go"
 	"fmt"
 	"os"
 	"encoding/xml"
 	"net"
 	"bufio"
+	"io"
+	"io/ioutil"
+	"path/filepath"
 	"time"
 )
 
@@ -24,7 +28,14 @@ type vmBaseConfig struct {
 	DefaultMaxCpus   int
 	DefaultMaxMem    int
 	Memory           int
+	MemoryOverhead   int
 	OriginalDiskPath string
+	// watchdog is the watchdog device of guests, nil for none.
+	watchdog *watchdog
+	// crashDump keeps crashed guests for their memory to be dumped.
+	crashDump bool
+	// graphics is the display of guests, one of the Graphics* kinds.
+	graphics string
 }
 
 type vmMemory struct {
@@ -40,6 +51,7 @@ type maxmem struct {
 
 type vcpu struct {
 	Placement string `xml:"placement,attr"`
+	Cpuset    string `xml:"cpuset,attr,omitempty"`
 	Current   string `xml:"current,attr"`
 	Content   int    `xml:",chardata"`
 }
@@ -52,7 +64,8 @@ type cell struct {
 }
 
 type vmCpu struct {
-	Mode string `xml:"mode,attr"`
+	Mode string   `xml:"mode,attr"`
+	Numa *cpunuma `xml:"numa,omitempty"`
 }
 
 type ostype struct {
@@ -143,42 +156,59 @@ type console struct {
 	Target constgt  `xml:"target"`
 }
 
+type chantgt struct {
+	Type string `xml:"type,attr"`
+	Name string `xml:"name,attr"`
+}
+
+type channel struct {
+	Type   string   `xml:"type,attr"`
+	Source channsrc `xml:"source"`
+	Target chantgt  `xml:"target"`
+}
+
 type device struct {
 	Emulator          string       `xml:"emulator"`
 	Filesystems       []filesystem `xml:"filesystem"`
 	Disks             []disk       `xml:"disk"`
 	Consoles          []console    `xml:"console"`
+	Channels          []channel    `xml:"channel"`
+	MemBalloon        *memballoon  `xml:"memballoon,omitempty"`
+	Watchdog          *watchdog    `xml:"watchdog,omitempty"`
+	Panic             *panicDevice `xml:"panic,omitempty"`
 	NetworkInterfaces []nic        `xml:"interface"`
 	Controller        []controller `xml:"controller"`
-	Graphics          graphics     `xml:"graphics"`
+	Graphics          *graphics    `xml:"graphics,omitempty"`
+	Vsock             *vsock       `xml:"vsock,omitempty"`
 }
 
-type graphics struct {
-	Type   string   `xml:"type,attr"`
-	Port   string   `xml:"port,attr"`
-}
-
-
-
 type seclab struct {
-	Type string `xml:"type,attr"`
+	Type    string `xml:"type,attr"`
+	Model   string `xml:"model,attr,omitempty"`
+	Relabel string `xml:"relabel,attr,omitempty"`
+	Label   string `xml:"label,omitempty"`
 }
 
 type domain struct {
-	XMLName    xml.Name  `xml:"domain"`
-	Type       string    `xml:"type,attr"`
-	Name       string    `xml:"name"`
-	Memory     vmMemory  `xml:"memory"`
-	MaxMem     *maxmem   `xml:"maxMemory,omitempty"`
-	VCpu       vcpu      `xml:"vcpu"`
-	OS         domainos  `xml:"os"`
-	Features   []feature `xml:"features"`
-	CPU        vmCpu     `xml:"cpu"`
-	OnPowerOff string    `xml:"on_poweroff"`
-	OnReboot   string    `xml:"on_reboot"`
-	OnCrash    string    `xml:"on_crash"`
-	Devices    device    `xml:"devices"`
-	SecLabel   seclab    `xml:"seclabel"`
+	XMLName       xml.Name       `xml:"domain"`
+	Type          string         `xml:"type,attr"`
+	Name          string         `xml:"name"`
+	UUID          string         `xml:"uuid,omitempty"`
+	Memory        vmMemory       `xml:"memory"`
+	MaxMem        *maxmem        `xml:"maxMemory,omitempty"`
+	VCpu          vcpu           `xml:"vcpu"`
+	CPUTune       *cputune       `xml:"cputune,omitempty"`
+	NUMATune      *numatune      `xml:"numatune,omitempty"`
+	MemTune       *memtune       `xml:"memtune,omitempty"`
+	MemoryBacking *memoryBacking `xml:"memoryBacking,omitempty"`
+	OS            domainos       `xml:"os"`
+	Features      []feature      `xml:"features"`
+	CPU           vmCpu          `xml:"cpu"`
+	OnPowerOff    string         `xml:"on_poweroff"`
+	OnReboot      string         `xml:"on_reboot"`
+	OnCrash       string         `xml:"on_crash"`
+	Devices       device         `xml:"devices"`
+	SecLabels     []seclab       `xml:"seclabel"`
 }
 
 type nicmac struct {
@@ -199,6 +229,7 @@ type nicmodel struct {
 }
 
 type nic struct {
+	XMLName xml.Name `xml:"interface"`
 	Type   string   `xml:"type,attr"`
 //	Mac    nicmac   `xml:"mac"`
 	Source sourceDev   `xml:"source"`
@@ -208,8 +239,9 @@ type nic struct {
 
 
 type KVMVirtualMachine struct {
-	id string
-	domain *libvirt.Domain
+	id     string
+	dir    string
+	domain domainHandle
 }
 
 func (k *KVMVirtualMachine) Suspend() error {
@@ -250,6 +282,10 @@ func (k *KVMVirtualMachine) Shutdown() error {
 	panic("implement me")
 }
 
+func (k *KVMVirtualMachine) IsRunning() (bool, error) {
+	return k.domain.IsActive()
+}
+
 func (k *KVMVirtualMachine) Kill() error {
 	err := k.Stop()
 	if err == nil {
@@ -264,124 +300,273 @@ func (k *KVMVirtualMachine) Remove() error {
 		return err
 	}
 
-	if rerr := os.RemoveAll("/var/run/docker-qemu/" + k.id); err == nil {
-		err = rerr
+	// A pooled guest shares the container's directories through bind
+	// mounts in its state dir, which must not be removed with it.
+	if err := unmountShare(k.dir); err != nil {
 		return err
 	}
+	return os.RemoveAll(k.dir)
+}
+
+
+// KVMHypervisor manages virtual machines through libvirt. VM artifacts are
+// kept under root, which is the runvm state directory given by --root.
+// Console output is only logged when consoleLog is set, and guests are
+// only pooled when pool is set.
+type KVMHypervisor struct {
+	uri         string
+	root        string
+	qemuUser    string
+	consoleLog  *logConfig
+	pool        *poolConfig
+	templateDir string
+	baseCfg     *vmBaseConfig
+	balloon     *balloonConfig
+	dump        *dumpConfig
+	// restartPolicy is the default restart policy of containers.
+	restartPolicy RestartPolicy
+	// dial opens the connections of CreateVM and GetVM instead of
+	// libvirt when set, for tests.
+	dial func(uri string) (domainConn, error)
+}
 
-	return nil
+func (k *KVMHypervisor) GetConnection(url string) (conn interface{}, err error) {
+	conn, err = libvirt.NewConnect(url)
+	if err != nil {
+		return nil, newError(ConnectionFailed, "", err)
+	}
+	return conn, nil
 }
 
+// rollback holds the undo actions of the steps of CreateVM that have
+// already completed. They are run in reverse order if a later step fails.
+type rollback []func() error
 
-type KVMHypervisor struct{
-	conn *libvirt.Connect
+func (r *rollback) add(undo func() error) {
+	*r = append(*r, undo)
 }
 
-func (k *KVMHypervisor) GetConnection(url string) (conn interface{}, err error) {
-	k.conn, err = libvirt.NewConnect(url)
-	if err != nil {
-		fmt.Errorf("Failed to get connection to qemu.")
+func (r rollback) run(id string) {
+	for i := len(r) - 1; i >= 0; i-- {
+		if err := r[i](); err != nil {
+			logrus.Warnf("rollback of vm %s: %v", id, err)
+		}
 	}
-	return k.conn, nil
 }
 
 func (k *KVMHypervisor) CreateVM(vmParams VirtualMachineParams) (vm VirtualMachine, err error) {
+	var undo rollback
+	defer func() {
+		if err != nil {
+			undo.run(vmParams.Id)
+		}
+	}()
+
+	if vmParams.NetInfo.Bridge != "" {
+		bridge := vmParams.NetInfo.Bridge
+		undo.add(func() error {
+			return removeLink(bridge)
+		})
+	}
 
-	vmParams.DiskDir, err = createQemuDir(vmParams.Id, err)
+	baseCfg := k.baseCfg
+	dir, domain, err := k.restoreVM(&vmParams, baseCfg, &undo)
 	if err != nil {
-		fmt.Errorf("Could not create directory /var/run/docker-qemu/%s : %s", vmParams.Id, err)
+		return nil, err
+	}
+	if domain == nil {
+		dir, domain, err = k.claimVM(&vmParams, baseCfg, &undo)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if domain == nil {
+		dir, domain, err = k.bootVM(&vmParams, baseCfg, &undo)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	_ , err = vmParams.CreateDeltaDiskImage()
-	if err != nil {
-		fmt.Errorf("Could not create delta disk for vm %s : %s", vmParams.Id, err)
+	if err := saveNetInfo(dir, vmParams.NetInfo); err != nil {
+		logrus.Warnf("network settings of vm %s: %v", vmParams.Id, err)
 	}
 
-	_ , err = vmParams.CreateSeedImage()
+	name, err := domain.GetName()
 	if err != nil {
-		fmt.Errorf("Could not create seed image for vm %s : %s", vmParams.Id, err)
+		return nil, domainError(DomainStartFailed, vmParams.Id, err)
+	}
+	if err := vmParams.enterCgroups(name); err != nil {
+		return nil, newError(CgroupFailed, vmParams.Id, err)
+	}
+
+	if k.consoleLog != nil {
+		go func() {
+			if err := k.consoleLog.logConsole(vmParams.DiskDir, SerialConsole); err != nil {
+				logrus.Warnf("serial console log of vm %s: %v", vmParams.Id, err)
+			}
+		}()
 	}
 
-	domainXml, err := vmParams.DomainXml()
+	appConsoleSockName := consoleSockPath(vmParams.DiskDir, AppConsole)
+	consoleConn, err := net.DialTimeout("unix", appConsoleSockName, time.Duration(10)*time.Second)
 	if err != nil {
-		fmt.Errorf("Could not create domain xml for vm %s : %s", vmParams.Id, err)
+		return nil, newError(ConsoleFailed, vmParams.Id, err)
+	}
+	defer consoleConn.Close()
+
+	if !vmParams.Detach {
+		var appLog io.Writer = ioutil.Discard
+		if k.consoleLog != nil {
+			log, err := k.consoleLog.openConsoleLog(vmParams.DiskDir, AppConsole)
+			if err != nil {
+				logrus.Warnf("app console log of vm %s: %v", vmParams.Id, err)
+			} else {
+				defer log.Close()
+				appLog = log
+			}
+		}
+
+		reader := bufio.NewReaderSize(consoleConn, 256)
+		cout := make(chan string, 128)
+		go ConsoleReader(reader, cout)
+
+		for line := range cout {
+			fmt.Println(line)
+			fmt.Fprintln(appLog, line)
+		}
 	}
 
-	KVMConnection(k)
-	defer k.conn.Close()
-	
-	domain, err := k.conn.DomainDefineXML(domainXml)
+	return &KVMVirtualMachine{
+		id:     vmParams.Id,
+		dir:    dir,
+		domain: domain,
+	}, nil
+}
+
+// bootVM creates the disks and seed image of a new virtual machine in its
+// state dir and boots it. It returns the state dir and the domain.
+func (k *KVMHypervisor) bootVM(vmParams *VirtualMachineParams, baseCfg *vmBaseConfig, undo *rollback) (string, domainHandle, error) {
+	var err error
+	vmParams.DiskDir, err = createQemuDir(k.root, vmParams.Id)
 	if err != nil {
-		fmt.Println("Could not define domain xml for vm %s : %+v", vmParams.Id, err)
-		return nil, err
+		return "", nil, newError(StateDirFailed, vmParams.Id, err)
 	}
+	dir := vmParams.DiskDir
+	undo.add(func() error {
+		return os.RemoveAll(dir)
+	})
 
-	if domain == nil {
-		fmt.Println("domain cannot be null for vm %s", vmParams.Id)
-		return nil, err
+	if err = k.setupQemuUser(vmParams); err != nil {
+		return "", nil, newError(SecurityFailed, vmParams.Id, err)
 	}
 
-	err = domain.Create()
+	deltaDisk, err := vmParams.CreateDeltaDiskImage(baseCfg.OriginalDiskPath)
 	if err != nil {
-		fmt.Println("Cannot create domain for vm %s : %+v", vmParams.Id, err)
-		return nil, err
+		return "", nil, newError(DeltaDiskFailed, vmParams.Id, err)
+	}
+	undo.add(func() error {
+		return os.Remove(deltaDisk)
+	})
 
+	if err = vmParams.createDisplayPasswd(baseCfg); err != nil {
+		return "", nil, newError(SecurityFailed, vmParams.Id, err)
 	}
 
-	appConsoleSockName := vmParams.DiskDir + "/app.sock"
+	vmParams.watchdog = baseCfg.watchdog != nil
+	seedImage, err := vmParams.CreateSeedImage()
+	if err != nil {
+		return "", nil, newError(SeedImageFailed, vmParams.Id, err)
+	}
+	undo.add(func() error {
+		return os.Remove(seedImage)
+	})
 
-	var consoleConn net.Conn
-	consoleConn, err = net.DialTimeout("unix", appConsoleSockName, time.Duration(10)*time.Second)
+	if err = vmParams.relabelSharedDirs(); err != nil {
+		return "", nil, newError(SecurityFailed, vmParams.Id, err)
+	}
 
+	domainXml, err := vmParams.domainXml(baseCfg)
 	if err != nil {
-		fmt.Println("failed to get console conn %+v", err)
+		return "", nil, newError(DomainXmlFailed, vmParams.Id, err)
+	}
 
+	conn, err := k.domainConnect()
+	if err != nil {
+		return "", nil, err
 	}
+	defer conn.Close()
 
-	reader := bufio.NewReaderSize(consoleConn, 256)
+	domain, err := conn.DomainDefineXML(domainXml)
+	if err != nil {
+		return "", nil, newError(DomainDefineFailed, vmParams.Id, err)
+	}
+	undo.add(domain.Undefine)
 
-	cout := make(chan string, 128)
-        if !vmParams.Detach{
-	    go ConsoleReader(reader, cout)
+	if err = domain.Create(); err != nil {
+		return "", nil, newError(DomainStartFailed, vmParams.Id, err)
+	}
+	undo.add(domain.Destroy)
 
-	    for {
-		    line, ok := <-cout
-		    if ok {
-			    fmt.Println(line)
-		    } else {
-			    break
-		    }
-	    }
-     }
-	return nil, nil
+	return dir, domain, nil
 }
 
-
-func KVMConnection(k *KVMHypervisor) {
-	if k.conn == nil {
-		hyperConn, _ := k.GetConnection("qemu:///system")
-		k.conn = hyperConn.(*libvirt.Connect)
+// connect opens a new connection to the configured libvirt URI. Domains
+// looked up through it hold their own reference, so the caller may close
+// the connection once it has the domain it needs.
+func (k *KVMHypervisor) connect() (*libvirt.Connect, error) {
+	conn, err := k.GetConnection(k.uri)
+	if err != nil {
+		return nil, err
 	}
+	return conn.(*libvirt.Connect), nil
 }
 
 func (k *KVMHypervisor) GetVM(id string) (vm VirtualMachine, err error) {
-	KVMConnection(k)
-	defer k.conn.Close()
-
-	kvmVirtualMachine := new(KVMVirtualMachine)
-	domain, err := k.conn.LookupDomainByName(id)
+	conn, err := k.domainConnect()
 	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
 
-	if domain == nil {
-		return nil, err
-
+	domain, err := conn.LookupDomainByName(k.domainName(id))
+	if err != nil {
+		return nil, newError(VMNotExists, id, err)
 	}
 
-	kvmVirtualMachine.id = id
-	kvmVirtualMachine.domain = domain
-
-	return kvmVirtualMachine, nil
+	dir := StateDir(k.root, id)
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	return &KVMVirtualMachine{
+		id:     id,
+		dir:    dir,
+		domain: domain,
+	}, nil
+}
+
+func (k *KVMHypervisor) DestroyVM(id string) error {
+	// A container whose virtual machine was never created has no state
+	// dir, and is deleted without connecting to libvirt.
+	if _, err := os.Lstat(StateDir(k.root, id)); os.IsNotExist(err) {
+		return nil
+	}
+	vm, err := k.GetVM(id)
+	if herr, ok := err.(*Error); ok && herr.Code == VMNotExists {
+		// The share of a clone whose domain is gone may still hold the
+		// directories of the container.
+		return unmountShare(StateDir(k.root, id))
+	}
+	if err != nil {
+		return err
+	}
+	running, err := vm.IsRunning()
+	if err != nil {
+		return err
+	}
+	if running {
+		if err := vm.Stop(); err != nil {
+			return err
+		}
+	}
+	return vm.Remove()
 }
-
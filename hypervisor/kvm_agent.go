@@ -0,0 +1,570 @@
+package hypervisor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AgentChannel is the name of the virtio-serial port the guest agent
+// listens on.
+const AgentChannel = "org.runvm.agent.0"
+
+// agentTimeout bounds the time the guest agent takes to set up the
+// container once a pooled guest is claimed.
+const agentTimeout = 30 * time.Second
+
+func agentSockPath(dir string) string {
+	return filepath.Join(dir, "agent.sock")
+}
+
+// agentHelper is the guest agent. In pooled guests it announces itself
+// with "ready", then waits for the container to be handed to it as a
+// single agentRequest. It mounts the share of the guest, brings up the
+// hot-attached network interface, answers "ok" and runs the process with
+// exec.py, powering the guest off once it exits. Other guests run it with
+// "serve". In both cases it then serves copyRequests and resizeRequests,
+// and relays the connections forwarded over vsock to the ports of the
+// container, until the guest stops.
+const agentHelper = `import fcntl
+import json
+import os
+import signal
+import socket
+import struct
+import subprocess
+import sys
+import termios
+import threading
+import time
+
+PORT = "/dev/virtio-ports/org.runvm.agent.0"
+RUN = "/run/runvm"
+SHARE = RUN + "/share"
+ROOTFS = "/mnt"
+CONSOLE = "/dev/hvc1"
+FORWARD_PORT = 1024
+
+
+def links():
+    return set(os.listdir("/sys/class/net")) - {"lo"}
+
+
+TAR = ["tar", "--xattrs", "--xattrs-include=*", "--numeric-owner"]
+
+
+class Port(object):
+    # Reads return nothing while no host is connected to the channel.
+
+    def __init__(self):
+        self.fd = os.open(PORT, os.O_RDWR)
+        self.buf = b""
+
+    def fill(self, wait):
+        data = os.read(self.fd, 65536)
+        if not data:
+            if not wait:
+                self.buf = b""
+                raise Exception("host disconnected")
+            time.sleep(0.2)
+        self.buf += data
+
+    def readline(self):
+        while b"\n" not in self.buf:
+            self.fill(True)
+        line, _, self.buf = self.buf.partition(b"\n")
+        return line
+
+    def read(self, n):
+        while len(self.buf) < n:
+            self.fill(False)
+        data, self.buf = self.buf[:n], self.buf[n:]
+        return data
+
+    def write(self, data):
+        while data:
+            data = data[os.write(self.fd, data):]
+
+
+def read_frames(port):
+    while True:
+        n = int(port.readline())
+        if n == 0:
+            return
+        yield port.read(n)
+
+
+def write_frame(port, data):
+    port.write(str(len(data)).encode() + b"\n" + data)
+
+
+def resolve(path):
+    # Follows symlinks the way the container sees them, inside ROOTFS.
+    parts = [p for p in path.split("/") if p]
+    resolved = ROOTFS
+    links = 0
+    while parts:
+        part = parts.pop(0)
+        if part == ".":
+            continue
+        if part == "..":
+            if resolved != ROOTFS:
+                resolved = os.path.dirname(resolved)
+            continue
+        candidate = os.path.join(resolved, part)
+        if os.path.islink(candidate):
+            links += 1
+            if links > 40:
+                raise Exception("too many levels of symbolic links in " + path)
+            target = os.readlink(candidate)
+            if target.startswith("/"):
+                resolved = ROOTFS
+            parts = [p for p in target.split("/") if p] + parts
+            continue
+        resolved = candidate
+    return resolved
+
+
+def freeze():
+    # Stops the processes of the container, leaving those stopped already.
+    stopped = []
+    for pid in os.listdir("/proc"):
+        if not pid.isdigit() or int(pid) == os.getpid():
+            continue
+        try:
+            if os.readlink("/proc/%s/root" % pid) != ROOTFS:
+                continue
+            with open("/proc/%s/stat" % pid) as f:
+                if f.read().rpartition(")")[2].split()[0] in "TtZ":
+                    continue
+            os.kill(int(pid), signal.SIGSTOP)
+            stopped.append(int(pid))
+        except OSError:
+            pass
+    return stopped
+
+
+def thaw(stopped):
+    for pid in stopped:
+        try:
+            os.kill(pid, signal.SIGCONT)
+        except OSError:
+            pass
+
+
+def copy_in(port, path):
+    if not os.path.isdir(path):
+        raise Exception("not a directory")
+    tar = subprocess.Popen(TAR + ["-x", "-p", "--same-owner", "-C", path, "-f", "-"], stdin=subprocess.PIPE)
+    port.write(b"ok\n")
+    failed = None
+    for data in read_frames(port):
+        if failed is None:
+            try:
+                tar.stdin.write(data)
+            except OSError as e:
+                failed = e
+    try:
+        tar.stdin.close()
+    except OSError:
+        pass
+    return tar
+
+
+def copy_out(port, path):
+    if not os.path.lexists(path):
+        raise Exception("no such file or directory")
+    tar = subprocess.Popen(TAR + ["-c", "-C", os.path.dirname(path), "-f", "-", os.path.basename(path)], stdout=subprocess.PIPE)
+    port.write(b"ok\n")
+    while True:
+        data = tar.stdout.read(65536)
+        write_frame(port, data)
+        if not data:
+            return tar
+
+
+def copy(port, req):
+    if req["copy"] == "in":
+        tar = copy_in(port, resolve(req["path"]))
+    elif req["copy"] == "out":
+        # The archive is named after the last component of the path, which
+        # is copied as it is, not what it links to.
+        path = os.path.normpath("/" + req["path"])
+        if path == "/":
+            raise Exception("cannot copy the root of the container")
+        tar = copy_out(port, os.path.join(resolve(os.path.dirname(path)), os.path.basename(path)))
+    else:
+        raise Exception("unknown copy %r" % req["copy"])
+    if tar.wait() != 0:
+        raise Exception("tar exited with status %d" % tar.returncode)
+
+
+def resize(size):
+    # The foreground process of the application console gets SIGWINCH.
+    console = os.open(CONSOLE, os.O_RDWR | os.O_NOCTTY)
+    try:
+        fcntl.ioctl(console, termios.TIOCSWINSZ, struct.pack("HHHH", size["rows"], size["cols"], 0, 0))
+    finally:
+        os.close(console)
+
+
+def pipe(src, dst):
+    try:
+        while True:
+            data = src.recv(65536)
+            if not data:
+                break
+            dst.sendall(data)
+    except OSError:
+        pass
+    try:
+        dst.shutdown(socket.SHUT_WR)
+    except OSError:
+        pass
+
+
+def forward(conn):
+    # The host names the port of the container in the first line.
+    try:
+        line = b""
+        while not line.endswith(b"\n"):
+            data = conn.recv(1)
+            if not data:
+                raise Exception("no port")
+            line += data
+        target = socket.create_connection(("127.0.0.1", int(line)))
+    except Exception as e:
+        try:
+            conn.sendall(("error: %s\n" % e).encode())
+        except OSError:
+            pass
+        conn.close()
+        return
+    conn.sendall(b"ok\n")
+    back = threading.Thread(target=pipe, args=(target, conn))
+    back.start()
+    pipe(conn, target)
+    back.join()
+    conn.close()
+    target.close()
+
+
+def listen_forwards():
+    try:
+        listener = socket.socket(socket.AF_VSOCK, socket.SOCK_STREAM)
+        listener.bind((socket.VMADDR_CID_ANY, FORWARD_PORT))
+        listener.listen(16)
+    except (AttributeError, OSError):
+        # No vsock in this guest.
+        return
+    while True:
+        conn, _ = listener.accept()
+        background(forward, conn)
+
+
+def background(target, *args):
+    thread = threading.Thread(target=target, args=args)
+    thread.daemon = True
+    thread.start()
+
+
+def ping():
+    # Answers once the network interfaces of the guest are up.
+    deadline = time.time() + 20
+    while True:
+        down = []
+        for link in links():
+            with open("/sys/class/net/%s/operstate" % link) as f:
+                if f.read().strip() not in ("up", "unknown"):
+                    down.append(link)
+        if not down:
+            return
+        if time.time() > deadline:
+            raise Exception("%s not up" % ", ".join(sorted(down)))
+        time.sleep(0.2)
+
+
+def serve(port):
+    while True:
+        line = port.readline()
+        stopped = []
+        try:
+            req = json.loads(line.decode())
+            if "ping" in req:
+                ping()
+            elif "resize" in req:
+                resize(req["resize"])
+            else:
+                if req.get("freeze"):
+                    stopped = freeze()
+                copy(port, req)
+            port.write(b"ok\n")
+        except Exception as e:
+            try:
+                port.write(("error: %s\n" % e).encode())
+            except OSError:
+                pass
+        finally:
+            thaw(stopped)
+
+
+def run(*args):
+    subprocess.check_call(args)
+
+
+def bind(source, target, is_dir):
+    if is_dir:
+        os.makedirs(target, exist_ok=True)
+    else:
+        os.makedirs(os.path.dirname(target), exist_ok=True)
+        open(target, "a").close()
+    run("mount", "--bind", source, target)
+
+
+def wait_link(known, timeout=30):
+    deadline = time.time() + timeout
+    while time.time() < deadline:
+        new = links() - known
+        if new:
+            return sorted(new)[0]
+        time.sleep(0.2)
+    raise Exception("no network interface was attached")
+
+
+def setup(req, known):
+    run("hostname", req["hostname"])
+    os.makedirs(SHARE, exist_ok=True)
+    run("mount", "-t", "9p", "-o", "trans=virtio", "share_dir", SHARE)
+    bind(SHARE + "/rootfs", ROOTFS, True)
+    for mount in req["mounts"]:
+        bind(SHARE + "/" + mount["source"], ROOTFS + mount["destination"], mount["dir"])
+    net = req.get("network")
+    if net:
+        link = wait_link(known)
+        run("ip", "addr", "add", net["address"] + "/" + net["netmask"], "dev", link)
+        run("ip", "link", "set", link, "up")
+        if net["gateway"]:
+            run("ip", "route", "add", "default", "via", net["gateway"])
+    for name, key in (("resolv.conf", "resolvConf"), ("hosts", "hosts")):
+        if req[key]:
+            with open(ROOTFS + "/etc/" + name, "w") as f:
+                f.write(req[key])
+    run("mount", "--bind", "/dev", ROOTFS + "/dev")
+    run("mount", "--bind", "/proc", ROOTFS + "/proc")
+    with open(RUN + "/process.json", "w") as f:
+        json.dump(req["process"], f)
+
+
+def main():
+    port = Port()
+    known = links()
+    port.write(b"ready\n")
+    req = json.loads(port.readline().decode())
+    while "ping" in req:
+        port.write(b"error: no container yet\n")
+        req = json.loads(port.readline().decode())
+    try:
+        setup(req, known)
+    except Exception as e:
+        port.write(("error: %s\n" % e).encode())
+        return
+    port.write(b"ok\n")
+    process = subprocess.Popen([sys.executable, RUN + "/exec.py", RUN + "/process.json", ROOTFS])
+    background(serve, port)
+    background(listen_forwards)
+    process.wait()
+
+
+if sys.argv[1:] == ["serve"]:
+    background(listen_forwards)
+    serve(Port())
+else:
+    main()
+    os.system("/sbin/poweroff -f")
+`
+
+const agentUserData = `#cloud-config
+hostname: %s
+runcmd:
+ - mkdir -p /cdrom /run/runvm
+ - mount /dev/cdrom /cdrom
+ - cp -p /cdrom/agent.py /cdrom/exec.py /run/runvm/.
+ - cp -p /cdrom/agent.service /etc/systemd/system/runvm-agent.service
+ - systemctl --no-block start runvm-agent
+`
+
+// agentService runs the guest agent with the arguments it is formatted
+// with.
+const agentService = `[Unit]
+Description=runvm guest agent
+After=cloud-init.service
+
+[Service]
+Type=simple
+ExecStart=/usr/bin/python3 /run/runvm/agent.py%s
+`
+
+// agentMount is a mount of the container, shared with the guest as the
+// entry Source of its share.
+type agentMount struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Dir         bool   `json:"dir"`
+}
+
+type agentNetwork struct {
+	Address string `json:"address"`
+	Netmask string `json:"netmask"`
+	Gateway string `json:"gateway"`
+}
+
+// agentRequest hands a container to the guest agent of a pooled guest.
+type agentRequest struct {
+	Hostname   string          `json:"hostname"`
+	Process    json.RawMessage `json:"process"`
+	Mounts     []agentMount    `json:"mounts"`
+	Network    *agentNetwork   `json:"network,omitempty"`
+	ResolvConf string          `json:"resolvConf"`
+	Hosts      string          `json:"hosts"`
+}
+
+func (k *VirtualMachineParams) agentRequest(mounts []agentMount) (*agentRequest, error) {
+	process, err := k.processSpec()
+	if err != nil {
+		return nil, err
+	}
+	req := &agentRequest{
+		Hostname:   k.Id,
+		Process:    process,
+		Mounts:     mounts,
+		ResolvConf: string(k.ResoveString),
+		Hosts:      string(k.HostsString),
+	}
+	if req.Mounts == nil {
+		req.Mounts = []agentMount{}
+	}
+	if k.NetInfo.MacAddr != "" {
+		req.Network = &agentNetwork{
+			Address: k.NetInfo.IpAddr,
+			Netmask: k.NetInfo.NetMask,
+			Gateway: k.NetInfo.GateWay,
+		}
+	}
+	return req, nil
+}
+
+// createAgentSeedImage writes the seed image of a pooled guest, which only
+// starts the guest agent.
+func (k *VirtualMachineParams) createAgentSeedImage() (string, error) {
+	genisoimagePath, err := exec.LookPath("genisoimage")
+	if err != nil {
+		return "", fmt.Errorf("genisoimage is not installed on your PATH. Please, install it to run isolated container")
+	}
+
+	userData := fmt.Sprintf(agentUserData, k.Id)
+	if k.watchdog {
+		userData = armWatchdog(userData)
+	}
+	files := []struct {
+		name string
+		data string
+		mode os.FileMode
+	}{
+		{"user-data", userData, 0600},
+		{"meta-data", fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", k.Id, k.Id), 0600},
+		{"agent.service", fmt.Sprintf(agentService, ""), 0600},
+		{"agent.py", agentHelper, 0700},
+		{"exec.py", execHelper, 0700},
+	}
+	args := []string{"-output", "seed.img", "-volid", "cidata", "-joliet", "-rock"}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(k.DiskDir, f.name), []byte(f.data), f.mode); err != nil {
+			return "", fmt.Errorf("Could not write %s for %s", f.name, k.Id)
+		}
+		args = append(args, f.name)
+	}
+
+	cmd := exec.Command(genisoimagePath, args...)
+	cmd.Dir = k.DiskDir
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Could not execute genisoimage")
+	}
+	return SeedDiskImgPath(k.DiskDir), nil
+}
+
+// dialAgent connects to the agent channel of the guest in dir. QEMU
+// creates the socket when the guest starts, so it is retried until
+// timeout, which also becomes the deadline of the connection.
+func dialAgent(dir string, timeout time.Duration) (net.Conn, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.Dial("unix", agentSockPath(dir))
+		if err == nil {
+			return conn, conn.SetDeadline(deadline)
+		}
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// waitAgent waits for the guest agent in dir to report that it is ready.
+func waitAgent(dir string, timeout time.Duration) error {
+	conn, err := dialAgent(dir, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("guest agent: %v", err)
+	}
+	if reply := strings.TrimSpace(line); reply != "ready" {
+		return fmt.Errorf("guest agent: unexpected reply %q", reply)
+	}
+	return nil
+}
+
+// sendAgent hands req to the guest agent in dir and waits until it has
+// set up the container.
+func sendAgent(dir string, req *agentRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	conn, err := dialAgent(dir, agentTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return readAgentReply(bufio.NewReader(conn))
+}
+
+// readAgentReply reads the next reply of the guest agent.
+func readAgentReply(reader *bufio.Reader) error {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("guest agent: %v", err)
+		}
+		switch reply := strings.TrimSpace(line); reply {
+		case "ready":
+			// Left over from a boot nobody waited for.
+		case "ok":
+			return nil
+		default:
+			return fmt.Errorf("guest agent: %s", reply)
+		}
+	}
+}
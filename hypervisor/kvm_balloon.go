@@ -0,0 +1,168 @@
+package hypervisor
+
+import (
+	"fmt"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+const (
+	// BalloonPeriod is how often, in seconds, guests report the memory
+	// statistics of their balloon driver.
+	BalloonPeriod = 5
+
+	// DefaultBalloonReserve is the free memory in MiB the balloon policy
+	// leaves to a guest on top of what it uses.
+	DefaultBalloonReserve = 128
+
+	// balloonMinimum is the least memory in MiB a guest is ballooned
+	// down to.
+	balloonMinimum = 256
+)
+
+type balloonStatsPeriod struct {
+	Period int `xml:"period,attr"`
+}
+
+type memballoon struct {
+	Model             string              `xml:"model,attr"`
+	FreePageReporting string              `xml:"freePageReporting,attr,omitempty"`
+	Stats             *balloonStatsPeriod `xml:"stats,omitempty"`
+}
+
+// balloonDevice returns the virtio balloon of a guest. Free page reporting
+// hands the pages the guest frees back to the host, while the balloon
+// policy reclaims memory the guest holds on to, such as its page cache.
+func balloonDevice() *memballoon {
+	return &memballoon{
+		Model:             "virtio",
+		FreePageReporting: "on",
+		Stats:             &balloonStatsPeriod{Period: BalloonPeriod},
+	}
+}
+
+// balloonConfig is the balloon policy of the hypervisor. reserve is in
+// MiB.
+type balloonConfig struct {
+	reserve uint64
+}
+
+// memoryStats converts the balloon statistics reported by libvirt, in KiB,
+// to MemoryStats. maximum is the boot memory of the guest in KiB.
+func memoryStats(stats []libvirt.DomainMemoryStat, maximum uint64) *MemoryStats {
+	s := &MemoryStats{Maximum: maximum << 10}
+	for _, stat := range stats {
+		switch libvirt.DomainMemoryStatTags(stat.Tag) {
+		case libvirt.DOMAIN_MEMORY_STAT_ACTUAL_BALLOON:
+			s.Actual = stat.Val << 10
+		case libvirt.DOMAIN_MEMORY_STAT_UNUSED:
+			s.Unused = stat.Val << 10
+		case libvirt.DOMAIN_MEMORY_STAT_AVAILABLE:
+			s.Available = stat.Val << 10
+		case libvirt.DOMAIN_MEMORY_STAT_USABLE:
+			s.Usable = stat.Val << 10
+		case libvirt.DOMAIN_MEMORY_STAT_RSS:
+			s.Rss = stat.Val << 10
+		case libvirt.DOMAIN_MEMORY_STAT_SWAP_IN:
+			s.SwapIn = stat.Val << 10
+		case libvirt.DOMAIN_MEMORY_STAT_SWAP_OUT:
+			s.SwapOut = stat.Val << 10
+		case libvirt.DOMAIN_MEMORY_STAT_MAJOR_FAULT:
+			s.MajorFaults = stat.Val
+		case libvirt.DOMAIN_MEMORY_STAT_MINOR_FAULT:
+			s.MinorFaults = stat.Val
+		}
+	}
+	return s
+}
+
+// balloonTarget returns the memory in bytes the guest described by s is
+// ballooned to, or 0 to leave it as it is. The guest is given what it uses
+// plus reserve, within balloonMinimum and its boot memory, which is sized
+// from the container's memory limit. Changes of less than a twentieth of
+// the boot memory are skipped so that the balloon does not churn.
+func balloonTarget(s *MemoryStats, reserve uint64) uint64 {
+	if s.Available == 0 || s.Actual == 0 || s.Maximum == 0 {
+		// The guest driver has not reported yet.
+		return 0
+	}
+	free := s.Unused
+	if s.Usable > free {
+		free = s.Usable
+	}
+	var used uint64
+	if s.Available > free {
+		used = s.Available - free
+	}
+	target := used + reserve<<20
+	if min := uint64(balloonMinimum) << 20; target < min {
+		target = min
+	}
+	if target > s.Maximum {
+		target = s.Maximum
+	}
+	diff := target - s.Actual
+	if target < s.Actual {
+		diff = s.Actual - target
+	}
+	if diff < s.Maximum/20 {
+		return 0
+	}
+	return target
+}
+
+func (k *KVMHypervisor) domainMemoryStats(domain *libvirt.Domain) (*MemoryStats, error) {
+	maximum, err := domain.GetMaxMemory()
+	if err != nil {
+		return nil, err
+	}
+	stats, err := domain.MemoryStats(uint32(libvirt.DOMAIN_MEMORY_STAT_NR), 0)
+	if err != nil {
+		return nil, err
+	}
+	return memoryStats(stats, maximum), nil
+}
+
+func (k *KVMHypervisor) MemoryStats(id string) (*MemoryStats, error) {
+	conn, err := k.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	domain, err := conn.LookupDomainByName(k.domainName(id))
+	if err != nil {
+		return nil, newError(VMNotExists, id, err)
+	}
+	defer domain.Free()
+	return k.domainMemoryStats(domain)
+}
+
+func (k *KVMHypervisor) BalanceMemory(id string) error {
+	if k.balloon == nil {
+		return nil
+	}
+	conn, err := k.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	domain, err := conn.LookupDomainByName(k.domainName(id))
+	if err != nil {
+		return newError(VMNotExists, id, err)
+	}
+	defer domain.Free()
+	stats, err := k.domainMemoryStats(domain)
+	if err != nil {
+		return err
+	}
+	target := balloonTarget(stats, k.balloon.reserve)
+	if target == 0 {
+		return nil
+	}
+	if err := domain.SetMemoryFlags(target>>10, libvirt.DOMAIN_MEM_LIVE); err != nil {
+		return fmt.Errorf("balloon vm %s to %d MiB: %v", id, target>>20, err)
+	}
+	return nil
+}
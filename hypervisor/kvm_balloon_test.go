@@ -0,0 +1,59 @@
+package hypervisor
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+func TestMemoryStats(t *testing.T) {
+	s := memoryStats([]libvirt.DomainMemoryStat{
+		{Tag: int32(libvirt.DOMAIN_MEMORY_STAT_ACTUAL_BALLOON), Val: 1048576},
+		{Tag: int32(libvirt.DOMAIN_MEMORY_STAT_UNUSED), Val: 524288},
+		{Tag: int32(libvirt.DOMAIN_MEMORY_STAT_MAJOR_FAULT), Val: 7},
+	}, 1048576)
+	if s.Maximum != 1<<30 || s.Actual != 1<<30 || s.Unused != 512<<20 || s.MajorFaults != 7 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+}
+
+func TestBalloonTarget(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		stats  MemoryStats
+		target uint64
+	}{
+		{"no report", MemoryStats{Maximum: 1024 << 20, Actual: 1024 << 20}, 0},
+		{"idle", MemoryStats{Maximum: 1024 << 20, Actual: 1024 << 20, Available: 1000 << 20, Unused: 800 << 20}, 328 << 20},
+		{"usable counts as free", MemoryStats{Maximum: 1024 << 20, Actual: 1024 << 20, Available: 1000 << 20, Unused: 100 << 20, Usable: 800 << 20}, 328 << 20},
+		{"minimum", MemoryStats{Maximum: 1024 << 20, Actual: 1024 << 20, Available: 1000 << 20, Unused: 990 << 20}, balloonMinimum << 20},
+		{"under pressure", MemoryStats{Maximum: 1024 << 20, Actual: 400 << 20, Available: 380 << 20, Unused: 10 << 20}, 498 << 20},
+		{"capped", MemoryStats{Maximum: 1024 << 20, Actual: 900 << 20, Available: 900 << 20}, 1024 << 20},
+		{"small change", MemoryStats{Maximum: 1024 << 20, Actual: 500 << 20, Available: 480 << 20, Unused: 100 << 20}, 0},
+	} {
+		if target := balloonTarget(&test.stats, 128); target != test.target {
+			t.Errorf("%s: expected %d MiB, got %d MiB", test.name, test.target>>20, target>>20)
+		}
+	}
+}
+
+func TestDomainXmlBalloon(t *testing.T) {
+	vmParams := &VirtualMachineParams{Id: "c1", DiskDir: "/run/runvm/c1/vm"}
+	out, err := vmParams.domainXml(testBaseCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<memballoon model="virtio" freePageReporting="on"><stats period="5"></stats></memballoon>`
+	if !strings.Contains(out, expected) {
+		t.Errorf("Expected %s in %s", expected, out)
+	}
+	var dom domain
+	if err := xml.Unmarshal([]byte(out), &dom); err != nil {
+		t.Fatal(err)
+	}
+	if dom.Devices.MemBalloon == nil || dom.Devices.MemBalloon.Stats.Period != BalloonPeriod {
+		t.Errorf("Unexpected balloon %+v", dom.Devices.MemBalloon)
+	}
+}
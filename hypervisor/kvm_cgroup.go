@@ -0,0 +1,81 @@
+package hypervisor
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/harche/runvm/libcontainer/cgroups"
+)
+
+// findQemuPid returns the pid of the QEMU process running domain name,
+// found through the "-name guest=<name>,..." argument libvirt starts it
+// with. It works for both system and session connections, which keep
+// their pid files in different places.
+func findQemuPid(procDir, name string) (int, error) {
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(filepath.Join(procDir, entry.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+		if qemuGuestName(cmdline) == name {
+			return pid, nil
+		}
+	}
+	return 0, fmt.Errorf("no QEMU process runs domain %s", name)
+}
+
+// qemuGuestName returns the guest name in the NUL separated command line
+// of a QEMU process, or "" if it has none.
+func qemuGuestName(cmdline []byte) string {
+	args := bytes.Split(cmdline, []byte{0})
+	for i := 0; i+1 < len(args); i++ {
+		if string(args[i]) != "-name" {
+			continue
+		}
+		for _, opt := range strings.Split(string(args[i+1]), ",") {
+			if strings.HasPrefix(opt, "guest=") {
+				return strings.TrimPrefix(opt, "guest=")
+			}
+		}
+		// Older libvirt passes the bare name.
+		return strings.SplitN(string(args[i+1]), ",", 2)[0]
+	}
+	return ""
+}
+
+// enterCgroups moves the QEMU process of domain name, with all its
+// threads, into the cgroups of the container, so that the limits in
+// linux.resources apply to what the virtual machine really uses and its
+// usage shows in the container's stats. libvirt keeps QEMU in its own
+// machine cgroups otherwise, which is why the domain leaves out the
+// <memtune> and CPU quota libvirt would set there. Memory already charged
+// is moved along where the memory controller supports it.
+func (k *VirtualMachineParams) enterCgroups(name string) error {
+	if len(k.CgroupPaths) == 0 {
+		return nil
+	}
+	pid, err := findQemuPid("/proc", name)
+	if err != nil {
+		return err
+	}
+	if memory := k.CgroupPaths["memory"]; memory != "" {
+		err := ioutil.WriteFile(filepath.Join(memory, "memory.move_charge_at_immigrate"), []byte("3"), 0644)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return cgroups.EnterPid(k.CgroupPaths, pid)
+}
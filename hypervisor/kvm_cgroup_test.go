@@ -0,0 +1,53 @@
+package hypervisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQemuGuestName(t *testing.T) {
+	for cmdline, name := range map[string]string{
+		"qemu-system-x86_64\x00-name\x00guest=c1,debug-threads=on\x00-S": "c1",
+		"qemu-kvm\x00-name\x00c2\x00-S":                                  "c2",
+		"/bin/sh\x00-c\x00true":                                          "",
+		"qemu-kvm\x00-name":                                              "",
+	} {
+		if got := qemuGuestName([]byte(cmdline)); got != name {
+			t.Errorf("Expected %q for %q, got %q", name, cmdline, got)
+		}
+	}
+}
+
+func TestFindQemuPid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runvm-proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for pid, cmdline := range map[string]string{
+		"12":   "qemu-kvm\x00-name\x00guest=c10,debug-threads=on",
+		"34":   "qemu-kvm\x00-name\x00guest=c1,debug-threads=on",
+		"self": "qemu-kvm\x00-name\x00guest=c1",
+	} {
+		if err := os.Mkdir(filepath.Join(dir, pid), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, pid, "cmdline"), []byte(cmdline), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pid, err := findQemuPid(dir, "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid != 34 {
+		t.Errorf("Expected pid 34, got %d", pid)
+	}
+	if _, err := findQemuPid(dir, "c2"); err == nil || !strings.Contains(err.Error(), "c2") {
+		t.Errorf("Expected an error naming c2, got %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package hypervisor
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+func checkPass(name, format string, args ...interface{}) CheckResult {
+	return CheckResult{Name: name, Status: CheckPass, Detail: fmt.Sprintf(format, args...)}
+}
+
+func checkFail(name string, err error) CheckResult {
+	return CheckResult{Name: name, Status: CheckFail, Detail: err.Error()}
+}
+
+// domainCaps is the part of the libvirt domain capabilities the checks
+// look at.
+type domainCaps struct {
+	Filesystem struct {
+		Supported string `xml:"supported,attr"`
+		Enums     []struct {
+			Name   string   `xml:"name,attr"`
+			Values []string `xml:"value"`
+		} `xml:"enum"`
+	} `xml:"devices>filesystem"`
+}
+
+func (k *KVMHypervisor) Check() []CheckResult {
+	return []CheckResult{
+		checkKvm(),
+		checkVhostVsock(),
+		k.checkLibvirt(),
+		checkTool("qemu-img"),
+		checkTool("genisoimage"),
+		checkBaseImage(k.baseCfg),
+		k.checkFilesystem(),
+	}
+}
+
+func checkKvm() CheckResult {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return checkFail("kvm", err)
+	}
+	f.Close()
+	return checkPass("kvm", "/dev/kvm is accessible")
+}
+
+func checkVhostVsock() CheckResult {
+	if _, err := os.Stat("/dev/vhost-vsock"); err != nil {
+		return checkFail("vhost-vsock", fmt.Errorf("%v, load the vhost_vsock module", err))
+	}
+	return checkPass("vhost-vsock", "/dev/vhost-vsock is present")
+}
+
+func (k *KVMHypervisor) checkLibvirt() CheckResult {
+	conn, err := k.connect()
+	if err != nil {
+		return checkFail("libvirt", err)
+	}
+	conn.Close()
+	return checkPass("libvirt", "connected to %s", k.uri)
+}
+
+func checkTool(name string) CheckResult {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return checkFail(name, err)
+	}
+	return checkPass(name, "found %s", path)
+}
+
+func checkBaseImage(baseCfg *vmBaseConfig) CheckResult {
+	f, err := os.Open(baseCfg.OriginalDiskPath)
+	if err != nil {
+		return checkFail("base image", err)
+	}
+	defer f.Close()
+	if _, err := f.Read(make([]byte, 1)); err != nil && err != io.EOF {
+		return checkFail("base image", fmt.Errorf("read %s: %v", baseCfg.OriginalDiskPath, err))
+	}
+	return checkPass("base image", "%s is readable", baseCfg.OriginalDiskPath)
+}
+
+// checkFilesystem asks libvirt whether QEMU can share host directories
+// with KVM guests, which is how the container rootfs reaches the guest.
+func (k *KVMHypervisor) checkFilesystem() CheckResult {
+	const name = "filesystem sharing"
+	conn, err := k.connect()
+	if err != nil {
+		return checkFail(name, err)
+	}
+	defer conn.Close()
+	data, err := conn.GetDomainCapabilities("", "", "", "kvm", 0)
+	if err != nil {
+		return checkFail(name, err)
+	}
+	return parseFilesystemCaps(data)
+}
+
+func parseFilesystemCaps(data string) CheckResult {
+	const name = "filesystem sharing"
+	var caps domainCaps
+	if err := xml.Unmarshal([]byte(data), &caps); err != nil {
+		return checkFail(name, err)
+	}
+	switch caps.Filesystem.Supported {
+	case "":
+		return CheckResult{Name: name, Status: CheckWarn, Detail: "libvirt does not report 9p or virtio-fs support"}
+	case "no":
+		return checkFail(name, fmt.Errorf("neither 9p nor virtio-fs is supported"))
+	}
+	for _, enum := range caps.Filesystem.Enums {
+		if enum.Name == "driverType" {
+			return checkPass(name, "driver types %s", strings.Join(enum.Values, ", "))
+		}
+	}
+	return checkPass(name, "supported")
+}
@@ -0,0 +1,37 @@
+package hypervisor
+
+import "testing"
+
+func TestParseFilesystemCaps(t *testing.T) {
+	for _, c := range []struct {
+		caps   string
+		status CheckStatus
+		detail string
+	}{
+		{
+			caps:   `<domainCapabilities><devices><filesystem supported="yes"><enum name="driverType"><value>path</value><value>handle</value><value>virtiofs</value></enum></filesystem></devices></domainCapabilities>`,
+			status: CheckPass,
+			detail: "driver types path, handle, virtiofs",
+		},
+		{
+			caps:   `<domainCapabilities><devices><filesystem supported="no"/></devices></domainCapabilities>`,
+			status: CheckFail,
+		},
+		{
+			caps:   `<domainCapabilities><devices><disk supported="yes"/></devices></domainCapabilities>`,
+			status: CheckWarn,
+		},
+		{
+			caps:   `not xml`,
+			status: CheckFail,
+		},
+	} {
+		result := parseFilesystemCaps(c.caps)
+		if result.Status != c.status {
+			t.Errorf("Expected %s for %s, got %+v", c.status, c.caps, result)
+		}
+		if c.detail != "" && result.Detail != c.detail {
+			t.Errorf("Expected %q, got %q", c.detail, result.Detail)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package hypervisor
+
+import (
+	"github.com/libvirt/libvirt-go"
+)
+
+// domainHandle is a libvirt domain as virtual machines are managed
+// through it. *libvirt.Domain implements it.
+type domainHandle interface {
+	GetName() (string, error)
+	Create() error
+	Destroy() error
+	Suspend() error
+	Resume() error
+	Undefine() error
+	IsActive() (bool, error)
+	GetXMLDesc(flags libvirt.DomainXMLFlags) (string, error)
+	Free() error
+}
+
+// domainConn is the part of a libvirt connection CreateVM and GetVM
+// define and look up domains through.
+type domainConn interface {
+	DomainDefineXML(domainXml string) (domainHandle, error)
+	LookupDomainByName(name string) (domainHandle, error)
+	ListAllDomains(flags libvirt.ConnectListAllDomainsFlags) ([]domainHandle, error)
+	Close() (int, error)
+}
+
+// libvirtConn is a domainConn of libvirt itself.
+type libvirtConn struct {
+	*libvirt.Connect
+}
+
+func (c libvirtConn) DomainDefineXML(domainXml string) (domainHandle, error) {
+	domain, err := c.Connect.DomainDefineXML(domainXml)
+	if err != nil {
+		return nil, err
+	}
+	return domain, nil
+}
+
+func (c libvirtConn) LookupDomainByName(name string) (domainHandle, error) {
+	domain, err := c.Connect.LookupDomainByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return domain, nil
+}
+
+func (c libvirtConn) ListAllDomains(flags libvirt.ConnectListAllDomainsFlags) ([]domainHandle, error) {
+	domains, err := c.Connect.ListAllDomains(flags)
+	if err != nil {
+		return nil, err
+	}
+	handles := make([]domainHandle, len(domains))
+	for i := range domains {
+		handles[i] = &domains[i]
+	}
+	return handles, nil
+}
+
+// domainConnect opens a domainConn to the configured libvirt URI, through
+// dial when it is set.
+func (k *KVMHypervisor) domainConnect() (domainConn, error) {
+	if k.dial != nil {
+		conn, err := k.dial(k.uri)
+		if err != nil {
+			return nil, newError(ConnectionFailed, "", err)
+		}
+		return conn, nil
+	}
+	conn, err := k.connect()
+	if err != nil {
+		return nil, err
+	}
+	return libvirtConn{conn}, nil
+}
+
+// domainError returns the error of a libvirt call on the domain of the
+// virtual machine id that failed: VMNotExists if libvirt no longer knows
+// the domain, code otherwise.
+func domainError(code ErrorCode, id string, err error) error {
+	if lerr, ok := err.(libvirt.Error); ok && lerr.Code == libvirt.ERR_NO_DOMAIN {
+		code = VMNotExists
+	}
+	return newError(code, id, err)
+}
@@ -0,0 +1,331 @@
+package hypervisor
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+// fakeLibvirt keeps the domains defined through its connections. Started
+// domains serve their application console, as a booted guest would.
+type fakeLibvirt struct {
+	mu      sync.Mutex
+	domains map[string]*fakeDomain
+	// createErr fails the start of domains.
+	createErr error
+	opened    int
+	closed    int
+}
+
+func newFakeLibvirt() *fakeLibvirt {
+	return &fakeLibvirt{domains: make(map[string]*fakeDomain)}
+}
+
+func (f *fakeLibvirt) dial(uri string) (domainConn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.opened++
+	return &fakeConn{f}, nil
+}
+
+func (f *fakeLibvirt) domain(name string) *fakeDomain {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.domains[name]
+}
+
+type fakeConn struct {
+	*fakeLibvirt
+}
+
+func (c *fakeConn) DomainDefineXML(domainXml string) (domainHandle, error) {
+	var dom domain
+	if err := xml.Unmarshal([]byte(domainXml), &dom); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.domains[dom.Name]
+	if !ok {
+		d = &fakeDomain{libvirt: c.fakeLibvirt}
+		c.domains[dom.Name] = d
+	}
+	d.dom = dom
+	return d, nil
+}
+
+func (c *fakeConn) LookupDomainByName(name string) (domainHandle, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.domains[name]
+	if !ok {
+		return nil, fmt.Errorf("domain %s not found", name)
+	}
+	return d, nil
+}
+
+func (c *fakeConn) ListAllDomains(flags libvirt.ConnectListAllDomainsFlags) ([]domainHandle, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var domains []domainHandle
+	for _, d := range c.domains {
+		domains = append(domains, d)
+	}
+	return domains, nil
+}
+
+func (c *fakeConn) Close() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed++
+	return 0, nil
+}
+
+type fakeDomain struct {
+	libvirt *fakeLibvirt
+	dom     domain
+	state   string
+	app     net.Listener
+}
+
+func (d *fakeDomain) GetName() (string, error) {
+	return d.dom.Name, nil
+}
+
+func (d *fakeDomain) Create() error {
+	if d.libvirt.createErr != nil {
+		return d.libvirt.createErr
+	}
+	l, err := net.Listen("unix", d.dom.Devices.Consoles[2].Source.Path)
+	if err != nil {
+		return err
+	}
+	d.app = l
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "hello from %s\n", d.dom.Name)
+			conn.Close()
+		}
+	}()
+	d.state = "running"
+	return nil
+}
+
+func (d *fakeDomain) Destroy() error {
+	if d.app != nil {
+		d.app.Close()
+		d.app = nil
+	}
+	d.state = "shutoff"
+	return nil
+}
+
+func (d *fakeDomain) Suspend() error {
+	d.state = "paused"
+	return nil
+}
+
+func (d *fakeDomain) Resume() error {
+	d.state = "running"
+	return nil
+}
+
+func (d *fakeDomain) Undefine() error {
+	d.libvirt.mu.Lock()
+	defer d.libvirt.mu.Unlock()
+	delete(d.libvirt.domains, d.dom.Name)
+	return nil
+}
+
+func (d *fakeDomain) IsActive() (bool, error) {
+	return d.state == "running" || d.state == "paused", nil
+}
+
+func (d *fakeDomain) GetXMLDesc(flags libvirt.DomainXMLFlags) (string, error) {
+	return marshalDomain(&d.dom)
+}
+
+func (d *fakeDomain) Free() error {
+	return nil
+}
+
+// fakeImageTools puts a qemu-img and genisoimage that only create their
+// output file first on the PATH, and returns the function to restore it.
+func fakeImageTools(t *testing.T, dir string) func() {
+	tools := map[string]string{
+		"qemu-img":    "#!/bin/sh\nfor last; do :; done\n: > \"$last\"\n",
+		"genisoimage": "#!/bin/sh\n: > \"$2\"\n",
+	}
+	for name, script := range tools {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return func() {
+		os.Setenv("PATH", path)
+	}
+}
+
+func newFakeHypervisor(t *testing.T) (*KVMHypervisor, *fakeLibvirt, func()) {
+	root, err := ioutil.TempDir("", "runvm-kvm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(root, "bin")
+	if err := os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	restorePath := fakeImageTools(t, bin)
+	lv := newFakeLibvirt()
+	k := &KVMHypervisor{uri: "test:///default", root: root, baseCfg: testBaseCfg, dial: lv.dial}
+	return k, lv, func() {
+		restorePath()
+		os.RemoveAll(root)
+	}
+}
+
+func testVMParams(root string) VirtualMachineParams {
+	return VirtualMachineParams{
+		Id:     "c1",
+		Args:   []string{"/bin/true"},
+		Rootfs: filepath.Join(root, "rootfs"),
+		CwD:    "/",
+		Detach: true,
+	}
+}
+
+func TestCreateVM(t *testing.T) {
+	k, lv, cleanup := newFakeHypervisor(t)
+	defer cleanup()
+
+	vm, err := k.CreateVM(testVMParams(k.root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.ID() != "c1" {
+		t.Errorf("Expected vm c1, got %s", vm.ID())
+	}
+	d := lv.domain("c1")
+	if d == nil {
+		t.Fatal("Expected domain c1 to be defined")
+	}
+	defer d.Destroy()
+	if d.state != "running" {
+		t.Errorf("Expected domain c1 to run, it is %q", d.state)
+	}
+	dir := StateDir(k.root, "c1")
+	if d.dom.Devices.Disks[0].Source.File != DeltaDiskImgPath(dir) {
+		t.Errorf("Expected the disk in the state dir, got %+v", d.dom.Devices.Disks[0])
+	}
+	for _, f := range []string{DeltaDiskImgPath(dir), SeedDiskImgPath(dir), filepath.Join(dir, "process.json")} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("Expected %s to be created: %v", f, err)
+		}
+	}
+	if lv.opened != lv.closed {
+		t.Errorf("Expected every connection to be closed, opened %d and closed %d", lv.opened, lv.closed)
+	}
+}
+
+func TestCreateVMRollback(t *testing.T) {
+	k, lv, cleanup := newFakeHypervisor(t)
+	defer cleanup()
+	lv.createErr = errors.New("no kvm")
+
+	_, err := k.CreateVM(testVMParams(k.root))
+	herr, ok := err.(*Error)
+	if !ok || herr.Code != DomainStartFailed {
+		t.Fatalf("Expected %s, got %v", DomainStartFailed, err)
+	}
+	if d := lv.domain("c1"); d != nil {
+		t.Error("Expected the domain of a failed start to be undefined")
+	}
+	if _, err := os.Stat(StateDir(k.root, "c1")); !os.IsNotExist(err) {
+		t.Errorf("Expected the state dir of a failed start to be removed, got %v", err)
+	}
+}
+
+func TestGetVM(t *testing.T) {
+	k, lv, cleanup := newFakeHypervisor(t)
+	defer cleanup()
+
+	if _, err := k.GetVM("c1"); err == nil {
+		t.Fatal("Expected an error for a vm that does not exist")
+	} else if herr, ok := err.(*Error); !ok || herr.Code != VMNotExists {
+		t.Fatalf("Expected %s, got %v", VMNotExists, err)
+	}
+
+	if _, err := k.CreateVM(testVMParams(k.root)); err != nil {
+		t.Fatal(err)
+	}
+	vm, err := k.GetVM("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Suspend(); err != nil {
+		t.Fatal(err)
+	}
+	if state := lv.domain("c1").state; state != "paused" {
+		t.Errorf("Expected the domain to be paused, it is %q", state)
+	}
+	if err := vm.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if running, err := vm.IsRunning(); err != nil || !running {
+		t.Errorf("Expected the vm to run, got %v %v", running, err)
+	}
+	if err := vm.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	if d := lv.domain("c1"); d != nil {
+		t.Error("Expected a killed vm to be undefined")
+	}
+	if _, err := os.Stat(StateDir(k.root, "c1")); !os.IsNotExist(err) {
+		t.Errorf("Expected the state dir of a killed vm to be removed, got %v", err)
+	}
+}
+
+func TestDomainError(t *testing.T) {
+	gone := libvirt.Error{Code: libvirt.ERR_NO_DOMAIN, Message: "domain not found"}
+	if err := domainError(DomainStartFailed, "c1", gone); err.(*Error).Code != VMNotExists {
+		t.Errorf("Expected %s, got %v", VMNotExists, err)
+	}
+	if err := domainError(DomainStartFailed, "c1", errors.New("broken pipe")); err.(*Error).Code != DomainStartFailed {
+		t.Errorf("Expected %s, got %v", DomainStartFailed, err)
+	}
+}
+
+func TestDestroyVM(t *testing.T) {
+	k, lv, cleanup := newFakeHypervisor(t)
+	defer cleanup()
+
+	if err := k.DestroyVM("c1"); err != nil {
+		t.Fatalf("Expected no error for a vm that does not exist, got %v", err)
+	}
+	if _, err := k.CreateVM(testVMParams(k.root)); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.DestroyVM("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if d := lv.domain("c1"); d != nil {
+		t.Error("Expected a destroyed vm to be undefined")
+	}
+	if _, err := os.Stat(StateDir(k.root, "c1")); !os.IsNotExist(err) {
+		t.Errorf("Expected the state dir of a destroyed vm to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package hypervisor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// copyFrameSize is the most data sent in one frame of a copy.
+const copyFrameSize = 64 << 10
+
+// copyRequest asks the guest agent to extract a tar archive into the
+// directory Path of the container ("in"), or to archive Path ("out"). The
+// archive follows the reply "ok" as frames of a length line and that many
+// bytes, ending with an empty frame, and a final reply tells how the copy
+// went. Freeze stops the processes of the container during the copy.
+type copyRequest struct {
+	Copy   string `json:"copy"`
+	Path   string `json:"path"`
+	Freeze bool   `json:"freeze,omitempty"`
+}
+
+// agentStream pushes the deadline of the connection to the guest agent
+// back on every read and write, so that only a stalled copy times out.
+type agentStream struct {
+	net.Conn
+}
+
+func (s agentStream) Read(b []byte) (int, error) {
+	s.SetDeadline(time.Now().Add(agentTimeout))
+	return s.Conn.Read(b)
+}
+
+func (s agentStream) Write(b []byte) (int, error) {
+	s.SetDeadline(time.Now().Add(agentTimeout))
+	return s.Conn.Write(b)
+}
+
+// writeFrames sends what is read from r as frames, ending with an empty
+// one.
+func writeFrames(w io.Writer, r io.Reader) error {
+	buf := make([]byte, copyFrameSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := fmt.Fprintf(w, "%d\n", n); err != nil {
+				return err
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			_, err = io.WriteString(w, "0\n")
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readFrames writes the data of the frames read from reader to w, up to
+// the empty frame.
+func readFrames(reader *bufio.Reader, w io.Writer) error {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("guest agent: invalid frame %q", strings.TrimSpace(line))
+		}
+		if n == 0 {
+			return nil
+		}
+		if _, err := io.CopyN(w, reader, n); err != nil {
+			return err
+		}
+	}
+}
+
+// startCopy connects to the guest agent of the virtual machine id and
+// sends req. The connection is returned once the agent accepted it.
+func (k *KVMHypervisor) startCopy(id string, req *copyRequest) (net.Conn, *bufio.Reader, error) {
+	dir, err := filepath.EvalSymlinks(StateDir(k.root, id))
+	if err != nil {
+		return nil, nil, newError(VMNotExists, id, err)
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := dialAgent(dir, agentTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn = agentStream{conn}
+	reader := bufio.NewReader(conn)
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := readAgentReply(reader); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("copy %s: %v", req.Path, err)
+	}
+	return conn, reader, nil
+}
+
+func (k *KVMHypervisor) CopyToVM(id, path string, freeze bool, archive io.Reader) error {
+	conn, reader, err := k.startCopy(id, &copyRequest{Copy: "in", Path: path, Freeze: freeze})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := writeFrames(conn, archive); err != nil {
+		return err
+	}
+	if err := readAgentReply(reader); err != nil {
+		return fmt.Errorf("copy to %s: %v", path, err)
+	}
+	return nil
+}
+
+func (k *KVMHypervisor) CopyFromVM(id, path string, freeze bool, archive io.Writer) error {
+	conn, reader, err := k.startCopy(id, &copyRequest{Copy: "out", Path: path, Freeze: freeze})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := readFrames(reader, archive); err != nil {
+		return err
+	}
+	if err := readAgentReply(reader); err != nil {
+		return fmt.Errorf("copy from %s: %v", path, err)
+	}
+	return nil
+}
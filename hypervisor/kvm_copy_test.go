@@ -0,0 +1,42 @@
+package hypervisor
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFrames(t *testing.T) {
+	data := bytes.Repeat([]byte("runvm"), copyFrameSize/4)
+	var stream bytes.Buffer
+	if err := writeFrames(&stream, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stream.String(), "65536\n") || !strings.HasSuffix(stream.String(), "runvm0\n") {
+		t.Errorf("Unexpected frames %.20q...%q", stream.String(), stream.String()[stream.Len()-8:])
+	}
+	stream.WriteString("ok\n")
+
+	reader := bufio.NewReader(&stream)
+	var out bytes.Buffer
+	if err := readFrames(reader, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("Expected %d bytes back, got %d", len(data), out.Len())
+	}
+	if err := readAgentReply(reader); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadAgentReply(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("ready\nerror: not a directory\n"))
+	if err := readAgentReply(reader); err == nil || err.Error() != "guest agent: error: not a directory" {
+		t.Errorf("Expected the error of the agent, got %v", err)
+	}
+	if err := readFrames(bufio.NewReader(strings.NewReader("x\n")), &bytes.Buffer{}); err == nil {
+		t.Error("Expected an invalid frame to be refused")
+	}
+}
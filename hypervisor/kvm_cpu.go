@@ -0,0 +1,189 @@
+package hypervisor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// minCpuQuota is the smallest per vCPU quota in microseconds libvirt
+// accepts.
+const minCpuQuota = 1000
+
+type cputune struct {
+	VcpuPins    []vcpupin    `xml:"vcpupin"`
+	EmulatorPin *emulatorpin `xml:"emulatorpin,omitempty"`
+	Period      uint64       `xml:"period,omitempty"`
+	Quota       int64        `xml:"quota,omitempty"`
+}
+
+type vcpupin struct {
+	Vcpu   int    `xml:"vcpu,attr"`
+	Cpuset string `xml:"cpuset,attr"`
+}
+
+type emulatorpin struct {
+	Cpuset string `xml:"cpuset,attr"`
+}
+
+type numatune struct {
+	Memory   *numamemory `xml:"memory,omitempty"`
+	MemNodes []memnode   `xml:"memnode"`
+}
+
+type numamemory struct {
+	Mode    string `xml:"mode,attr"`
+	Nodeset string `xml:"nodeset,attr"`
+}
+
+type memnode struct {
+	CellId  string `xml:"cellid,attr"`
+	Mode    string `xml:"mode,attr"`
+	Nodeset string `xml:"nodeset,attr"`
+}
+
+type cpunuma struct {
+	Cells []cell `xml:"cell"`
+}
+
+// parseCpuset parses a cpuset list such as "0-3,8,10-11" as used by
+// cpuset.cpus and cpuset.mems.
+func parseCpuset(s string) ([]int, error) {
+	var ids []int
+	if strings.TrimSpace(s) == "" {
+		return ids, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpuset %q", s)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, fmt.Errorf("invalid cpuset %q", s)
+			}
+		}
+		for id := first; id <= last; id++ {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// formatCpuset is the inverse of parseCpuset for a sorted list of ids.
+func formatCpuset(ids []int) string {
+	var parts []string
+	for i := 0; i < len(ids); {
+		j := i
+		for j+1 < len(ids) && ids[j+1] == ids[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(ids[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", ids[i], ids[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// applyCpuResources sizes and places the vCPUs of dom from the cpu
+// resources of the container. A cpuset gives one vCPU per host CPU, each
+// pinned to its own CPU, and a quota caps the count at the CPUs it
+// allows. Without either the guest gets numCpu vCPUs. cpuset.mems binds
+// guest memory to the host nodes and, with more than one node, gives the
+// guest a matching NUMA topology.
+func (r vmResources) applyCpuResources(dom *domain, numCpu int) error {
+	cpus, err := parseCpuset(r.CpusetCpus)
+	if err != nil {
+		return err
+	}
+	nodes, err := parseCpuset(r.CpusetMems)
+	if err != nil {
+		return err
+	}
+
+	vcpus := numCpu
+	if len(cpus) > 0 {
+		vcpus = len(cpus)
+	}
+	if r.CpuQuota > 0 && r.CpuPeriod > 0 {
+		allowed := int((uint64(r.CpuQuota) + r.CpuPeriod - 1) / r.CpuPeriod)
+		if len(cpus) == 0 || allowed < vcpus {
+			vcpus = allowed
+		}
+	}
+
+	dom.VCpu = vcpu{
+		Placement: "static",
+		Current:   strconv.Itoa(vcpus),
+		Content:   vcpus,
+	}
+
+	var tune cputune
+	if len(cpus) > 0 {
+		dom.VCpu.Cpuset = formatCpuset(cpus)
+		for i := 0; i < vcpus; i++ {
+			tune.VcpuPins = append(tune.VcpuPins, vcpupin{
+				Vcpu:   i,
+				Cpuset: strconv.Itoa(cpus[i]),
+			})
+		}
+		tune.EmulatorPin = &emulatorpin{Cpuset: formatCpuset(cpus)}
+	}
+	// QEMU leaves the cgroups libvirt tunes for the cpu cgroup of the
+	// container, which enforces the quota.
+	if r.CpuQuota > 0 && r.CpuPeriod > 0 && !r.CpuCgroup {
+		// libvirt applies the quota to each vCPU.
+		quota := r.CpuQuota / int64(vcpus)
+		if quota < minCpuQuota {
+			quota = minCpuQuota
+		}
+		tune.Period = r.CpuPeriod
+		tune.Quota = quota
+	}
+	if len(tune.VcpuPins) > 0 || tune.Quota > 0 {
+		dom.CPUTune = &tune
+	}
+
+	if len(nodes) == 0 {
+		return nil
+	}
+	dom.NUMATune = &numatune{
+		Memory: &numamemory{
+			Mode:    "strict",
+			Nodeset: formatCpuset(nodes),
+		},
+	}
+	if len(nodes) < 2 || vcpus < len(nodes) {
+		return nil
+	}
+	numa := &cpunuma{}
+	memory := dom.Memory.Content
+	for i, node := range nodes {
+		var cellCpus []int
+		for id := i * vcpus / len(nodes); id < (i+1)*vcpus/len(nodes); id++ {
+			cellCpus = append(cellCpus, id)
+		}
+		cellMemory := memory / len(nodes)
+		if i == len(nodes)-1 {
+			cellMemory = memory - cellMemory*(len(nodes)-1)
+		}
+		numa.Cells = append(numa.Cells, cell{
+			Id:     strconv.Itoa(i),
+			Cpus:   formatCpuset(cellCpus),
+			Memory: strconv.Itoa(cellMemory),
+			Unit:   dom.Memory.Unit,
+		})
+		dom.NUMATune.MemNodes = append(dom.NUMATune.MemNodes, memnode{
+			CellId:  strconv.Itoa(i),
+			Mode:    "strict",
+			Nodeset: strconv.Itoa(node),
+		})
+	}
+	dom.CPU.Numa = numa
+	return nil
+}
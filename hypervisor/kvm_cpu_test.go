@@ -0,0 +1,85 @@
+package hypervisor
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCpuset(t *testing.T) {
+	ids, err := parseCpuset("0-3,8, 10-11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int{0, 1, 2, 3, 8, 10, 11}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("Expected %v, got %v", expected, ids)
+	}
+	if s := formatCpuset(ids); s != "0-3,8,10-11" {
+		t.Errorf("Expected 0-3,8,10-11, got %s", s)
+	}
+	for _, invalid := range []string{"a", "3-1", "1-"} {
+		if _, err := parseCpuset(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestApplyCpuResourcesDefault(t *testing.T) {
+	dom := &domain{}
+	vmParams := new(VirtualMachineParams)
+	if err := vmParams.resources().applyCpuResources(dom, 2); err != nil {
+		t.Fatal(err)
+	}
+	if dom.VCpu.Content != 2 || dom.CPUTune != nil || dom.NUMATune != nil {
+		t.Errorf("Expected 2 unpinned vcpus, got %+v %+v %+v", dom.VCpu, dom.CPUTune, dom.NUMATune)
+	}
+}
+
+func TestApplyCpuResourcesPinning(t *testing.T) {
+	dom := &domain{}
+	dom.Memory.Unit = "MiB"
+	dom.Memory.Content = 1024
+	vmParams := &VirtualMachineParams{
+		CpusetCpus: "4-7",
+		CpusetMems: "0-1",
+		CpuQuota:   300000,
+		CpuPeriod:  100000,
+	}
+	if err := vmParams.resources().applyCpuResources(dom, 1); err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(dom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`<vcpu placement="static" cpuset="4-7" current="3">3</vcpu>`,
+		`<cputune><vcpupin vcpu="0" cpuset="4"></vcpupin><vcpupin vcpu="1" cpuset="5"></vcpupin><vcpupin vcpu="2" cpuset="6"></vcpupin><emulatorpin cpuset="4-7"></emulatorpin><period>100000</period><quota>100000</quota></cputune>`,
+		`<numatune><memory mode="strict" nodeset="0-1"></memory><memnode cellid="0" mode="strict" nodeset="0"></memnode><memnode cellid="1" mode="strict" nodeset="1"></memnode></numatune>`,
+		`<numa><cell id="0" cpus="0" memory="512" unit="MiB"></cell><cell id="1" cpus="1-2" memory="512" unit="MiB"></cell></numa>`,
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("Expected %s in %s", expected, data)
+		}
+	}
+}
+
+func TestApplyCpuResourcesContainerCgroup(t *testing.T) {
+	dom := &domain{}
+	vmParams := &VirtualMachineParams{
+		CpuQuota:    200000,
+		CpuPeriod:   100000,
+		CgroupPaths: map[string]string{"cpu": "/sys/fs/cgroup/cpu/c1"},
+	}
+	if err := vmParams.resources().applyCpuResources(dom, 1); err != nil {
+		t.Fatal(err)
+	}
+	if dom.VCpu.Content != 2 {
+		t.Errorf("Expected 2 vCPUs, got %d", dom.VCpu.Content)
+	}
+	if dom.CPUTune != nil {
+		t.Errorf("Expected the quota to be left to the container cgroup, got %+v", dom.CPUTune)
+	}
+}
@@ -0,0 +1,142 @@
+package hypervisor
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+const (
+	// Graphics of guests. Guests have no display by default, their
+	// consoles are serial. vnc-socket serves VNC on a unix socket in the
+	// state dir of the virtual machine, which only root can reach, and
+	// spice serves SPICE on the loopback address behind a password
+	// generated for each guest.
+	GraphicsNone      = "none"
+	GraphicsVNCSocket = "vnc-socket"
+	GraphicsSpice     = "spice"
+
+	vncSocketFile   = "vnc.sock"
+	spicePasswdFile = "spice.passwd"
+	spiceListen     = "127.0.0.1"
+)
+
+type graphicsListen struct {
+	Type    string `xml:"type,attr"`
+	Address string `xml:"address,attr,omitempty"`
+	Socket  string `xml:"socket,attr,omitempty"`
+}
+
+type graphics struct {
+	Type     string          `xml:"type,attr"`
+	Port     string          `xml:"port,attr,omitempty"`
+	AutoPort string          `xml:"autoport,attr,omitempty"`
+	Passwd   string          `xml:"passwd,attr,omitempty"`
+	Listen   *graphicsListen `xml:"listen,omitempty"`
+}
+
+func VncSocketPath(dir string) string {
+	return filepath.Join(dir, vncSocketFile)
+}
+
+func SpicePasswdPath(dir string) string {
+	return filepath.Join(dir, spicePasswdFile)
+}
+
+// graphicsDevice returns the graphics of a guest with state dir dir, nil
+// for none.
+func graphicsDevice(kind, dir, passwd string) *graphics {
+	switch kind {
+	case GraphicsVNCSocket:
+		return &graphics{
+			Type:   "vnc",
+			Listen: &graphicsListen{Type: "socket", Socket: VncSocketPath(dir)},
+		}
+	case GraphicsSpice:
+		return &graphics{
+			Type:     "spice",
+			AutoPort: "yes",
+			Passwd:   passwd,
+			Listen:   &graphicsListen{Type: "address", Address: spiceListen},
+		}
+	}
+	return nil
+}
+
+// createDisplayPasswd generates the SPICE password of the guest and keeps
+// it in its state dir for clients to read.
+func (k *VirtualMachineParams) createDisplayPasswd(baseCfg *vmBaseConfig) error {
+	if baseCfg.graphics != GraphicsSpice {
+		return nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	k.displayPasswd = hex.EncodeToString(b)
+	return ioutil.WriteFile(SpicePasswdPath(k.DiskDir), []byte(k.displayPasswd+"\n"), 0600)
+}
+
+// displayOf returns the display of the guest in the live domain XML
+// domainXml, nil if it has none.
+func displayOf(domainXml string) (*Display, error) {
+	var dom struct {
+		Graphics []graphics `xml:"devices>graphics"`
+	}
+	if err := xml.Unmarshal([]byte(domainXml), &dom); err != nil {
+		return nil, err
+	}
+	for _, g := range dom.Graphics {
+		d := &Display{Type: g.Type}
+		if g.Listen != nil && g.Listen.Type == "socket" {
+			d.Socket = g.Listen.Socket
+		} else if g.Port != "" && g.Port != "-1" {
+			host := spiceListen
+			if g.Listen != nil && g.Listen.Address != "" {
+				host = g.Listen.Address
+			}
+			d.Address = net.JoinHostPort(host, g.Port)
+		}
+		return d, nil
+	}
+	return nil, nil
+}
+
+func (k *KVMHypervisor) Display(id string) (*Display, error) {
+	if k.baseCfg.graphics == GraphicsNone {
+		return nil, nil
+	}
+	conn, err := k.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	domain, err := conn.LookupDomainByName(k.domainName(id))
+	if err != nil {
+		return nil, newError(VMNotExists, id, err)
+	}
+	defer domain.Free()
+	// The live XML has the port SPICE was given, but not its password.
+	domainXml, err := domain.GetXMLDesc(libvirt.DomainXMLFlags(0))
+	if err != nil {
+		return nil, err
+	}
+	display, err := displayOf(domainXml)
+	if err != nil || display == nil {
+		return display, err
+	}
+	if display.Type == "spice" {
+		dir, err := filepath.EvalSymlinks(StateDir(k.root, id))
+		if err != nil {
+			return nil, err
+		}
+		display.PasswordFile = SpicePasswdPath(dir)
+	}
+	return display, nil
+}
@@ -0,0 +1,91 @@
+package hypervisor
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGraphicsDevice(t *testing.T) {
+	baseCfg := newBaseConfig(DefaultConfig())
+	vmParams := &VirtualMachineParams{Id: "c1", DiskDir: "/run/runvm/c1/vm"}
+	out, err := vmParams.domainXml(baseCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "<graphics") {
+		t.Errorf("Expected no graphics by default, got %s", out)
+	}
+
+	baseCfg.graphics = GraphicsVNCSocket
+	dom, err := vmParams.buildDomain(baseCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := dom.Devices.Graphics
+	if g == nil || g.Type != "vnc" || g.Listen == nil || g.Listen.Socket != "/run/runvm/c1/vm/vnc.sock" || g.Port != "" {
+		t.Errorf("Expected VNC on the socket in the state dir, got %+v", g)
+	}
+}
+
+func TestCreateDisplayPasswd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runvm-display")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	baseCfg := newBaseConfig(DefaultConfig())
+	baseCfg.graphics = GraphicsSpice
+	vmParams := &VirtualMachineParams{Id: "c1", DiskDir: dir}
+	if err := vmParams.createDisplayPasswd(baseCfg); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(SpicePasswdPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vmParams.displayPasswd) != 32 || string(data) != vmParams.displayPasswd+"\n" {
+		t.Errorf("Unexpected password %q in %q", vmParams.displayPasswd, data)
+	}
+	if fi, err := os.Stat(SpicePasswdPath(dir)); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected the password to be private, got %v %v", fi, err)
+	}
+
+	dom, err := vmParams.buildDomain(baseCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := dom.Devices.Graphics
+	if g == nil || g.Type != "spice" || g.Passwd != vmParams.displayPasswd || g.Listen.Address != "127.0.0.1" {
+		t.Errorf("Expected SPICE on the loopback address, got %+v", g)
+	}
+	if _, err := xml.Marshal(dom); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDisplayOf(t *testing.T) {
+	for _, c := range []struct {
+		xml     string
+		display *Display
+	}{
+		{`<domain><devices></devices></domain>`, nil},
+		{`<domain><devices><graphics type="vnc" socket="/run/runvm/c1/vm/vnc.sock"><listen type="socket" socket="/run/runvm/c1/vm/vnc.sock"/></graphics></devices></domain>`,
+			&Display{Type: "vnc", Socket: "/run/runvm/c1/vm/vnc.sock"}},
+		{`<domain><devices><graphics type="spice" port="5901" autoport="yes" listen="127.0.0.1"><listen type="address" address="127.0.0.1"/></graphics></devices></domain>`,
+			&Display{Type: "spice", Address: "127.0.0.1:5901"}},
+		{`<domain><devices><graphics type="spice" port="-1" autoport="yes"/></devices></domain>`,
+			&Display{Type: "spice"}},
+	} {
+		display, err := displayOf(c.xml)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (display == nil) != (c.display == nil) || display != nil && *display != *c.display {
+			t.Errorf("Expected %+v for %s, got %+v", c.display, c.xml, display)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package hypervisor
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/harche/runvm/libcontainer/configs"
+)
+
+// domainMount is a mount of the container shared with the guest: the host
+// directory Dir is exported under the 9p tag Tag.
+type domainMount struct {
+	Dir string
+	Tag string
+}
+
+// vmResources are the resources of a container that size and place its
+// guest, as in linux.resources.
+type vmResources struct {
+	CpusetCpus        string
+	CpusetMems        string
+	CpuQuota          int64
+	CpuPeriod         uint64
+	MemoryLimit       uint64
+	MemoryReservation uint64
+	HugepageLimits    []*configs.HugepageLimit
+	// CpuCgroup and MemoryCgroup are set when QEMU is moved into the cpu
+	// and memory cgroups of the container, which then enforce its limits.
+	CpuCgroup    bool
+	MemoryCgroup bool
+}
+
+func (k *VirtualMachineParams) resources() vmResources {
+	return vmResources{
+		CpusetCpus:        k.CpusetCpus,
+		CpusetMems:        k.CpusetMems,
+		CpuQuota:          k.CpuQuota,
+		CpuPeriod:         k.CpuPeriod,
+		MemoryLimit:       k.MemoryLimit,
+		MemoryReservation: k.MemoryReservation,
+		HugepageLimits:    k.HugepageLimits,
+		CpuCgroup:         k.CgroupPaths["cpu"] != "",
+		MemoryCgroup:      k.CgroupPaths["memory"] != "",
+	}
+}
+
+// domainSpec is everything the domain of a virtual machine is built from.
+// The host and the configuration are only looked at when the spec is
+// resolved, so that newDomain gives the same domain, devices in the same
+// order, for the same spec.
+type domainSpec struct {
+	// Name is the name of the domain and UUID its UUID, empty to let
+	// libvirt pick one.
+	Name string
+	UUID string
+	// Resources size the guest, which gets NumCPU vCPUs and Memory MiB
+	// when they do not say otherwise. MemoryOverhead MiB of a memory limit
+	// are left to QEMU.
+	Resources      vmResources
+	NumCPU         int
+	Memory         int
+	MemoryOverhead int
+	Security       vmSecurity
+	// NetInfo is the network of the guest, which has none without a MAC
+	// address.
+	NetInfo NetInfo
+	// Dir is the state dir, where the sockets of the consoles, the agent
+	// and the display are.
+	Dir string
+	// Rootfs is shared with the guest first, then Mounts in this order.
+	Rootfs string
+	Mounts []domainMount
+	// Graphics is the kind of display of the guest, DisplayPasswd its
+	// SPICE password.
+	Graphics      string
+	DisplayPasswd string
+	// Watchdog is the watchdog device of the guest, nil for none.
+	Watchdog *watchdog
+	// CrashDump keeps crashed guests for their memory to be dumped.
+	CrashDump bool
+	// Disk is the overlay the guest runs from, with BackingDisk below it.
+	// BackingDisk is empty when the overlay records it on its own.
+	Disk        string
+	BackingDisk string
+	// SeedImage is the cloud-init image of the guest.
+	SeedImage string
+}
+
+// mountTag returns the 9p tag a mount with destination is shared under.
+// The guest finds it from the destination alone.
+func mountTag(destination string) string {
+	h := sha1.Sum([]byte(strings.Replace(destination, "/", "_", -1)))
+	return hex.EncodeToString(h[:15])
+}
+
+// mountSources returns the sources of the mounts of the container, ordered
+// by destination so that a mount comes before those below it.
+func (k *VirtualMachineParams) mountSources() []string {
+	sources := make([]string, 0, len(k.Mounts))
+	for source := range k.Mounts {
+		sources = append(sources, source)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		di, dj := k.Mounts[sources[i]], k.Mounts[sources[j]]
+		if di != dj {
+			return di < dj
+		}
+		return sources[i] < sources[j]
+	})
+	return sources
+}
+
+// domainSpec resolves the spec of the domain of the guest, sized by
+// baseCfg. Files are mounted through their parent directory, which is
+// only shared once when it is a mount of its own.
+func (k *VirtualMachineParams) domainSpec(baseCfg *vmBaseConfig) (*domainSpec, error) {
+	spec := &domainSpec{
+		Name:           k.Id,
+		Resources:      k.resources(),
+		NumCPU:         baseCfg.numCPU,
+		Memory:         baseCfg.Memory,
+		MemoryOverhead: baseCfg.MemoryOverhead,
+		Security:       k.security(),
+		NetInfo:        k.NetInfo,
+		Dir:            k.DiskDir,
+		Rootfs:         k.Rootfs,
+		Graphics:       baseCfg.graphics,
+		DisplayPasswd:  k.displayPasswd,
+		CrashDump:      baseCfg.crashDump,
+		Disk:           DeltaDiskImgPath(k.DiskDir),
+		BackingDisk:    baseCfg.OriginalDiskPath,
+		SeedImage:      SeedDiskImgPath(k.DiskDir),
+	}
+	if baseCfg.watchdog != nil {
+		watchdog := *baseCfg.watchdog
+		spec.Watchdog = &watchdog
+	}
+	for _, source := range k.mountSources() {
+		dir, err := sharedDir(source)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := k.Mounts[dir]; ok && dir != source {
+			continue
+		}
+		spec.Mounts = append(spec.Mounts, domainMount{Dir: dir, Tag: mountTag(k.Mounts[source])})
+	}
+	return spec, nil
+}
+
+// newDomain builds the domain described by spec.
+func newDomain(spec *domainSpec) (*domain, error) {
+	dom := &domain{
+		Type: "kvm",
+		Name: spec.Name,
+		UUID: spec.UUID,
+	}
+
+	if err := spec.Resources.applyMemoryResources(dom, spec.Memory, spec.MemoryOverhead); err != nil {
+		return nil, err
+	}
+	if err := spec.Resources.applyCpuResources(dom, spec.NumCPU); err != nil {
+		return nil, err
+	}
+
+	dom.OS.Supported = "yes"
+	dom.OS.Type.Content = "hvm"
+	dom.Features = append(dom.Features, feature{Acpi: acpi{}})
+	dom.SecLabels = spec.Security.seclabels()
+	dom.CPU.Mode = "host-passthrough"
+
+	dom.OnPowerOff = "destroy"
+	dom.OnReboot = "destroy"
+	dom.OnCrash = "destroy"
+	if spec.CrashDump {
+		dom.OnCrash = "preserve"
+	}
+
+	diskimage := disk{
+		Type:   "file",
+		Device: "disk",
+		Driver: diskdriver{
+			Name: "qemu",
+			Type: "qcow2",
+		},
+		Source: disksource{
+			File: spec.Disk,
+		},
+		Target: disktarget{
+			Dev: "sda",
+			Bus: "scsi",
+		},
+	}
+	if spec.BackingDisk != "" {
+		diskimage.BackingStore = &backingstore{
+			Type:  "file",
+			Index: "1",
+			Format: diskformat{
+				Type: "raw",
+			},
+			Source: disksource{
+				File: spec.BackingDisk,
+			},
+		}
+	}
+	seedimage := disk{
+		Type:   "file",
+		Device: "cdrom",
+		Driver: diskdriver{
+			Name: "qemu",
+			Type: "raw",
+		},
+		Source: disksource{
+			File: spec.SeedImage,
+		},
+		Target: disktarget{
+			Dev: "sdb",
+			Bus: "scsi",
+		},
+		Readonly: &readonly{},
+	}
+	dom.Devices.Disks = []disk{diskimage, seedimage}
+	dom.Devices.Controller = []controller{{Type: "scsi", Model: "virtio-scsi"}}
+
+	if spec.NetInfo.MacAddr != "" {
+		dom.Devices.NetworkInterfaces = append(dom.Devices.NetworkInterfaces, spec.NetInfo.networkInterface())
+	}
+
+	dom.Devices.Graphics = graphicsDevice(spec.Graphics, spec.Dir, spec.DisplayPasswd)
+	dom.Devices.MemBalloon = balloonDevice()
+	dom.Devices.Watchdog = spec.Watchdog
+	dom.Devices.Panic = &panicDevice{Model: "isa"}
+	dom.Devices.Vsock = vsockDevice()
+
+	dom.Devices.Filesystems = append(dom.Devices.Filesystems, filesystem{
+		Type:       "mount",
+		Accessmode: spec.Security.fsAccessMode(),
+		Source:     fspath{Dir: spec.Rootfs},
+		Target:     fspath{Dir: "share_dir"},
+	})
+	for _, m := range spec.Mounts {
+		dom.Devices.Filesystems = append(dom.Devices.Filesystems, filesystem{
+			Type:       "mount",
+			Accessmode: spec.Security.fsAccessMode(),
+			Source:     fspath{Dir: m.Dir},
+			Target:     fspath{Dir: m.Tag},
+		})
+	}
+
+	// The serial console is the guest's console, hvc0 is unused and hvc1
+	// carries the application.
+	for i, name := range []string{SerialConsole, "arbritary", AppConsole} {
+		target := constgt{Type: "virtio", Port: fmt.Sprint(i)}
+		if i == 0 {
+			target.Type = "serial"
+		}
+		dom.Devices.Consoles = append(dom.Devices.Consoles, console{
+			Type: "unix",
+			Source: channsrc{
+				Mode: "bind",
+				Path: consoleSockPath(spec.Dir, name),
+			},
+			Target: target,
+		})
+	}
+	dom.Devices.Channels = append(dom.Devices.Channels, channel{
+		Type: "unix",
+		Source: channsrc{
+			Mode: "bind",
+			Path: agentSockPath(spec.Dir),
+		},
+		Target: chantgt{
+			Type: "virtio",
+			Name: AgentChannel,
+		},
+	})
+
+	return dom, nil
+}
+
+// marshalDomain returns the XML libvirt defines dom from.
+func marshalDomain(dom *domain) (string, error) {
+	data, err := xml.Marshal(dom)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// buildDomain resolves the spec of the domain of the guest, sized by
+// baseCfg, and builds it.
+func (k *VirtualMachineParams) buildDomain(baseCfg *vmBaseConfig) (*domain, error) {
+	spec, err := k.domainSpec(baseCfg)
+	if err != nil {
+		return nil, err
+	}
+	return newDomain(spec)
+}
+
+func (k *VirtualMachineParams) domainXml(baseCfg *vmBaseConfig) (string, error) {
+	dom, err := k.buildDomain(baseCfg)
+	if err != nil {
+		return "", err
+	}
+	return marshalDomain(dom)
+}
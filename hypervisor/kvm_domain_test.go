@@ -0,0 +1,181 @@
+package hypervisor
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// testDomainSpec returns the spec of a guest of container c1 with no
+// network, mounts or display.
+func testDomainSpec() *domainSpec {
+	dir := "/run/runvm/c1/vm"
+	return &domainSpec{
+		Name:           "c1",
+		NumCPU:         testBaseCfg.numCPU,
+		Memory:         testBaseCfg.Memory,
+		MemoryOverhead: testBaseCfg.MemoryOverhead,
+		Dir:            dir,
+		Rootfs:         "/bundles/c1/rootfs",
+		Disk:           DeltaDiskImgPath(dir),
+		BackingDisk:    testBaseCfg.OriginalDiskPath,
+		SeedImage:      SeedDiskImgPath(dir),
+	}
+}
+
+func TestNewDomainGolden(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		modify func(spec *domainSpec)
+	}{
+		{"default", func(spec *domainSpec) {}},
+		{"nic", func(spec *domainSpec) {
+			spec.NetInfo = NetInfo{IpAddr: "10.88.0.5", MacAddr: "52:54:00:12:34:56", NetMask: "255.255.0.0", GateWay: "10.88.0.1", Bridge: "veth4242"}
+		}},
+		{"mounts", func(spec *domainSpec) {
+			spec.Mounts = []domainMount{
+				{Dir: "/srv/data", Tag: mountTag("/data")},
+				{Dir: "/srv/data/cache", Tag: mountTag("/data/cache")},
+				{Dir: "/etc/app", Tag: mountTag("/etc/app.conf")},
+			}
+		}},
+		{"console-vnc", func(spec *domainSpec) {
+			spec.Graphics = GraphicsVNCSocket
+		}},
+		{"console-spice", func(spec *domainSpec) {
+			spec.Graphics = GraphicsSpice
+			spec.DisplayPasswd = "0123456789abcdef0123456789abcdef"
+		}},
+		{"disk-clone", func(spec *domainSpec) {
+			spec.UUID = "6c2f3f7e-58a1-4b53-9d0e-2f0f6b8f6a11"
+			spec.BackingDisk = ""
+			spec.SeedImage = SeedDiskImgPath("/var/lib/runvm/templates/small")
+		}},
+		{"disk-crash", func(spec *domainSpec) {
+			spec.CrashDump = true
+			spec.Watchdog = &watchdog{Model: DefaultWatchdogModel, Action: "pause"}
+		}},
+	} {
+		spec := testDomainSpec()
+		tc.modify(spec)
+		dom, err := newDomain(spec)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		out, err := xml.MarshalIndent(dom, "", "  ")
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		out = append(out, '\n')
+		golden := filepath.Join("testdata", "domain", tc.name+".xml")
+		if *update {
+			if err := ioutil.WriteFile(golden, out, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		expected, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("%s: %v, run the tests with -update to create it", tc.name, err)
+		}
+		if !bytes.Equal(out, expected) {
+			t.Errorf("%s: domain differs from %s, got\n%s", tc.name, golden, out)
+		}
+	}
+}
+
+func TestNewDomainIsPure(t *testing.T) {
+	spec := testDomainSpec()
+	first, err := newDomain(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newDomain(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("Expected the same domain for the same spec, got %+v and %+v", first, second)
+	}
+}
+
+func TestDomainSpecMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runvm-domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"data", "data/cache", "etc", "logs"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"etc/app.conf", "data/motd"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm := &VirtualMachineParams{
+		Id:      "c1",
+		DiskDir: "/run/runvm/c1/vm",
+		Mounts: map[string]string{
+			filepath.Join(dir, "logs"):         "/var/log",
+			filepath.Join(dir, "data/cache"):   "/data/cache",
+			filepath.Join(dir, "etc/app.conf"): "/etc/app.conf",
+			filepath.Join(dir, "data"):         "/data",
+			// Shared through the data mount.
+			filepath.Join(dir, "data/motd"): "/etc/motd",
+		},
+	}
+	expected := []domainMount{
+		{Dir: filepath.Join(dir, "data"), Tag: mountTag("/data")},
+		{Dir: filepath.Join(dir, "data/cache"), Tag: mountTag("/data/cache")},
+		{Dir: filepath.Join(dir, "etc"), Tag: mountTag("/etc/app.conf")},
+		{Dir: filepath.Join(dir, "logs"), Tag: mountTag("/var/log")},
+	}
+	var previous string
+	for i := 0; i < 10; i++ {
+		spec, err := vm.domainSpec(testBaseCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(spec.Mounts, expected) {
+			t.Fatalf("Expected mounts %+v, got %+v", expected, spec.Mounts)
+		}
+		dom, err := newDomain(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := marshalDomain(dom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if previous != "" && out != previous {
+			t.Fatalf("Expected the same domain XML every time, got\n%s\nand\n%s", previous, out)
+		}
+		previous = out
+	}
+
+	vm.Mounts[filepath.Join(dir, "missing")] = "/missing"
+	if _, err := vm.domainSpec(testBaseCfg); err == nil {
+		t.Error("Expected an error for a missing mount source")
+	}
+}
+
+func TestMountTag(t *testing.T) {
+	// The guest mounts the share of /data under the tag derived from
+	// "_data", as runvm always did.
+	if tag := mountTag("/data"); tag != "c05ad229d6065a3fb9e9fa952b4fa2" {
+		t.Errorf("Expected c05ad229d6065a3fb9e9fa952b4fa2, got %s", tag)
+	}
+	if mountTag("/data") == mountTag("/data/cache") {
+		t.Error("Expected different tags for different destinations")
+	}
+}
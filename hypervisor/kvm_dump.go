@@ -0,0 +1,118 @@
+package hypervisor
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+const (
+	// DefaultCrashDumpDir keeps crash dumps across reboots of the host.
+	DefaultCrashDumpDir = "/var/lib/runvm/crash"
+
+	// Crash dump formats. elf is read by crash and gdb, the kdump ones
+	// are compressed and read by crash.
+	CrashDumpELF         = "elf"
+	CrashDumpKdumpZlib   = "kdump-zlib"
+	CrashDumpKdumpLzo    = "kdump-lzo"
+	CrashDumpKdumpSnappy = "kdump-snappy"
+
+	crashDumpFile = "memory.core"
+)
+
+var crashDumpFormats = map[string]libvirt.DomainCoreDumpFormat{
+	CrashDumpELF:         libvirt.DOMAIN_CORE_DUMP_FORMAT_RAW,
+	CrashDumpKdumpZlib:   libvirt.DOMAIN_CORE_DUMP_FORMAT_KDUMP_ZLIB,
+	CrashDumpKdumpLzo:    libvirt.DOMAIN_CORE_DUMP_FORMAT_KDUMP_LZO,
+	CrashDumpKdumpSnappy: libvirt.DOMAIN_CORE_DUMP_FORMAT_KDUMP_SNAPPY,
+}
+
+// dumpConfig is where and how guests are dumped.
+type dumpConfig struct {
+	dir    string
+	format libvirt.DomainCoreDumpFormat
+	// onCrash keeps crashed guests around until they are dumped.
+	onCrash bool
+}
+
+// panicDevice is the pvpanic device through which the guest kernel
+// reports a panic to libvirt.
+type panicDevice struct {
+	Model string `xml:"model,attr"`
+}
+
+// crashDumpPath returns a new directory for a dump of the virtual machine
+// id taken at t.
+func (d *dumpConfig) crashDumpPath(id string, t time.Time) string {
+	return filepath.Join(d.dir, id, t.UTC().Format("20060102T150405Z"))
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// DumpVM writes the guest memory of the virtual machine id, its domain XML
+// and its serial console log to a new directory under the crash dump
+// directory, and returns that directory. The guest is paused while its
+// memory is written and resumed afterwards unless it crashed.
+func (k *KVMHypervisor) DumpVM(id, reason string) (string, error) {
+	conn, err := k.connect()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	domain, err := conn.LookupDomainByName(k.domainName(id))
+	if err != nil {
+		return "", newError(VMNotExists, id, err)
+	}
+	defer domain.Free()
+
+	dir := k.dump.crashDumpPath(id, time.Now())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "reason"), []byte(reason+"\n"), 0600); err != nil {
+		return "", err
+	}
+	domainXml, err := domain.GetXMLDesc(libvirt.DOMAIN_XML_SECURE)
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "domain.xml"), []byte(domainXml), 0600); err != nil {
+		return "", err
+	}
+	// The serial console is only logged when console logging is enabled.
+	stateDir := StateDir(k.root, id)
+	for _, path := range ConsoleLogFiles(ConsoleLogPath(stateDir, SerialConsole)) {
+		if err := copyFile(path, filepath.Join(dir, filepath.Base(path))); err != nil {
+			return "", err
+		}
+	}
+	if err := domain.CoreDumpWithFormat(filepath.Join(dir, crashDumpFile), k.dump.format, libvirt.DUMP_MEMORY_ONLY); err != nil {
+		return "", fmt.Errorf("dump vm %s: %v", id, err)
+	}
+	return dir, nil
+}
+
+func (k *KVMHypervisor) DumpsOnCrash() bool {
+	return k.dump != nil && k.dump.onCrash
+}
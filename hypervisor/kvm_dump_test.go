@@ -0,0 +1,45 @@
+package hypervisor
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestCrashDumpPath(t *testing.T) {
+	d := &dumpConfig{dir: "/var/lib/runvm/crash"}
+	at := time.Date(2017, 6, 1, 12, 30, 5, 0, time.UTC)
+	if path := d.crashDumpPath("c1", at); path != "/var/lib/runvm/crash/c1/20170601T123005Z" {
+		t.Errorf("Unexpected path %s", path)
+	}
+}
+
+func TestNewBaseConfigCrashDump(t *testing.T) {
+	config := DefaultConfig()
+	baseCfg := newBaseConfig(config)
+	if baseCfg.crashDump || baseCfg.watchdog != nil {
+		t.Errorf("Expected no crash dump and no watchdog by default, got %+v", baseCfg)
+	}
+	config.WatchdogModel = DefaultWatchdogModel
+	if baseCfg = newBaseConfig(config); baseCfg.watchdog.Action != WatchdogReset {
+		t.Errorf("Expected the watchdog to reset the guest, got %+v", baseCfg.watchdog)
+	}
+	config.CrashDump = true
+	baseCfg = newBaseConfig(config)
+	if !baseCfg.crashDump || baseCfg.watchdog.Action != "pause" {
+		t.Errorf("Expected the watchdog to pause the guest, got %+v", baseCfg.watchdog)
+	}
+
+	vmParams := &VirtualMachineParams{Id: "c1", DiskDir: "/run/runvm/c1/vm"}
+	out, err := vmParams.domainXml(baseCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dom domain
+	if err := xml.Unmarshal([]byte(out), &dom); err != nil {
+		t.Fatal(err)
+	}
+	if dom.OnCrash != "preserve" || dom.Devices.Panic == nil || dom.Devices.Panic.Model != "isa" {
+		t.Errorf("Expected crashed guests to be kept, got %s %+v", dom.OnCrash, dom.Devices.Panic)
+	}
+}
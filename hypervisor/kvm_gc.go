@@ -0,0 +1,267 @@
+package hypervisor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libvirt/libvirt-go"
+	"github.com/vishvananda/netlink"
+)
+
+// Kinds of orphans.
+const (
+	OrphanDomain    = "domain"
+	OrphanPoolGuest = "pool-guest"
+	OrphanLink      = "link"
+	OrphanStateDir  = "state-dir"
+)
+
+// Orphan is what is left of a virtual machine that no container owns, after
+// runvm died while it created or destroyed the container.
+type Orphan struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// Path is the directory of a pool guest or state dir.
+	Path string `json:"path,omitempty"`
+}
+
+func (o Orphan) String() string {
+	if o.Path != "" {
+		return fmt.Sprintf("%s %s (%s)", o.Kind, o.Name, o.Path)
+	}
+	return fmt.Sprintf("%s %s", o.Kind, o.Name)
+}
+
+// isRunvmDomain reports whether the domain name, of the XML domainXml,
+// keeps its state below root, the way runvm defines domains.
+func isRunvmDomain(domainXml, root, name string) bool {
+	return strings.Contains(domainXml, StateDir(root, name)+"/")
+}
+
+// vethPid returns the pid in the name of a host side veth created by
+// netinfo.sh, "veth<pid>", or 0 if name is not one.
+func vethPid(name string) int {
+	if !strings.HasPrefix(name, "veth") {
+		return 0
+	}
+	pid, err := strconv.Atoi(name[len("veth"):])
+	if err != nil || pid <= 0 || strconv.Itoa(pid) != name[len("veth"):] {
+		return 0
+	}
+	return pid
+}
+
+// containerStateFile is the state libcontainer saves in the directory of
+// each container below root.
+const containerStateFile = "state.json"
+
+// hasStateLayout reports whether the directory name below root looks like
+// the directory of a container, holding a state dir or a saved state.
+// Anything else below root was not created by runvm and is left alone.
+func hasStateLayout(root, name string) bool {
+	if _, err := os.Lstat(StateDir(root, name)); err == nil {
+		return true
+	}
+	_, err := os.Lstat(filepath.Join(root, name, containerStateFile))
+	return err == nil
+}
+
+// stateDirOrphans returns the directories below root of containers that
+// are not in containers and were last changed more than minAge ago.
+func stateDirOrphans(root string, containers map[string]int, minAge time.Duration) ([]Orphan, error) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var orphans []Orphan
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || name == PoolDir {
+			continue
+		}
+		if _, ok := containers[name]; ok || time.Since(entry.ModTime()) < minAge {
+			continue
+		}
+		if !hasStateLayout(root, name) {
+			continue
+		}
+		orphans = append(orphans, Orphan{Kind: OrphanStateDir, Name: name, Path: filepath.Join(root, name)})
+	}
+	return orphans, nil
+}
+
+// poolGuestOrphans returns the claimed pool guests below root whose
+// container is not in containers. Claims younger than minAge are skipped,
+// as the state dir of the container is linked to the guest only after it
+// is claimed.
+func poolGuestOrphans(root string, containers map[string]int, minAge time.Duration) ([]Orphan, error) {
+	linked := make(map[string]bool)
+	for id := range containers {
+		if target, err := os.Readlink(StateDir(root, id)); err == nil {
+			linked[filepath.Base(target)] = true
+		}
+	}
+	classes, err := ioutil.ReadDir(filepath.Join(root, PoolDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var orphans []Orphan
+	for _, class := range classes {
+		if !class.IsDir() {
+			continue
+		}
+		classDir := filepath.Join(root, PoolDir, class.Name())
+		guests, err := ioutil.ReadDir(classDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, guest := range guests {
+			name := guest.Name()
+			if !guest.IsDir() || linked[name] || time.Since(guest.ModTime()) < minAge {
+				continue
+			}
+			dir := filepath.Join(classDir, name)
+			if _, err := os.Stat(filepath.Join(dir, poolClaimedFile)); err != nil {
+				// Idle guests are kept by the pool.
+				continue
+			}
+			orphans = append(orphans, Orphan{Kind: OrphanPoolGuest, Name: name, Path: dir})
+		}
+	}
+	return orphans, nil
+}
+
+// stateChangedWithin reports whether the state dir of the container name
+// below root was changed less than minAge ago. A domain is defined only
+// after its state dir is filled, so a younger state dir may be of a
+// container being created.
+func stateChangedWithin(root, name string, minAge time.Duration) bool {
+	fi, err := os.Lstat(StateDir(root, name))
+	return err == nil && time.Since(fi.ModTime()) < minAge
+}
+
+func (k *KVMHypervisor) domainOrphans(containers map[string]int, minAge time.Duration) ([]Orphan, error) {
+	conn, err := k.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	domains, err := conn.ListAllDomains(0)
+	if err != nil {
+		return nil, err
+	}
+	var orphans []Orphan
+	for i := range domains {
+		domain := &domains[i]
+		name, err := domain.GetName()
+		if err == nil && !strings.HasPrefix(name, poolGuestPrefix) {
+			if _, ok := containers[name]; !ok && !stateChangedWithin(k.root, name, minAge) {
+				domainXml, err := domain.GetXMLDesc(libvirt.DomainXMLFlags(0))
+				if err == nil && isRunvmDomain(domainXml, k.root, name) {
+					orphans = append(orphans, Orphan{Kind: OrphanDomain, Name: name})
+				}
+			}
+		}
+		domain.Free()
+	}
+	return orphans, nil
+}
+
+// linkOrphans returns the veths created for containers whose init process
+// is gone and which are not in containers.
+func linkOrphans(containers map[string]int) ([]Orphan, error) {
+	pids := make(map[int]bool)
+	for _, pid := range containers {
+		pids[pid] = true
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	var orphans []Orphan
+	for _, link := range links {
+		name := link.Attrs().Name
+		pid := vethPid(name)
+		if link.Type() != "veth" || pid == 0 || pids[pid] {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join("/proc", strconv.Itoa(pid))); err == nil {
+			continue
+		}
+		orphans = append(orphans, Orphan{Kind: OrphanLink, Name: name})
+	}
+	return orphans, nil
+}
+
+// Orphans returns the libvirt domains, claimed pool guests, veths and state
+// dirs below the runvm root that none of containers owns. containers maps
+// the id of every container to the pid of its init process. Domains, state
+// dirs and claims younger than minAge are left alone, as they may belong to
+// a container being created.
+func (k *KVMHypervisor) Orphans(containers map[string]int, minAge time.Duration) ([]Orphan, error) {
+	orphans, err := k.domainOrphans(containers, minAge)
+	if err != nil {
+		return nil, err
+	}
+	guests, err := poolGuestOrphans(k.root, containers, minAge)
+	if err != nil {
+		return nil, err
+	}
+	orphans = append(orphans, guests...)
+	links, err := linkOrphans(containers)
+	if err != nil {
+		return nil, err
+	}
+	orphans = append(orphans, links...)
+	// State dirs go last, so that a domain is removed before the disks it
+	// runs from.
+	dirs, err := stateDirOrphans(k.root, containers, minAge)
+	if err != nil {
+		return nil, err
+	}
+	return append(orphans, dirs...), nil
+}
+
+func (k *KVMHypervisor) RemoveOrphan(o Orphan) error {
+	switch o.Kind {
+	case OrphanDomain:
+		conn, err := k.connect()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		domain, err := conn.LookupDomainByName(o.Name)
+		if err != nil {
+			return newError(VMNotExists, o.Name, err)
+		}
+		defer domain.Free()
+		if active, _ := domain.IsActive(); active {
+			if err := domain.Destroy(); err != nil {
+				return err
+			}
+		}
+		return domain.Undefine()
+	case OrphanPoolGuest:
+		return k.removePoolGuest(o.Path)
+	case OrphanLink:
+		return removeLink(o.Name)
+	case OrphanStateDir:
+		vmDir := StateDir(k.root, o.Name)
+		if fi, err := os.Lstat(vmDir); err == nil && fi.IsDir() {
+			if err := unmountShare(vmDir); err != nil {
+				return err
+			}
+		}
+		return os.RemoveAll(o.Path)
+	default:
+		return fmt.Errorf("unknown orphan %q", o.Kind)
+	}
+}
@@ -0,0 +1,135 @@
+package hypervisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVethPid(t *testing.T) {
+	for name, pid := range map[string]int{
+		"veth1234":  1234,
+		"veth0":     0,
+		"veth":      0,
+		"veth01":    0,
+		"veth12ab":  0,
+		"vethc0ffe": 0,
+		"eth0":      0,
+	} {
+		if got := vethPid(name); got != pid {
+			t.Errorf("vethPid(%q) = %d, expected %d", name, got, pid)
+		}
+	}
+}
+
+func TestIsRunvmDomain(t *testing.T) {
+	xml := `<domain><name>c1</name><devices><disk><source file="/run/runvm/c1/vm/disk.qcow2"/></disk></devices></domain>`
+	if !isRunvmDomain(xml, "/run/runvm", "c1") {
+		t.Error("expected a domain with its disk in the state dir to be runvm's")
+	}
+	if isRunvmDomain(xml, "/run/other", "c1") {
+		t.Error("expected a domain of another root not to be runvm's")
+	}
+	if isRunvmDomain(`<domain><name>web</name></domain>`, "/run/runvm", "web") {
+		t.Error("expected a foreign domain not to be runvm's")
+	}
+}
+
+func TestStateDirOrphans(t *testing.T) {
+	root, err := ioutil.TempDir("", "runvm-gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, dir := range []string{StateDir("", "owned"), StateDir("", "left"), "foreign", "crashed", filepath.Join(PoolDir, "default")} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "crashed", containerStateFile), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	containers := map[string]int{"owned": 42}
+
+	orphans, err := stateDirOrphans(root, containers, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("expected recent state dirs to be kept, got %v", orphans)
+	}
+
+	orphans, err = stateDirOrphans(root, containers, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Orphan{
+		{Kind: OrphanStateDir, Name: "crashed", Path: filepath.Join(root, "crashed")},
+		{Kind: OrphanStateDir, Name: "left", Path: filepath.Join(root, "left")},
+	}
+	if !reflect.DeepEqual(orphans, expected) {
+		t.Errorf("expected orphans %v, got %v", expected, orphans)
+	}
+}
+
+func TestStateChangedWithin(t *testing.T) {
+	root, err := ioutil.TempDir("", "runvm-gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(StateDir(root, "new"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if !stateChangedWithin(root, "new", time.Hour) {
+		t.Error("expected a new state dir to be changed within an hour")
+	}
+	if stateChangedWithin(root, "new", 0) {
+		t.Error("expected no state dir to be changed within 0")
+	}
+	if stateChangedWithin(root, "gone", time.Hour) {
+		t.Error("expected a missing state dir not to be changed")
+	}
+}
+
+func TestPoolGuestOrphans(t *testing.T) {
+	root, err := ioutil.TempDir("", "runvm-gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	classDir := filepath.Join(root, PoolDir, "default")
+	guests := map[string]string{
+		poolGuestPrefix + "idle":    poolReadyFile,
+		poolGuestPrefix + "used":    poolClaimedFile,
+		poolGuestPrefix + "dropped": poolClaimedFile,
+	}
+	for name, marker := range guests {
+		dir := filepath.Join(classDir, name)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, marker), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(root, "c1"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(classDir, poolGuestPrefix+"used"), StateDir(root, "c1")); err != nil {
+		t.Fatal(err)
+	}
+
+	orphans, err := poolGuestOrphans(root, map[string]int{"c1": 42}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped := poolGuestPrefix + "dropped"
+	expected := []Orphan{{Kind: OrphanPoolGuest, Name: dropped, Path: filepath.Join(classDir, dropped)}}
+	if !reflect.DeepEqual(orphans, expected) {
+		t.Errorf("expected orphans %v, got %v", expected, orphans)
+	}
+}
@@ -0,0 +1,119 @@
+package hypervisor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/harche/runvm/libcontainer/configs"
+)
+
+const (
+	netInfoFile = "net.json"
+
+	// bootTimeout is how long WaitBooted waits for a guest.
+	bootTimeout = poolBootTimeout
+)
+
+// pingRequest asks the guest agent whether the guest is up. It answers
+// once the network interfaces of the guest are.
+type pingRequest struct {
+	Ping bool `json:"ping"`
+}
+
+// saveNetInfo keeps the network settings of the guest in dir for
+// VMState, as they are not in the domain XML.
+func saveNetInfo(dir string, info NetInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, netInfoFile), data, 0600)
+}
+
+func loadNetInfo(dir string) (*NetInfo, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, netInfoFile))
+	if err != nil {
+		return nil, err
+	}
+	var info NetInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// vmSockets returns the sockets that exist in the state dir dir by name.
+func vmSockets(dir string) map[string]string {
+	sockets := make(map[string]string)
+	for name, path := range map[string]string{
+		SerialConsole: consoleSockPath(dir, SerialConsole),
+		AppConsole:    consoleSockPath(dir, AppConsole),
+		"agent":       agentSockPath(dir),
+		"attach":      attachSockPath(dir),
+		"vnc":         VncSocketPath(dir),
+	} {
+		if _, err := os.Stat(path); err == nil {
+			sockets[name] = path
+		}
+	}
+	return sockets
+}
+
+// VMState describes the virtual machine id for the hooks of its
+// container. The QEMU pid is 0 once QEMU has exited.
+func (k *KVMHypervisor) VMState(id string) (*configs.VMState, error) {
+	dir := StateDir(k.root, id)
+	if _, err := os.Stat(dir); err != nil {
+		return nil, newError(VMNotExists, id, err)
+	}
+	name := k.domainName(id)
+	state := &configs.VMState{
+		Domain:  name,
+		Sockets: vmSockets(dir),
+	}
+	if pid, err := findQemuPid("/proc", name); err == nil {
+		state.QemuPid = pid
+	}
+	if info, err := loadNetInfo(dir); err == nil {
+		state.IP = info.IpAddr
+	}
+	return state, nil
+}
+
+func pingAgent(dir string) error {
+	data, err := json.Marshal(&pingRequest{Ping: true})
+	if err != nil {
+		return err
+	}
+	conn, err := dialAgent(dir, agentTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return readAgentReply(bufio.NewReader(conn))
+}
+
+// WaitBooted waits until the guest agent of the virtual machine id answers
+// and the network interfaces of the guest are up. A pooled guest answers
+// once it has been handed its container.
+func (k *KVMHypervisor) WaitBooted(id string) error {
+	deadline := time.Now().Add(bootTimeout)
+	for {
+		err := pingAgent(StateDir(k.root, id))
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("vm %s did not boot: %v", id, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,56 @@
+package hypervisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestVMState(t *testing.T) {
+	root, err := ioutil.TempDir("", "runvm-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	k := &KVMHypervisor{root: root}
+
+	if _, err := k.VMState("c1"); err == nil {
+		t.Fatal("expected an error for a container without a virtual machine")
+	}
+
+	dir := StateDir(root, "c1")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveNetInfo(dir, NetInfo{IpAddr: "172.17.0.2", Bridge: "veth42"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"serial.sock", "agent.sock"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state, err := k.VMState("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Domain != "c1" {
+		t.Errorf("expected domain c1, got %q", state.Domain)
+	}
+	if state.QemuPid != 0 {
+		t.Errorf("expected no QEMU pid, got %d", state.QemuPid)
+	}
+	if state.IP != "172.17.0.2" {
+		t.Errorf("expected ip 172.17.0.2, got %q", state.IP)
+	}
+	sockets := map[string]string{
+		SerialConsole: filepath.Join(dir, "serial.sock"),
+		"agent":       filepath.Join(dir, "agent.sock"),
+	}
+	if !reflect.DeepEqual(state.Sockets, sockets) {
+		t.Errorf("expected sockets %v, got %v", sockets, state.Sockets)
+	}
+}
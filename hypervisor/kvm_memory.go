@@ -0,0 +1,116 @@
+package hypervisor
+
+import (
+	"fmt"
+
+	"github.com/docker/go-units"
+	"github.com/harche/runvm/libcontainer/configs"
+)
+
+// DefaultMemoryOverhead is the memory in MiB left to QEMU itself when the
+// guest is sized from the container's memory limit.
+const DefaultMemoryOverhead = 128
+
+type memtune struct {
+	HardLimit *memlimit `xml:"hard_limit,omitempty"`
+	SoftLimit *memlimit `xml:"soft_limit,omitempty"`
+}
+
+type memlimit struct {
+	Unit    string `xml:"unit,attr"`
+	Content uint64 `xml:",chardata"`
+}
+
+type memoryBacking struct {
+	Hugepages hugepages `xml:"hugepages"`
+}
+
+type hugepages struct {
+	Pages []hugepage `xml:"page"`
+}
+
+type hugepage struct {
+	Size uint64 `xml:"size,attr"`
+	Unit string `xml:"unit,attr"`
+}
+
+// hugepageSize returns the largest page size in KiB for which the
+// container has a hugetlb limit, and that limit in KiB.
+func hugepageSize(limits []*configs.HugepageLimit) (uint64, uint64, error) {
+	var size, limit uint64
+	for _, l := range limits {
+		if l == nil || l.Limit == 0 {
+			continue
+		}
+		bytes, err := units.RAMInBytes(l.Pagesize)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid hugepage size %q: %v", l.Pagesize, err)
+		}
+		if kib := uint64(bytes) >> 10; kib > size {
+			size = kib
+			limit = l.Limit >> 10
+		}
+	}
+	return size, limit, nil
+}
+
+// applyMemoryResources sizes the guest memory of dom. With a memory limit
+// the guest gets the limit less overhead MiB for QEMU, otherwise
+// defaultMem MiB. A hugetlb limit backs the guest with pages of that size,
+// capping the guest at the limit. The limit and reservation bound the
+// whole VM through <memtune>, unless QEMU is moved into the memory cgroup
+// of the container, see enterCgroups.
+func (r vmResources) applyMemoryResources(dom *domain, defaultMem, overhead int) error {
+	memory := uint64(defaultMem) << 10
+	if r.MemoryLimit > 0 {
+		limit := r.MemoryLimit >> 10
+		if limit <= uint64(overhead)<<10 {
+			return fmt.Errorf("memory limit of %d bytes leaves no memory for the guest after %d MiB of overhead", r.MemoryLimit, overhead)
+		}
+		memory = limit - uint64(overhead)<<10
+	}
+
+	pageSize, pageLimit, err := hugepageSize(r.HugepageLimits)
+	if err != nil {
+		return err
+	}
+	if pageSize > 0 {
+		if pageLimit < memory {
+			memory = pageLimit
+		}
+		memory -= memory % pageSize
+		if memory == 0 {
+			return fmt.Errorf("hugetlb limit is smaller than one %d KiB page", pageSize)
+		}
+		dom.MemoryBacking = &memoryBacking{
+			Hugepages: hugepages{
+				Pages: []hugepage{{Size: pageSize, Unit: "KiB"}},
+			},
+		}
+	}
+
+	if memory%1024 == 0 {
+		dom.Memory.Unit = "MiB"
+		dom.Memory.Content = int(memory >> 10)
+	} else {
+		dom.Memory.Unit = "KiB"
+		dom.Memory.Content = int(memory)
+	}
+
+	// QEMU leaves the cgroups libvirt tunes for those of the container,
+	// which enforce its limits.
+	if r.MemoryCgroup {
+		return nil
+	}
+	var tune memtune
+	if r.MemoryLimit > 0 {
+		tune.HardLimit = &memlimit{Unit: "KiB", Content: r.MemoryLimit >> 10}
+	}
+	if r.MemoryReservation > 0 {
+		tune.SoftLimit = &memlimit{Unit: "KiB", Content: r.MemoryReservation >> 10}
+	}
+	if tune.HardLimit != nil || tune.SoftLimit != nil {
+		dom.MemTune = &tune
+	}
+	return nil
+}
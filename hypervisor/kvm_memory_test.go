@@ -0,0 +1,110 @@
+package hypervisor
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/harche/runvm/libcontainer/configs"
+)
+
+func TestApplyMemoryResourcesDefault(t *testing.T) {
+	dom := &domain{}
+	vmParams := new(VirtualMachineParams)
+	if err := vmParams.resources().applyMemoryResources(dom, 1024, 128); err != nil {
+		t.Fatal(err)
+	}
+	if dom.Memory.Unit != "MiB" || dom.Memory.Content != 1024 {
+		t.Errorf("Expected 1024 MiB, got %+v", dom.Memory)
+	}
+	if dom.MemTune != nil || dom.MemoryBacking != nil {
+		t.Errorf("Expected no memtune or backing, got %+v %+v", dom.MemTune, dom.MemoryBacking)
+	}
+}
+
+func TestApplyMemoryResourcesLimit(t *testing.T) {
+	dom := &domain{}
+	vmParams := &VirtualMachineParams{
+		MemoryLimit:       512 << 20,
+		MemoryReservation: 256 << 20,
+	}
+	if err := vmParams.resources().applyMemoryResources(dom, 1024, 128); err != nil {
+		t.Fatal(err)
+	}
+	if dom.Memory.Unit != "MiB" || dom.Memory.Content != 384 {
+		t.Errorf("Expected 384 MiB, got %+v", dom.Memory)
+	}
+	if dom.MemTune == nil || dom.MemTune.HardLimit.Content != 512<<10 || dom.MemTune.SoftLimit.Content != 256<<10 {
+		t.Fatalf("Unexpected memtune %+v", dom.MemTune)
+	}
+	out, err := xml.Marshal(dom.MemTune)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), `<hard_limit unit="KiB">524288</hard_limit>`) {
+		t.Errorf("Unexpected memtune xml %s", out)
+	}
+}
+
+func TestApplyMemoryResourcesLimitTooSmall(t *testing.T) {
+	vmParams := &VirtualMachineParams{MemoryLimit: 64 << 20}
+	if err := vmParams.resources().applyMemoryResources(&domain{}, 1024, 128); err == nil {
+		t.Error("Expected an error for a limit below the overhead")
+	}
+}
+
+func TestApplyMemoryResourcesHugepages(t *testing.T) {
+	dom := &domain{}
+	vmParams := &VirtualMachineParams{
+		MemoryLimit: 1024 << 20,
+		HugepageLimits: []*configs.HugepageLimit{
+			{Pagesize: "2MB", Limit: 513 << 20},
+		},
+	}
+	if err := vmParams.resources().applyMemoryResources(dom, 1024, 128); err != nil {
+		t.Fatal(err)
+	}
+	// Capped at the hugetlb limit and rounded down to whole pages.
+	if dom.Memory.Unit != "MiB" || dom.Memory.Content != 512 {
+		t.Errorf("Expected 512 MiB, got %+v", dom.Memory)
+	}
+	if dom.MemoryBacking == nil {
+		t.Fatal("Expected hugepage backing")
+	}
+	out, err := xml.Marshal(dom.MemoryBacking)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<memoryBacking><hugepages><page size="2048" unit="KiB"></page></hugepages></memoryBacking>`
+	if string(out) != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+}
+
+func TestApplyMemoryResourcesHugepagesTooSmall(t *testing.T) {
+	vmParams := &VirtualMachineParams{
+		HugepageLimits: []*configs.HugepageLimit{
+			{Pagesize: "1GB", Limit: 512 << 20},
+		},
+	}
+	if err := vmParams.resources().applyMemoryResources(&domain{}, 1024, 128); err == nil {
+		t.Error("Expected an error for a limit below one page")
+	}
+}
+
+func TestApplyMemoryResourcesContainerCgroup(t *testing.T) {
+	dom := &domain{}
+	vmParams := &VirtualMachineParams{
+		MemoryLimit: 512 << 20,
+		CgroupPaths: map[string]string{"memory": "/sys/fs/cgroup/memory/c1"},
+	}
+	if err := vmParams.resources().applyMemoryResources(dom, 1024, 128); err != nil {
+		t.Fatal(err)
+	}
+	if dom.Memory.Content != 384 {
+		t.Errorf("Expected 384 MiB, got %+v", dom.Memory)
+	}
+	if dom.MemTune != nil {
+		t.Errorf("Expected the limit to be left to the container cgroup, got %+v", dom.MemTune)
+	}
+}
@@ -0,0 +1,203 @@
+package hypervisor
+
+import (
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/libvirt/libvirt-go"
+)
+
+var (
+	eventLoopOnce sync.Once
+	eventLoopErr  error
+)
+
+// startEventLoop registers the default libvirt event implementation and
+// runs it in the background. It must be called before opening a connection
+// that is used to subscribe to domain events.
+func startEventLoop() error {
+	eventLoopOnce.Do(func() {
+		if eventLoopErr = libvirt.EventRegisterDefaultImpl(); eventLoopErr != nil {
+			return
+		}
+		go func() {
+			for {
+				if err := libvirt.EventRunDefaultImpl(); err != nil {
+					logrus.Warnf("libvirt event loop: %v", err)
+				}
+			}
+		}()
+	})
+	return eventLoopErr
+}
+
+// lifecycleEvent maps a libvirt lifecycle event and its detail onto an
+// EventType. Events that do not change the state of the container are
+// ignored. A guest that stops because it crashed or QEMU failed is
+// reported as crashed.
+func lifecycleEvent(event libvirt.DomainEventType, detail int) (EventType, bool) {
+	switch event {
+	case libvirt.DOMAIN_EVENT_STARTED:
+		return EventStarted, true
+	case libvirt.DOMAIN_EVENT_SUSPENDED:
+		return EventPaused, true
+	case libvirt.DOMAIN_EVENT_RESUMED:
+		return EventResumed, true
+	case libvirt.DOMAIN_EVENT_STOPPED:
+		switch libvirt.DomainEventStoppedDetailType(detail) {
+		case libvirt.DOMAIN_EVENT_STOPPED_CRASHED, libvirt.DOMAIN_EVENT_STOPPED_FAILED:
+			return EventCrashed, true
+		}
+		return EventStopped, true
+	case libvirt.DOMAIN_EVENT_CRASHED:
+		return EventCrashed, true
+	}
+	return 0, false
+}
+
+// kvmWatcher delivers the events of a virtual machine to a subscriber.
+// Events are queued rather than sent from the libvirt event loop, which
+// must not block, so that none is lost however slow the subscriber is.
+type kvmWatcher struct {
+	events chan Event
+	// release deregisters from libvirt once the watcher is done.
+	release func()
+
+	m       sync.Mutex
+	pending []Event
+	// closed is set once no more events are queued, after the virtual
+	// machine stopped or crashed or stop was called.
+	closed bool
+	wake   chan struct{}
+	done   chan struct{}
+}
+
+// newWatcher returns a watcher that delivers events once forward runs.
+func newWatcher(release func()) *kvmWatcher {
+	return &kvmWatcher{
+		events:  make(chan Event),
+		release: release,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// send queues an event without blocking the libvirt event loop.
+func (w *kvmWatcher) send(e Event) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.closed {
+		return
+	}
+	w.pending = append(w.pending, e)
+	if e.Type == EventStopped || e.Type == EventCrashed {
+		w.closed = true
+	}
+	w.signal()
+}
+
+func (w *kvmWatcher) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// forward delivers the queued events in order, and closes the channel
+// after the last one or once stop is called.
+func (w *kvmWatcher) forward() {
+	defer func() {
+		close(w.events)
+		// Deregistering from within the callback would deadlock the
+		// event loop, which is why it happens here.
+		w.release()
+	}()
+	for {
+		w.m.Lock()
+		batch, closed := w.pending, w.closed
+		w.pending = nil
+		w.m.Unlock()
+		for _, e := range batch {
+			select {
+			case w.events <- e:
+			case <-w.done:
+				return
+			}
+		}
+		if closed && len(batch) == 0 {
+			return
+		}
+		if len(batch) > 0 {
+			continue
+		}
+		select {
+		case <-w.wake:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *kvmWatcher) stop() {
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.closed = true
+	select {
+	case <-w.done:
+	default:
+		close(w.done)
+	}
+}
+
+func (k *KVMHypervisor) Watch(id string) (<-chan Event, func(), error) {
+	if err := startEventLoop(); err != nil {
+		return nil, nil, newError(ConnectionFailed, id, err)
+	}
+	conn, err := k.connect()
+	if err != nil {
+		return nil, nil, err
+	}
+	var callbackIDs []int
+	w := newWatcher(func() {
+		for _, callbackID := range callbackIDs {
+			if err := conn.DomainEventDeregister(callbackID); err != nil {
+				logrus.Warnf("deregister events for vm %s: %v", id, err)
+			}
+		}
+		conn.Close()
+	})
+	// Subscribe for all domains and filter by name so that the watch can
+	// be set up before the domain is defined or a pooled guest is claimed.
+	callback := func(c *libvirt.Connect, d *libvirt.Domain, event *libvirt.DomainEventLifecycle) {
+		name, err := d.GetName()
+		if err != nil || name != k.domainName(id) {
+			return
+		}
+		if t, ok := lifecycleEvent(event.Event, event.Detail); ok {
+			w.send(Event{ID: id, Type: t})
+		}
+	}
+	watchdogCallback := func(c *libvirt.Connect, d *libvirt.Domain, event *libvirt.DomainEventWatchdog) {
+		name, err := d.GetName()
+		if err != nil || name != k.domainName(id) {
+			return
+		}
+		w.send(Event{ID: id, Type: EventWatchdog})
+	}
+	lifecycleID, err := conn.DomainEventLifecycleRegister(nil, callback)
+	if err != nil {
+		conn.Close()
+		return nil, nil, newError(ConnectionFailed, id, err)
+	}
+	callbackIDs = append(callbackIDs, lifecycleID)
+	watchdogID, err := conn.DomainEventWatchdogRegister(nil, watchdogCallback)
+	if err != nil {
+		conn.DomainEventDeregister(lifecycleID)
+		conn.Close()
+		return nil, nil, newError(ConnectionFailed, id, err)
+	}
+	callbackIDs = append(callbackIDs, watchdogID)
+	// Events sent meanwhile are queued.
+	go w.forward()
+	return w.events, w.stop, nil
+}
@@ -0,0 +1,56 @@
+package hypervisor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatcherKeepsEvents(t *testing.T) {
+	released := make(chan struct{})
+	w := newWatcher(func() { close(released) })
+	go w.forward()
+
+	// The subscriber is slow: nothing is read until the guest crashed.
+	for i := 0; i < 100; i++ {
+		w.send(Event{ID: "c1", Type: EventPaused})
+		w.send(Event{ID: "c1", Type: EventResumed})
+	}
+	w.send(Event{ID: "c1", Type: EventWatchdog})
+	w.send(Event{ID: "c1", Type: EventCrashed})
+	// Nothing follows a crash.
+	w.send(Event{ID: "c1", Type: EventStarted})
+
+	var events []Event
+	for e := range w.events {
+		events = append(events, e)
+	}
+	if len(events) != 202 {
+		t.Fatalf("Expected 202 events, got %d", len(events))
+	}
+	if events[200].Type != EventWatchdog || events[201].Type != EventCrashed {
+		t.Errorf("Expected the watchdog and crash last, got %s and %s", events[200].Type, events[201].Type)
+	}
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the watcher to be released after the crash")
+	}
+	w.stop()
+}
+
+func TestWatcherStop(t *testing.T) {
+	released := make(chan struct{})
+	w := newWatcher(func() { close(released) })
+	go w.forward()
+	w.send(Event{ID: "c1", Type: EventPaused})
+	w.stop()
+	w.stop()
+	for range w.events {
+	}
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the watcher to be released when stopped")
+	}
+	w.send(Event{ID: "c1", Type: EventResumed})
+}
@@ -0,0 +1,543 @@
+package hypervisor
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/libvirt/libvirt-go"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// PoolDir is the directory below the runvm root holding the pooled
+	// guests, in one directory per class.
+	PoolDir = ".pool"
+
+	PoolRefillAuto   = "auto"
+	PoolRefillManual = "manual"
+
+	// poolBootTimeout bounds the time a pooled guest takes to boot up to
+	// its agent.
+	poolBootTimeout = 5 * time.Minute
+
+	poolGuestPrefix = "runvm-pool-"
+	// poolReadyFile marks an idle guest and holds its base image. A claim
+	// renames it to poolClaimedFile.
+	poolReadyFile   = "ready"
+	poolClaimedFile = "claimed"
+	poolShareDir    = "share"
+	poolRootfsDir   = "rootfs"
+)
+
+type poolConfig struct {
+	size    int
+	classes []PoolClass
+	paused  bool
+	// autoRefill refills the pool after each container start.
+	autoRefill bool
+}
+
+// poolClasses returns the configured classes, or a single class of the
+// default guest size.
+func (p *poolConfig) poolClasses(baseCfg *vmBaseConfig) []PoolClass {
+	if len(p.classes) > 0 {
+		return p.classes
+	}
+	return []PoolClass{{Name: "default", NumCPU: baseCfg.numCPU, Memory: baseCfg.Memory}}
+}
+
+func (k *KVMHypervisor) poolClassDir(name string) string {
+	return filepath.Join(k.root, PoolDir, name)
+}
+
+// domainName returns the name of the domain backing container id. A
+// claimed guest keeps its pool name and the state dir of the container
+// links to that of the guest.
+func (k *KVMHypervisor) domainName(id string) string {
+	target, err := os.Readlink(StateDir(k.root, id))
+	if err != nil {
+		return id
+	}
+	return filepath.Base(target)
+}
+
+// poolDomain sizes the guest of the container the way domainXml does and
+// returns the pool class of that size. Containers that need pinning, NUMA
+// placement, hugepages or security labels fit no class, as those are
+// fixed when a guest boots.
+func (k *VirtualMachineParams) poolDomain(classes []PoolClass, baseCfg *vmBaseConfig) (*PoolClass, *domain, error) {
+	if k.ProcessLabel != "" || k.MountLabel != "" || k.AppArmorProfile != "" {
+		return nil, nil, nil
+	}
+	dom := &domain{}
+	resources := k.resources()
+	if err := resources.applyMemoryResources(dom, baseCfg.Memory, baseCfg.MemoryOverhead); err != nil {
+		return nil, nil, err
+	}
+	if err := resources.applyCpuResources(dom, baseCfg.numCPU); err != nil {
+		return nil, nil, err
+	}
+	if dom.MemoryBacking != nil || dom.NUMATune != nil || dom.VCpu.Cpuset != "" || dom.Memory.Unit != "MiB" {
+		return nil, nil, nil
+	}
+	for i := range classes {
+		if classes[i].NumCPU == dom.VCpu.Content && classes[i].Memory == dom.Memory.Content {
+			return &classes[i], dom, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// takeGuest claims the idle guest in dir. The ready marker is renamed, so
+// that a guest is handed out only once among concurrent runvm processes.
+func takeGuest(dir string) bool {
+	return os.Rename(filepath.Join(dir, poolReadyFile), filepath.Join(dir, poolClaimedFile)) == nil
+}
+
+// takeIdleGuest claims an idle guest of classDir booted from image and
+// returns its state dir, or "" if there is none.
+func takeIdleGuest(classDir, image string) (string, error) {
+	entries, err := ioutil.ReadDir(classDir)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(classDir, entry.Name())
+		data, err := ioutil.ReadFile(filepath.Join(dir, poolReadyFile))
+		if err != nil || string(data) != image {
+			continue
+		}
+		if takeGuest(dir) {
+			return dir, nil
+		}
+	}
+	return "", nil
+}
+
+// bindMount mounts source over target, creating target as a directory or
+// an empty file.
+func bindMount(source, target string, dir bool) error {
+	if dir {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+	} else {
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0644)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	return unix.Mount(source, target, "", unix.MS_BIND|unix.MS_REC, "")
+}
+
+// unmountShare detaches the bind mounts in the share of the pooled guest
+// in dir. It must succeed before dir is removed, or the removal would
+// reach into the container's files.
+func unmountShare(dir string) error {
+	share := filepath.Join(dir, poolShareDir)
+	entries, err := ioutil.ReadDir(share)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err := unix.Unmount(filepath.Join(share, entry.Name()), unix.MNT_DETACH)
+		if err != nil && err != unix.EINVAL {
+			return err
+		}
+	}
+	return nil
+}
+
+// shareWithGuest bind mounts the rootfs and mounts of the container into
+// share. QEMU holds on to the share directory itself from the start, so
+// they go below it, where the guest agent picks them up.
+func (k *VirtualMachineParams) shareWithGuest(share string) ([]agentMount, error) {
+	if err := bindMount(k.Rootfs, filepath.Join(share, poolRootfsDir), true); err != nil {
+		return nil, err
+	}
+	var mounts []agentMount
+	for _, source := range k.mountSources() {
+		destination := k.Mounts[source]
+		isSourceDir, err := isDir(source)
+		if err != nil {
+			return nil, err
+		}
+		name := strconv.Itoa(len(mounts))
+		if err := bindMount(source, filepath.Join(share, name), isSourceDir); err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, agentMount{
+			Source:      name,
+			Destination: destination,
+			Dir:         isSourceDir,
+		})
+	}
+	return mounts, nil
+}
+
+// tuneLive applies the memory and CPU bandwidth limits of dom to a
+// running guest.
+func tuneLive(domain *libvirt.Domain, dom *domain) error {
+	if tune := dom.MemTune; tune != nil {
+		params := &libvirt.DomainMemoryParameters{}
+		if tune.HardLimit != nil {
+			params.HardLimitSet = true
+			params.HardLimit = tune.HardLimit.Content
+		}
+		if tune.SoftLimit != nil {
+			params.SoftLimitSet = true
+			params.SoftLimit = tune.SoftLimit.Content
+		}
+		if err := domain.SetMemoryParameters(params, libvirt.DOMAIN_AFFECT_LIVE); err != nil {
+			return err
+		}
+	}
+	if tune := dom.CPUTune; tune != nil && tune.Quota > 0 {
+		params := &libvirt.DomainSchedulerParameters{
+			VcpuPeriodSet: true,
+			VcpuPeriod:    tune.Period,
+			VcpuQuotaSet:  true,
+			VcpuQuota:     uint64(tune.Quota),
+		}
+		if err := domain.SetSchedulerParametersFlags(params, libvirt.DOMAIN_AFFECT_LIVE); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handOver attaches the network interface of the container to the running
+// agent guest in dir and hands the container over to its agent.
+func (k *VirtualMachineParams) handOver(domain *libvirt.Domain, dir string, mounts []agentMount) error {
+	req, err := k.agentRequest(mounts)
+	if err != nil {
+		return err
+	}
+	if k.NetInfo.MacAddr != "" {
+		nicXml, err := xml.Marshal(k.NetInfo.networkInterface())
+		if err != nil {
+			return err
+		}
+		if err := domain.AttachDevice(string(nicXml)); err != nil {
+			return err
+		}
+	}
+	return sendAgent(dir, req)
+}
+
+// claimVM hands an idle pooled guest of the container's size over to it.
+// The state dir of the container becomes a link to that of the guest,
+// whose domain keeps its pool name. It returns a nil domain if the
+// container has to boot a guest of its own.
+func (k *KVMHypervisor) claimVM(vmParams *VirtualMachineParams, baseCfg *vmBaseConfig, undo *rollback) (string, domainHandle, error) {
+	if k.pool == nil {
+		return "", nil, nil
+	}
+	class, dom, err := vmParams.poolDomain(k.pool.poolClasses(baseCfg), baseCfg)
+	if err != nil {
+		return "", nil, newError(DomainXmlFailed, vmParams.Id, err)
+	}
+	if class == nil {
+		return "", nil, nil
+	}
+	dir, err := takeIdleGuest(k.poolClassDir(class.Name), baseCfg.OriginalDiskPath)
+	if err != nil {
+		logrus.Warnf("pool of class %s: %v", class.Name, err)
+	}
+	if dir == "" {
+		logrus.Debugf("no pooled guest of class %s left for vm %s", class.Name, vmParams.Id)
+		return "", nil, nil
+	}
+	undo.add(func() error {
+		return k.removePoolGuest(dir)
+	})
+
+	vmParams.DiskDir = StateDir(k.root, vmParams.Id)
+	if err := os.MkdirAll(filepath.Dir(vmParams.DiskDir), 0700); err != nil {
+		return "", nil, newError(StateDirFailed, vmParams.Id, err)
+	}
+	if err := os.Symlink(dir, vmParams.DiskDir); err != nil {
+		return "", nil, newError(StateDirFailed, vmParams.Id, err)
+	}
+	link := vmParams.DiskDir
+	undo.add(func() error {
+		return os.Remove(link)
+	})
+
+	mounts, err := vmParams.shareWithGuest(filepath.Join(dir, poolShareDir))
+	if err != nil {
+		return "", nil, newError(PoolFailed, vmParams.Id, err)
+	}
+
+	conn, err := k.connect()
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+
+	domain, err := conn.LookupDomainByName(filepath.Base(dir))
+	if err != nil {
+		return "", nil, newError(PoolFailed, vmParams.Id, err)
+	}
+	state, _, err := domain.GetState()
+	if err != nil {
+		return "", nil, newError(PoolFailed, vmParams.Id, err)
+	}
+	if state == libvirt.DOMAIN_PAUSED {
+		if err := domain.Resume(); err != nil {
+			return "", nil, newError(PoolFailed, vmParams.Id, err)
+		}
+	}
+	if err := tuneLive(domain, dom); err != nil {
+		return "", nil, newError(PoolFailed, vmParams.Id, err)
+	}
+	if err := vmParams.handOver(domain, dir, mounts); err != nil {
+		return "", nil, newError(PoolFailed, vmParams.Id, err)
+	}
+	logrus.Debugf("vm %s runs in pooled guest %s", vmParams.Id, filepath.Base(dir))
+	return dir, domain, nil
+}
+
+// bootAgentGuest boots a guest named name with numCpu vCPUs and memory
+// MiB in dir, which runs the guest agent instead of a container, and
+// waits until the agent is ready.
+func (k *KVMHypervisor) bootAgentGuest(name, dir string, numCpu, memory int, baseCfg *vmBaseConfig) (*libvirt.Domain, error) {
+	vmParams := VirtualMachineParams{
+		Id:       name,
+		DiskDir:  dir,
+		Rootfs:   filepath.Join(dir, poolShareDir),
+		watchdog: baseCfg.watchdog != nil,
+	}
+	if err := os.Mkdir(vmParams.Rootfs, 0755); err != nil {
+		return nil, err
+	}
+	if err := k.setupQemuUser(&vmParams); err != nil {
+		return nil, err
+	}
+	if _, err := vmParams.CreateDeltaDiskImage(baseCfg.OriginalDiskPath); err != nil {
+		return nil, err
+	}
+	if _, err := vmParams.createAgentSeedImage(); err != nil {
+		return nil, err
+	}
+	if err := vmParams.createDisplayPasswd(baseCfg); err != nil {
+		return nil, err
+	}
+	guestCfg := *baseCfg
+	guestCfg.numCPU = numCpu
+	guestCfg.Memory = memory
+	domainXml, err := vmParams.domainXml(&guestCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := k.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	domain, err := conn.DomainDefineXML(domainXml)
+	if err != nil {
+		return nil, err
+	}
+	if err := domain.Create(); err != nil {
+		return nil, err
+	}
+	if err := waitAgent(dir, poolBootTimeout); err != nil {
+		return nil, err
+	}
+	return domain, nil
+}
+
+// bootPoolGuest boots a new guest of class in classDir and marks it idle
+// once its agent is ready.
+func (k *KVMHypervisor) bootPoolGuest(classDir string, class PoolClass, baseCfg *vmBaseConfig) (err error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := poolGuestPrefix + class.Name + "-" + hex.EncodeToString(suffix)
+	dir := filepath.Join(classDir, name)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rerr := k.removePoolGuest(dir); rerr != nil {
+				logrus.Warnf("remove pooled guest %s: %v", name, rerr)
+			}
+		}
+	}()
+
+	domain, err := k.bootAgentGuest(name, dir, class.NumCPU, class.Memory, baseCfg)
+	if err != nil {
+		return err
+	}
+	if k.pool.paused {
+		if err := domain.Suspend(); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(dir, poolReadyFile), []byte(baseCfg.OriginalDiskPath), 0600)
+}
+
+// removePoolGuest destroys the pooled guest in dir and removes its state.
+func (k *KVMHypervisor) removePoolGuest(dir string) error {
+	return k.removeGuest(filepath.Base(dir), dir)
+}
+
+// removeGuest destroys the agent guest name and removes its state in dir.
+func (k *KVMHypervisor) removeGuest(name, dir string) error {
+	conn, err := k.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if domain, err := conn.LookupDomainByName(name); err == nil {
+		domain.Destroy()
+		if err := domain.Undefine(); err != nil {
+			return err
+		}
+	}
+	if err := unmountShare(dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// lockPool serializes the runvm processes that fill or drain the pool.
+func (k *KVMHypervisor) lockPool() (*os.File, error) {
+	dir := filepath.Join(k.root, PoolDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// sweepPool removes the guests of classDir that did not finish booting
+// and the idle guests whose base image keep rejects. Claimed guests are
+// left to their containers. It returns the number of idle guests kept.
+// The pool lock must be held.
+func (k *KVMHypervisor) sweepPool(classDir string, keep func(image string) bool) (int, error) {
+	entries, err := ioutil.ReadDir(classDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	idle := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(classDir, entry.Name())
+		// Claims rename the ready marker, so check it before the claimed
+		// one to never miss both.
+		if data, err := ioutil.ReadFile(filepath.Join(dir, poolReadyFile)); err == nil {
+			if keep(string(data)) {
+				idle++
+				continue
+			}
+			if !takeGuest(dir) {
+				continue
+			}
+		} else if _, err := os.Stat(filepath.Join(dir, poolClaimedFile)); err == nil {
+			continue
+		}
+		if err := k.removePoolGuest(dir); err != nil {
+			return idle, err
+		}
+	}
+	return idle, nil
+}
+
+func (k *KVMHypervisor) PoolAutoRefill() bool {
+	return k.pool != nil && k.pool.autoRefill
+}
+
+func (k *KVMHypervisor) FillPool() error {
+	if k.pool == nil {
+		return fmt.Errorf("the pool is disabled, set PoolSize in the hypervisor configuration")
+	}
+	baseCfg := k.baseCfg
+	lock, err := k.lockPool()
+	if err != nil {
+		return newError(PoolFailed, "", err)
+	}
+	defer lock.Close()
+
+	current := func(image string) bool {
+		return image == baseCfg.OriginalDiskPath
+	}
+	for _, class := range k.pool.poolClasses(baseCfg) {
+		classDir := k.poolClassDir(class.Name)
+		if err := os.MkdirAll(classDir, 0700); err != nil {
+			return newError(PoolFailed, "", err)
+		}
+		idle, err := k.sweepPool(classDir, current)
+		if err != nil {
+			return newError(PoolFailed, "", err)
+		}
+		for ; idle < k.pool.size; idle++ {
+			if err := k.bootPoolGuest(classDir, class, baseCfg); err != nil {
+				return newError(PoolFailed, "", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (k *KVMHypervisor) DrainPool() error {
+	lock, err := k.lockPool()
+	if err != nil {
+		return newError(PoolFailed, "", err)
+	}
+	defer lock.Close()
+
+	entries, err := ioutil.ReadDir(filepath.Join(k.root, PoolDir))
+	if err != nil {
+		return newError(PoolFailed, "", err)
+	}
+	none := func(string) bool {
+		return false
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		classDir := filepath.Join(k.root, PoolDir, entry.Name())
+		if _, err := k.sweepPool(classDir, none); err != nil {
+			return newError(PoolFailed, "", err)
+		}
+		// Kept while claimed guests are still in use.
+		os.Remove(classDir)
+	}
+	return nil
+}
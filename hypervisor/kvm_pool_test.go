@@ -0,0 +1,272 @@
+package hypervisor
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testBaseCfg = &vmBaseConfig{
+	numCPU:           1,
+	Memory:           1024,
+	MemoryOverhead:   128,
+	OriginalDiskPath: "/images/base.img",
+}
+
+var testClasses = []PoolClass{
+	{Name: "small", NumCPU: 1, Memory: 1024},
+	{Name: "large", NumCPU: 2, Memory: 896},
+}
+
+func TestPoolDomainDefault(t *testing.T) {
+	vmParams := new(VirtualMachineParams)
+	class, dom, err := vmParams.poolDomain(testClasses, testBaseCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if class == nil || class.Name != "small" {
+		t.Fatalf("Expected class small, got %+v", class)
+	}
+	if dom.MemTune != nil || dom.CPUTune != nil {
+		t.Errorf("Expected no tuning, got %+v %+v", dom.MemTune, dom.CPUTune)
+	}
+}
+
+func TestPoolDomainLimits(t *testing.T) {
+	vmParams := &VirtualMachineParams{
+		MemoryLimit: 1024 << 20,
+		CpuQuota:    200000,
+		CpuPeriod:   100000,
+	}
+	class, dom, err := vmParams.poolDomain(testClasses, testBaseCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if class == nil || class.Name != "large" {
+		t.Fatalf("Expected class large, got %+v", class)
+	}
+	if dom.MemTune == nil || dom.CPUTune == nil || dom.CPUTune.Quota != 100000 {
+		t.Errorf("Expected limits to apply live, got %+v %+v", dom.MemTune, dom.CPUTune)
+	}
+}
+
+func TestPoolDomainNoMatch(t *testing.T) {
+	for _, vmParams := range []*VirtualMachineParams{
+		{MemoryLimit: 512 << 20},
+		{CpusetCpus: "0"},
+		{CpusetMems: "0"},
+		{ProcessLabel: "system_u:system_r:svirt_t:s0:c1,c2"},
+	} {
+		class, _, err := vmParams.poolDomain(testClasses, testBaseCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if class != nil {
+			t.Errorf("Expected no class for %+v, got %+v", vmParams, class)
+		}
+	}
+}
+
+func writeGuest(t *testing.T, classDir, name, marker, image string) string {
+	dir := filepath.Join(classDir, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, marker), []byte(image), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestTakeIdleGuest(t *testing.T) {
+	classDir, err := ioutil.TempDir("", "runvm-pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(classDir)
+
+	writeGuest(t, classDir, "a", poolReadyFile, "/images/old.img")
+	writeGuest(t, classDir, "b", poolClaimedFile, "/images/base.img")
+	c := writeGuest(t, classDir, "c", poolReadyFile, "/images/base.img")
+
+	dir, err := takeIdleGuest(classDir, "/images/base.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != c {
+		t.Fatalf("Expected %s, got %q", c, dir)
+	}
+	if _, err := os.Stat(filepath.Join(c, poolClaimedFile)); err != nil {
+		t.Errorf("Expected guest to be marked claimed: %v", err)
+	}
+	if dir, _ := takeIdleGuest(classDir, "/images/base.img"); dir != "" {
+		t.Errorf("Expected no idle guest left, got %s", dir)
+	}
+	if dir, err := takeIdleGuest(filepath.Join(classDir, "missing"), "/images/base.img"); dir != "" || err != nil {
+		t.Errorf("Expected nothing from a missing class, got %q %v", dir, err)
+	}
+}
+
+func TestDomainName(t *testing.T) {
+	root, err := ioutil.TempDir("", "runvm-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	k := &KVMHypervisor{root: root}
+	if name := k.domainName("c1"); name != "c1" {
+		t.Errorf("Expected c1, got %s", name)
+	}
+	guest := filepath.Join(root, PoolDir, "small", "runvm-pool-small-0011aabb")
+	if err := os.MkdirAll(filepath.Dir(StateDir(root, "c1")), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(guest, StateDir(root, "c1")); err != nil {
+		t.Fatal(err)
+	}
+	if name := k.domainName("c1"); name != "runvm-pool-small-0011aabb" {
+		t.Errorf("Expected the pooled guest, got %s", name)
+	}
+}
+
+// shareSource bind mounts a directory holding a file into the share of the
+// guest in dir, as a container start does, and returns that file.
+func shareSource(t *testing.T, dir string) string {
+	if os.Getuid() != 0 {
+		t.Skip("bind mounts need root")
+	}
+	source, err := ioutil.TempDir("", "runvm-rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(source, "data")
+	if err := ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := bindMount(source, filepath.Join(dir, poolShareDir, poolRootfsDir), true); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// defineRunning defines a running domain named name in lv.
+func defineRunning(t *testing.T, lv *fakeLibvirt, name string) {
+	conn, _ := lv.dial("test:///default")
+	domainXml, err := marshalDomain(&domain{Type: "kvm", Name: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.DomainDefineXML(domainXml); err != nil {
+		t.Fatal(err)
+	}
+	lv.domain(name).state = "running"
+}
+
+func TestDestroyPooledVM(t *testing.T) {
+	k, lv, cleanup := newFakeHypervisor(t)
+	defer cleanup()
+
+	guest := writeGuest(t, k.poolClassDir("small"), "runvm-pool-small-0011aabb", poolClaimedFile, "/images/base.img")
+	file := shareSource(t, guest)
+	defer os.RemoveAll(filepath.Dir(file))
+	defer unmountShare(guest)
+	if err := os.MkdirAll(filepath.Dir(StateDir(k.root, "c1")), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(guest, StateDir(k.root, "c1")); err != nil {
+		t.Fatal(err)
+	}
+	defineRunning(t, lv, filepath.Base(guest))
+
+	// Deleting the container destroys the guest before its root goes.
+	if err := k.DestroyVM("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(k.root, "c1")); err != nil {
+		t.Fatal(err)
+	}
+	if d := lv.domain(filepath.Base(guest)); d != nil {
+		t.Error("Expected the pooled guest to be undefined")
+	}
+	if _, err := os.Stat(guest); !os.IsNotExist(err) {
+		t.Errorf("Expected the pooled guest to be removed, got %v", err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("Expected the rootfs of the container to survive: %v", err)
+	}
+}
+
+func TestAgentRequest(t *testing.T) {
+	vmParams := &VirtualMachineParams{
+		Id:           "c1",
+		Args:         []string{"sh", "-c", "echo hi"},
+		ResoveString: []byte("nameserver 10.0.0.1\n"),
+	}
+	req, err := vmParams.agentRequest(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if mounts, ok := decoded["mounts"].([]interface{}); !ok || len(mounts) != 0 {
+		t.Errorf("Expected an empty mount list, got %v", decoded["mounts"])
+	}
+	if _, ok := decoded["network"]; ok {
+		t.Errorf("Expected no network without an interface, got %v", decoded["network"])
+	}
+	if decoded["resolvConf"] != "nameserver 10.0.0.1\n" {
+		t.Errorf("Unexpected resolv.conf %v", decoded["resolvConf"])
+	}
+	process := decoded["process"].(map[string]interface{})
+	if args := process["args"].([]interface{}); len(args) != 3 || args[2] != "echo hi" {
+		t.Errorf("Unexpected process %v", process)
+	}
+
+	vmParams.NetInfo = NetInfo{IpAddr: "10.0.0.2", MacAddr: "aa", NetMask: "255.255.255.0", GateWay: "10.0.0.1"}
+	req, err = vmParams.agentRequest(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Network == nil || req.Network.Address != "10.0.0.2" || req.Network.Gateway != "10.0.0.1" {
+		t.Errorf("Unexpected network %+v", req.Network)
+	}
+}
+
+func TestNetworkInterfaceXml(t *testing.T) {
+	vmParams := &VirtualMachineParams{NetInfo: NetInfo{Bridge: "veth0"}}
+	out, err := xml.Marshal(vmParams.NetInfo.networkInterface())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<interface type="direct"><source dev="veth0" mode="passthrough"></source><model type="virtio"></model></interface>`
+	if string(out) != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+}
+
+func TestDomainXmlAgentChannel(t *testing.T) {
+	vmParams := &VirtualMachineParams{
+		Id:      "runvm-pool-small-0011aabb",
+		DiskDir: "/run/runvm/.pool/small/runvm-pool-small-0011aabb",
+		Rootfs:  "/run/runvm/.pool/small/runvm-pool-small-0011aabb/share",
+	}
+	out, err := vmParams.domainXml(testBaseCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<channel type="unix"><source mode="bind" path="/run/runvm/.pool/small/runvm-pool-small-0011aabb/agent.sock"></source><target type="virtio" name="org.runvm.agent.0"></target></channel>`
+	if !strings.Contains(out, expected) {
+		t.Errorf("Expected %s in %s", expected, out)
+	}
+}
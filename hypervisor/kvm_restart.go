@@ -0,0 +1,164 @@
+package hypervisor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RestartPolicyAnnotation is the OCI annotation overriding the
+	// RestartPolicy of the hypervisor configuration for a container.
+	RestartPolicyAnnotation = "io.runvm.restart-policy"
+
+	// Restart policies. on-failure takes an optional maximum count of
+	// restarts, as in "on-failure:3".
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+
+	restartsFile = "restarts.json"
+)
+
+// RestartPolicy tells whether runvm restarts the virtual machine of a
+// container after the guest crashed or its watchdog fired.
+type RestartPolicy struct {
+	OnFailure bool
+	// MaxCount is the number of restarts allowed, 0 for no limit.
+	MaxCount int
+}
+
+// ParseRestartPolicy parses a restart policy: "never", "on-failure" or
+// "on-failure:<count>".
+func ParseRestartPolicy(s string) (RestartPolicy, error) {
+	name := s
+	count := ""
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		name, count = s[:i], s[i+1:]
+	}
+	switch name {
+	case RestartNever:
+		if count == "" {
+			return RestartPolicy{}, nil
+		}
+	case RestartOnFailure:
+		policy := RestartPolicy{OnFailure: true}
+		if count == "" {
+			return policy, nil
+		}
+		n, err := strconv.Atoi(count)
+		if err == nil && n > 0 {
+			policy.MaxCount = n
+			return policy, nil
+		}
+	}
+	return RestartPolicy{}, fmt.Errorf("invalid restart policy %q", s)
+}
+
+func (p RestartPolicy) String() string {
+	switch {
+	case !p.OnFailure:
+		return RestartNever
+	case p.MaxCount == 0:
+		return RestartOnFailure
+	default:
+		return fmt.Sprintf("%s:%d", RestartOnFailure, p.MaxCount)
+	}
+}
+
+// Allows reports whether a virtual machine that failed after restarts
+// restarts is restarted again.
+func (p RestartPolicy) Allows(restarts int) bool {
+	return p.OnFailure && (p.MaxCount == 0 || restarts < p.MaxCount)
+}
+
+func loadRestarts(dir string) ([]Restart, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, restartsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var restarts []Restart
+	if err := json.Unmarshal(data, &restarts); err != nil {
+		return nil, err
+	}
+	return restarts, nil
+}
+
+// recordRestart appends a restart for reason to the restarts of the
+// virtual machine in dir.
+func recordRestart(dir, reason string) error {
+	restarts, err := loadRestarts(dir)
+	if err != nil {
+		return err
+	}
+	restarts = append(restarts, Restart{Time: time.Now().UTC(), Reason: reason})
+	data, err := json.Marshal(restarts)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, restartsFile+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, restartsFile))
+}
+
+func (k *KVMHypervisor) Restarts(id string) ([]Restart, error) {
+	return loadRestarts(StateDir(k.root, id))
+}
+
+// RestartVM boots the stopped virtual machine id again. The container runs
+// from its shared rootfs, so only the guest disk is recreated, which makes
+// cloud-init start the container process as on the first boot. Pooled and
+// template guests are set up by the guest agent and cannot be restarted.
+func (k *KVMHypervisor) RestartVM(id string, cgroupPaths map[string]string, reason string) error {
+	dir, err := filepath.EvalSymlinks(StateDir(k.root, id))
+	if err != nil {
+		return newError(VMNotExists, id, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "process.json")); err != nil {
+		return fmt.Errorf("vm %s runs in a pooled or template guest, which cannot be restarted", id)
+	}
+
+	conn, err := k.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	name := k.domainName(id)
+	domain, err := conn.LookupDomainByName(name)
+	if err != nil {
+		return newError(VMNotExists, id, err)
+	}
+	if active, err := domain.IsActive(); err == nil && active {
+		if err := domain.Destroy(); err != nil {
+			return newError(DomainStartFailed, id, err)
+		}
+	}
+
+	vmParams := VirtualMachineParams{Id: id, DiskDir: dir, CgroupPaths: cgroupPaths}
+	if err := os.Remove(DeltaDiskImgPath(dir)); err != nil && !os.IsNotExist(err) {
+		return newError(DeltaDiskFailed, id, err)
+	}
+	if _, err := vmParams.CreateDeltaDiskImage(k.baseCfg.OriginalDiskPath); err != nil {
+		return newError(DeltaDiskFailed, id, err)
+	}
+	if err := domain.Create(); err != nil {
+		return newError(DomainStartFailed, id, err)
+	}
+	if err := vmParams.enterCgroups(name); err != nil {
+		return newError(CgroupFailed, id, err)
+	}
+	return recordRestart(dir, reason)
+}
+
+func (k *KVMHypervisor) RestartPolicy() RestartPolicy {
+	return k.restartPolicy
+}
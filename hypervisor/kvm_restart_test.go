@@ -0,0 +1,116 @@
+package hypervisor
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+func TestParseRestartPolicy(t *testing.T) {
+	for s, expected := range map[string]RestartPolicy{
+		"never":        {},
+		"on-failure":   {OnFailure: true},
+		"on-failure:3": {OnFailure: true, MaxCount: 3},
+	} {
+		policy, err := ParseRestartPolicy(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if policy != expected {
+			t.Errorf("Expected %+v for %s, got %+v", expected, s, policy)
+		}
+		if policy.String() != s {
+			t.Errorf("Expected %s, got %s", s, policy)
+		}
+	}
+	for _, s := range []string{"", "always", "never:1", "on-failure:0", "on-failure:x"} {
+		if _, err := ParseRestartPolicy(s); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+}
+
+func TestRestartPolicyAllows(t *testing.T) {
+	if (RestartPolicy{}).Allows(0) {
+		t.Error("Expected never to refuse restarts")
+	}
+	if !(RestartPolicy{OnFailure: true}).Allows(100) {
+		t.Error("Expected on-failure to restart without limit")
+	}
+	policy := RestartPolicy{OnFailure: true, MaxCount: 2}
+	if !policy.Allows(1) || policy.Allows(2) {
+		t.Errorf("Expected %s to allow exactly 2 restarts", policy)
+	}
+}
+
+func TestRecordRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runvm-restart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	restarts, err := loadRestarts(dir)
+	if err != nil || len(restarts) != 0 {
+		t.Fatalf("Expected no restarts, got %v %v", restarts, err)
+	}
+	for _, reason := range []string{"crashed", "watchdog"} {
+		if err := recordRestart(dir, reason); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restarts, err = loadRestarts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restarts) != 2 || restarts[1].Reason != "watchdog" || restarts[1].Time.IsZero() {
+		t.Errorf("Unexpected restarts %+v", restarts)
+	}
+}
+
+func TestLifecycleEventStopped(t *testing.T) {
+	for detail, expected := range map[libvirt.DomainEventStoppedDetailType]EventType{
+		libvirt.DOMAIN_EVENT_STOPPED_SHUTDOWN:  EventStopped,
+		libvirt.DOMAIN_EVENT_STOPPED_DESTROYED: EventStopped,
+		libvirt.DOMAIN_EVENT_STOPPED_CRASHED:   EventCrashed,
+		libvirt.DOMAIN_EVENT_STOPPED_FAILED:    EventCrashed,
+	} {
+		if e, ok := lifecycleEvent(libvirt.DOMAIN_EVENT_STOPPED, int(detail)); !ok || e != expected {
+			t.Errorf("Expected %s for detail %d, got %s", expected, detail, e)
+		}
+	}
+}
+
+func TestDomainXmlWatchdog(t *testing.T) {
+	vmParams := &VirtualMachineParams{Id: "c1", DiskDir: "/run/runvm/c1/vm"}
+	out, err := vmParams.domainXml(testBaseCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "<watchdog") {
+		t.Errorf("Expected no watchdog, got %s", out)
+	}
+	baseCfg := *testBaseCfg
+	baseCfg.watchdog = &watchdog{Model: DefaultWatchdogModel, Action: WatchdogReset}
+	out, err = vmParams.domainXml(&baseCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<watchdog model="i6300esb" action="reset"></watchdog>`
+	if !strings.Contains(out, expected) {
+		t.Errorf("Expected %s in %s", expected, out)
+	}
+}
+
+func TestArmWatchdog(t *testing.T) {
+	userData := armWatchdog("#cloud-config\nhostname: c1\nruncmd:\n - service myscript start\n")
+	if !strings.Contains(userData, "runcmd:\n - systemctl daemon-reexec\n - service myscript start\n") {
+		t.Errorf("Expected systemd to be re-executed first, got %s", userData)
+	}
+	if !strings.Contains(userData, "RuntimeWatchdogSec=30") {
+		t.Errorf("Expected the runtime watchdog to be set, got %s", userData)
+	}
+}
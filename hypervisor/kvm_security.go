@@ -0,0 +1,157 @@
+package hypervisor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/harche/runvm/libcontainer/user"
+	"github.com/opencontainers/selinux/go-selinux/label"
+)
+
+// vmSecurity is the security settings of a container that QEMU and the
+// directories shared with the guest are confined with.
+type vmSecurity struct {
+	ProcessLabel    string
+	AppArmorProfile string
+	QemuUser        string
+}
+
+func (k *VirtualMachineParams) security() vmSecurity {
+	return vmSecurity{
+		ProcessLabel:    k.ProcessLabel,
+		AppArmorProfile: k.AppArmorProfile,
+		QemuUser:        k.QemuUser,
+	}
+}
+
+// seclabels maps the security settings of the container onto libvirt
+// <seclabel> elements. A process label pins QEMU to that SELinux context.
+// Without any, libvirt applies the dynamic sVirt labelling of the host's
+// security driver.
+func (k vmSecurity) seclabels() []seclab {
+	var labels []seclab
+	if k.ProcessLabel != "" {
+		labels = append(labels, seclab{
+			Type:    "static",
+			Model:   "selinux",
+			Relabel: "yes",
+			Label:   k.ProcessLabel,
+		})
+	}
+	if k.AppArmorProfile != "" {
+		labels = append(labels, seclab{
+			Type:  "static",
+			Model: "apparmor",
+			Label: k.AppArmorProfile,
+		})
+	}
+	if k.QemuUser != "" {
+		labels = append(labels, seclab{
+			Type:    "static",
+			Model:   "dac",
+			Relabel: "yes",
+			Label:   k.QemuUser,
+		})
+	}
+	return labels
+}
+
+// fsAccessMode returns the 9p access mode of shared directories. An
+// unprivileged QEMU cannot change ownership on the host, so it squashes
+// the failures instead.
+func (k vmSecurity) fsAccessMode() string {
+	if k.QemuUser != "" {
+		return "squash"
+	}
+	return "passthrough"
+}
+
+// sharedDir returns the directory exported to the guest for a mount
+// source; files are shared through their parent directory.
+func sharedDir(source string) (string, error) {
+	isSourceDir, err := isDir(source)
+	if err != nil {
+		return "", err
+	}
+	if isSourceDir {
+		return source, nil
+	}
+	return filepath.Abs(filepath.Dir(source))
+}
+
+// relabelMounts returns the sources of the mounts to relabel, and whether
+// their label is shared with other containers.
+func (k *VirtualMachineParams) relabelMounts() (map[string]bool, error) {
+	relabel := make(map[string]bool)
+	for source, option := range k.MountRelabels {
+		if _, ok := k.Mounts[source]; !ok {
+			continue
+		}
+		switch option {
+		case "z":
+			relabel[source] = true
+		case "Z":
+			relabel[source] = false
+		default:
+			return nil, fmt.Errorf("invalid relabel option %q of mount %s", option, source)
+		}
+	}
+	return relabel, nil
+}
+
+// relabelSharedDirs gives the rootfs, which is private to the container,
+// and the mounts that ask for it the mount label of the container, so that
+// a confined QEMU can access them. Only the source of a file mount is
+// relabelled, never the directory it is shared through.
+func (k *VirtualMachineParams) relabelSharedDirs() error {
+	if k.MountLabel == "" {
+		return nil
+	}
+	if err := label.Relabel(k.Rootfs, k.MountLabel, false); err != nil {
+		return err
+	}
+	relabel, err := k.relabelMounts()
+	if err != nil {
+		return err
+	}
+	for source, shared := range relabel {
+		if err := label.Relabel(source, k.MountLabel, shared); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupQemuUser resolves the unprivileged user QEMU runs as and hands the
+// VM state dir over to it. The state root only gains search permission so
+// that QEMU can reach the directory without being able to list others.
+func (k *KVMHypervisor) setupQemuUser(vmParams *VirtualMachineParams) error {
+	if k.qemuUser == "" {
+		return nil
+	}
+	passwdPath, err := user.GetPasswdPath()
+	if err != nil {
+		return err
+	}
+	groupPath, err := user.GetGroupPath()
+	if err != nil {
+		return err
+	}
+	execUser, err := user.GetExecUserPath(k.qemuUser, nil, passwdPath, groupPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(vmParams.DiskDir, execUser.Uid, execUser.Gid); err != nil {
+		return err
+	}
+	fi, err := os.Stat(k.root)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(k.root, fi.Mode().Perm()|0011); err != nil {
+		return err
+	}
+	vmParams.QemuUser = fmt.Sprintf("+%d:+%d", execUser.Uid, execUser.Gid)
+	return nil
+}
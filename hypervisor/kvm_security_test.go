@@ -0,0 +1,72 @@
+package hypervisor
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSeclabels(t *testing.T) {
+	vmParams := &VirtualMachineParams{
+		ProcessLabel:    "system_u:system_r:svirt_t:s0:c1,c2",
+		AppArmorProfile: "runvm-default",
+		QemuUser:        "+107:+107",
+	}
+	expected := []seclab{
+		{Type: "static", Model: "selinux", Relabel: "yes", Label: "system_u:system_r:svirt_t:s0:c1,c2"},
+		{Type: "static", Model: "apparmor", Label: "runvm-default"},
+		{Type: "static", Model: "dac", Relabel: "yes", Label: "+107:+107"},
+	}
+	if labels := vmParams.security().seclabels(); !reflect.DeepEqual(labels, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, labels)
+	}
+	if mode := vmParams.security().fsAccessMode(); mode != "squash" {
+		t.Errorf("Expected squash for an unprivileged qemu, got %s", mode)
+	}
+}
+
+func TestSeclabelsDefault(t *testing.T) {
+	vmParams := new(VirtualMachineParams)
+	if labels := vmParams.security().seclabels(); len(labels) != 0 {
+		t.Errorf("Expected libvirt's default labelling, got %+v", labels)
+	}
+	if mode := vmParams.security().fsAccessMode(); mode != "passthrough" {
+		t.Errorf("Expected passthrough, got %s", mode)
+	}
+}
+
+func TestRelabelMounts(t *testing.T) {
+	vmParams := &VirtualMachineParams{
+		Mounts: map[string]string{
+			"/srv/data":     "/data",
+			"/srv/private":  "/private",
+			"/etc/app.conf": "/etc/app.conf",
+			"/srv/logs":     "/var/log",
+		},
+		MountRelabels: map[string]string{
+			"/srv/data":     "z",
+			"/srv/private":  "Z",
+			"/etc/app.conf": "Z",
+			// Not a mount of the guest.
+			"/srv/other": "z",
+		},
+	}
+	// File mounts are relabelled themselves, not the directory they are
+	// shared through, and mounts that do not ask for it are left alone.
+	expected := map[string]bool{
+		"/srv/data":     true,
+		"/srv/private":  false,
+		"/etc/app.conf": false,
+	}
+	relabel, err := vmParams.relabelMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(relabel, expected) {
+		t.Errorf("Expected %v, got %v", expected, relabel)
+	}
+
+	vmParams.MountRelabels["/srv/logs"] = "zZ"
+	if _, err := vmParams.relabelMounts(); err == nil {
+		t.Error("Expected an error for an invalid relabel option")
+	}
+}
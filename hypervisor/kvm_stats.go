@@ -0,0 +1,104 @@
+package hypervisor
+
+import (
+	"encoding/xml"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/libvirt/libvirt-go"
+)
+
+// domainStates names the states of libvirt domains in DomainStats.
+var domainStates = map[libvirt.DomainState]string{
+	libvirt.DOMAIN_NOSTATE:     "nostate",
+	libvirt.DOMAIN_RUNNING:     "running",
+	libvirt.DOMAIN_BLOCKED:     "blocked",
+	libvirt.DOMAIN_PAUSED:      "paused",
+	libvirt.DOMAIN_SHUTDOWN:    "shutdown",
+	libvirt.DOMAIN_SHUTOFF:     "shutoff",
+	libvirt.DOMAIN_CRASHED:     "crashed",
+	libvirt.DOMAIN_PMSUSPENDED: "pmsuspended",
+}
+
+// domainState returns the name of state.
+func domainState(state libvirt.DomainState) string {
+	if name, ok := domainStates[state]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// domainDisks returns the target devices of the disks in the domain XML
+// domainXml, in the order they are defined.
+func domainDisks(domainXml string) ([]string, error) {
+	var dom struct {
+		Disks []disk `xml:"devices>disk"`
+	}
+	if err := xml.Unmarshal([]byte(domainXml), &dom); err != nil {
+		return nil, err
+	}
+	var devs []string
+	for _, d := range dom.Disks {
+		if d.Target.Dev != "" {
+			devs = append(devs, d.Target.Dev)
+		}
+	}
+	return devs, nil
+}
+
+func (k *KVMHypervisor) DomainStats(id string) (*DomainStats, error) {
+	conn, err := k.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	domain, err := conn.LookupDomainByName(k.domainName(id))
+	if err != nil {
+		return nil, newError(VMNotExists, id, err)
+	}
+	defer domain.Free()
+
+	info, err := domain.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	s := &DomainStats{
+		State:   domainState(info.State),
+		VCpus:   info.NrVirtCpu,
+		CpuTime: info.CpuTime,
+		MaxMem:  info.MaxMem << 10,
+		Memory:  info.Memory << 10,
+	}
+	if info.State != libvirt.DOMAIN_RUNNING && info.State != libvirt.DOMAIN_PAUSED {
+		return s, nil
+	}
+	// The balloon and disks only report while QEMU runs.
+	if balloon, err := k.domainMemoryStats(domain); err == nil {
+		s.Balloon = balloon
+	} else {
+		logrus.Debugf("balloon stats of %s: %v", id, err)
+	}
+	domainXml, err := domain.GetXMLDesc(libvirt.DomainXMLFlags(0))
+	if err != nil {
+		return nil, err
+	}
+	devs, err := domainDisks(domainXml)
+	if err != nil {
+		return nil, err
+	}
+	for _, dev := range devs {
+		bs, err := domain.BlockStats(dev)
+		if err != nil {
+			logrus.Debugf("block stats of %s of %s: %v", dev, id, err)
+			continue
+		}
+		s.Disks = append(s.Disks, DiskStats{
+			Device:        dev,
+			ReadBytes:     uint64(bs.RdBytes),
+			ReadRequests:  uint64(bs.RdReq),
+			WriteBytes:    uint64(bs.WrBytes),
+			WriteRequests: uint64(bs.WrReq),
+		})
+	}
+	return s, nil
+}
@@ -0,0 +1,35 @@
+package hypervisor
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+func TestDomainDisks(t *testing.T) {
+	domainXml := `<domain type="kvm"><name>c1</name><devices>
+<disk type="file" device="disk"><source file="/run/runvm/c1/vm/disk.qcow2"/><target dev="vda" bus="virtio"/></disk>
+<disk type="file" device="cdrom"><source file="/run/runvm/c1/vm/seed.iso"/><target dev="sda" bus="sata"/><readonly/></disk>
+<interface type="direct"><source dev="veth42" mode="bridge"/><target dev="macvtap0"/></interface>
+</devices></domain>`
+	devs, err := domainDisks(domainXml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"vda", "sda"}; !reflect.DeepEqual(devs, expected) {
+		t.Errorf("expected disks %v, got %v", expected, devs)
+	}
+	if _, err := domainDisks("<domain"); err == nil {
+		t.Error("expected an error for invalid XML")
+	}
+}
+
+func TestDomainState(t *testing.T) {
+	if state := domainState(libvirt.DOMAIN_PAUSED); state != "paused" {
+		t.Errorf("expected paused, got %s", state)
+	}
+	if state := domainState(libvirt.DomainState(42)); state != "unknown" {
+		t.Errorf("expected unknown, got %s", state)
+	}
+}
@@ -0,0 +1,290 @@
+package hypervisor
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+const (
+	// DefaultTemplateDir keeps templates across reboots of the host.
+	DefaultTemplateDir = "/var/lib/runvm/templates"
+
+	// TemplateAnnotation is the OCI annotation naming the template a
+	// container is cloned from.
+	TemplateAnnotation = "io.runvm.template"
+
+	templateGuestPrefix = "runvm-template-"
+	templateMemoryFile  = "memory.save"
+	templateConfigFile  = "template.json"
+)
+
+// templateConfig describes the guest saved in a template.
+type templateConfig struct {
+	NumCPU           int
+	Memory           int
+	OriginalDiskPath string
+}
+
+func (k *KVMHypervisor) templatePath(name string) string {
+	return filepath.Join(k.templateDir, name)
+}
+
+func loadTemplateConfig(dir string) (*templateConfig, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, templateConfigFile))
+	if err != nil {
+		return nil, err
+	}
+	var config templateConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// CreateTemplate boots an agent guest of numCpu vCPUs and memory MiB, 0
+// meaning the default size, and saves it as template name once the agent
+// waits for its container. Saving stops the guest and leaves its disk as
+// the base of the clones.
+func (k *KVMHypervisor) CreateTemplate(name string, numCpu, memory int) (err error) {
+	if name == "" || strings.ContainsRune(name, '/') {
+		return fmt.Errorf("invalid template name %q", name)
+	}
+	baseCfg := k.baseCfg
+	if numCpu == 0 {
+		numCpu = baseCfg.numCPU
+	}
+	if memory == 0 {
+		memory = baseCfg.Memory
+	}
+
+	if err := os.MkdirAll(k.templateDir, 0711); err != nil {
+		return newError(TemplateFailed, "", err)
+	}
+	dir := k.templatePath(name)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("template %s already exists", name)
+		}
+		return newError(TemplateFailed, "", err)
+	}
+	guest := templateGuestPrefix + name
+	defer func() {
+		if err != nil {
+			if rerr := k.removeGuest(guest, dir); rerr != nil {
+				err = fmt.Errorf("%v (cleanup: %v)", err, rerr)
+			}
+		}
+	}()
+
+	domain, err := k.bootAgentGuest(guest, dir, numCpu, memory, baseCfg)
+	if err != nil {
+		return newError(TemplateFailed, "", err)
+	}
+	if err := domain.SaveFlags(filepath.Join(dir, templateMemoryFile), "", libvirt.DOMAIN_SAVE_RUNNING); err != nil {
+		return newError(TemplateFailed, "", err)
+	}
+	if err := domain.Undefine(); err != nil {
+		return newError(TemplateFailed, "", err)
+	}
+
+	data, err := json.Marshal(templateConfig{
+		NumCPU:           numCpu,
+		Memory:           memory,
+		OriginalDiskPath: baseCfg.OriginalDiskPath,
+	})
+	if err != nil {
+		return newError(TemplateFailed, "", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, templateConfigFile), data, 0600); err != nil {
+		return newError(TemplateFailed, "", err)
+	}
+	return nil
+}
+
+// usesTemplate reports whether the domain of the XML domainXml is a clone
+// of the template in templateDir, whose seed image clones boot from.
+func usesTemplate(domainXml, templateDir string) bool {
+	return strings.Contains(domainXml, templateDir+"/")
+}
+
+// templateClones returns the names of the domains cloned from the template
+// in templateDir.
+func (k *KVMHypervisor) templateClones(templateDir string) ([]string, error) {
+	conn, err := k.domainConnect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	domains, err := conn.ListAllDomains(0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, domain := range domains {
+			domain.Free()
+		}
+	}()
+	var clones []string
+	for _, domain := range domains {
+		domainXml, err := domain.GetXMLDesc(libvirt.DomainXMLFlags(0))
+		if err != nil {
+			return nil, err
+		}
+		if !usesTemplate(domainXml, templateDir) {
+			continue
+		}
+		name, err := domain.GetName()
+		if err != nil {
+			return nil, err
+		}
+		clones = append(clones, name)
+	}
+	return clones, nil
+}
+
+// RemoveTemplate deletes template name. It is refused while clones of the
+// template, which run from its disk and seed image, are defined.
+func (k *KVMHypervisor) RemoveTemplate(name string) error {
+	if name == "" || strings.ContainsRune(name, '/') {
+		return fmt.Errorf("invalid template name %q", name)
+	}
+	dir := k.templatePath(name)
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("template %s does not exist", name)
+	}
+	clones, err := k.templateClones(dir)
+	if err != nil {
+		return newError(TemplateFailed, "", err)
+	}
+	if len(clones) > 0 {
+		return fmt.Errorf("template %s is in use by %s", name, strings.Join(clones, ", "))
+	}
+	return os.RemoveAll(dir)
+}
+
+// cloneDomain returns the domain XML a clone of the template in
+// templateDir is restored with. It keeps the devices of the saved guest
+// and only changes what is private to the clone: its name and UUID, its
+// state dir and the limits of the container.
+func (k *VirtualMachineParams) cloneDomain(templateDir string, baseCfg *vmBaseConfig) (string, error) {
+	clone := *k
+	clone.NetInfo = NetInfo{}
+	clone.Mounts = nil
+	clone.Rootfs = filepath.Join(k.DiskDir, poolShareDir)
+	spec, err := clone.domainSpec(baseCfg)
+	if err != nil {
+		return "", err
+	}
+	if spec.UUID, err = newUUID(); err != nil {
+		return "", err
+	}
+	// The overlay of the clone records the template disk as its backing
+	// file, which libvirt follows on its own.
+	spec.BackingDisk = ""
+	spec.SeedImage = SeedDiskImgPath(templateDir)
+	dom, err := newDomain(spec)
+	if err != nil {
+		return "", err
+	}
+	return marshalDomain(dom)
+}
+
+// restoreVM clones the template of the container into a guest of its own.
+// The disk of the clone is a copy-on-write overlay of the template disk,
+// while its memory is read from the saved memory of the template. It
+// returns a nil domain if the container does not use a template.
+func (k *KVMHypervisor) restoreVM(vmParams *VirtualMachineParams, baseCfg *vmBaseConfig, undo *rollback) (string, domainHandle, error) {
+	if vmParams.Template == "" {
+		return "", nil, nil
+	}
+	templateDir := k.templatePath(vmParams.Template)
+	template, err := loadTemplateConfig(templateDir)
+	if err != nil {
+		return "", nil, newError(TemplateFailed, vmParams.Id, err)
+	}
+	class := PoolClass{Name: vmParams.Template, NumCPU: template.NumCPU, Memory: template.Memory}
+	fit, _, err := vmParams.poolDomain([]PoolClass{class}, baseCfg)
+	if err != nil {
+		return "", nil, newError(DomainXmlFailed, vmParams.Id, err)
+	}
+	if fit == nil {
+		return "", nil, newError(TemplateFailed, vmParams.Id, fmt.Errorf("container does not fit the %d vCPUs and %d MiB of template %s", template.NumCPU, template.Memory, vmParams.Template))
+	}
+
+	vmParams.DiskDir, err = createQemuDir(k.root, vmParams.Id)
+	if err != nil {
+		return "", nil, newError(StateDirFailed, vmParams.Id, err)
+	}
+	dir := vmParams.DiskDir
+	undo.add(func() error {
+		if err := unmountShare(dir); err != nil {
+			return err
+		}
+		return os.RemoveAll(dir)
+	})
+
+	if err := k.setupQemuUser(vmParams); err != nil {
+		return "", nil, newError(SecurityFailed, vmParams.Id, err)
+	}
+	if err := createOverlay(DeltaDiskImgPath(templateDir), DeltaDiskImgPath(dir)); err != nil {
+		return "", nil, newError(DeltaDiskFailed, vmParams.Id, err)
+	}
+	share := filepath.Join(dir, poolShareDir)
+	if err := os.Mkdir(share, 0755); err != nil {
+		return "", nil, newError(TemplateFailed, vmParams.Id, err)
+	}
+	mounts, err := vmParams.shareWithGuest(share)
+	if err != nil {
+		return "", nil, newError(TemplateFailed, vmParams.Id, err)
+	}
+	if err := vmParams.createDisplayPasswd(baseCfg); err != nil {
+		return "", nil, newError(SecurityFailed, vmParams.Id, err)
+	}
+	domainXml, err := vmParams.cloneDomain(templateDir, baseCfg)
+	if err != nil {
+		return "", nil, newError(DomainXmlFailed, vmParams.Id, err)
+	}
+
+	conn, err := k.connect()
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.DomainRestoreFlags(filepath.Join(templateDir, templateMemoryFile), domainXml, libvirt.DOMAIN_SAVE_RUNNING); err != nil {
+		return "", nil, newError(DomainStartFailed, vmParams.Id, err)
+	}
+	domain, err := conn.LookupDomainByName(vmParams.Id)
+	if err != nil {
+		return "", nil, newError(DomainStartFailed, vmParams.Id, err)
+	}
+	undo.add(domain.Destroy)
+	// Restored domains are transient; define it like a booted one.
+	if _, err := conn.DomainDefineXML(domainXml); err != nil {
+		return "", nil, newError(DomainDefineFailed, vmParams.Id, err)
+	}
+	undo.add(domain.Undefine)
+
+	if err := vmParams.handOver(domain, dir, mounts); err != nil {
+		return "", nil, newError(TemplateFailed, vmParams.Id, err)
+	}
+	return dir, domain, nil
+}
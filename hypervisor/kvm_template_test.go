@@ -0,0 +1,179 @@
+package hypervisor
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestNewUUID(t *testing.T) {
+	uuid, err := newUUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(uuid) {
+		t.Errorf("Invalid uuid %s", uuid)
+	}
+	other, _ := newUUID()
+	if other == uuid {
+		t.Errorf("Expected distinct uuids, got %s twice", uuid)
+	}
+}
+
+func TestCloneDomain(t *testing.T) {
+	vmParams := &VirtualMachineParams{
+		Id:          "c1",
+		DiskDir:     "/run/runvm/c1/vm",
+		Rootfs:      "/bundle/rootfs",
+		MemoryLimit: 1152 << 20,
+		NetInfo:     NetInfo{MacAddr: "aa", Bridge: "veth0"},
+		Mounts:      map[string]string{"/data": "/data"},
+	}
+	out, err := vmParams.cloneDomain("/var/lib/runvm/templates/ci", testBaseCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dom domain
+	if err := xml.Unmarshal([]byte(out), &dom); err != nil {
+		t.Fatal(err)
+	}
+	if dom.Name != "c1" || dom.UUID == "" {
+		t.Errorf("Expected a new identity, got %s %s", dom.Name, dom.UUID)
+	}
+	if dom.Memory.Content != 1024 || dom.MemTune == nil {
+		t.Errorf("Expected 1024 MiB with the container's limit, got %+v %+v", dom.Memory, dom.MemTune)
+	}
+	if len(dom.Devices.NetworkInterfaces) != 0 || len(dom.Devices.Filesystems) != 1 {
+		t.Errorf("Expected the devices of the template, got %+v", dom.Devices)
+	}
+	if dom.Devices.Filesystems[0].Source.Dir != "/run/runvm/c1/vm/share" {
+		t.Errorf("Expected the share of the clone, got %s", dom.Devices.Filesystems[0].Source.Dir)
+	}
+	if disk := dom.Devices.Disks[0]; disk.Source.File != "/run/runvm/c1/vm/disk.img" || disk.BackingStore != nil {
+		t.Errorf("Unexpected disk %+v", disk)
+	}
+	if seed := dom.Devices.Disks[1]; seed.Source.File != "/var/lib/runvm/templates/ci/seed.img" {
+		t.Errorf("Unexpected seed %+v", seed)
+	}
+	if len(dom.Devices.Channels) != 1 || dom.Devices.Channels[0].Source.Path != "/run/runvm/c1/vm/agent.sock" {
+		t.Errorf("Unexpected agent channel %+v", dom.Devices.Channels)
+	}
+}
+
+func TestLoadTemplateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runvm-template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := loadTemplateConfig(dir); err == nil {
+		t.Error("Expected an error without a template")
+	}
+	data := `{"NumCPU":2,"Memory":896,"OriginalDiskPath":"/images/base.img"}`
+	if err := ioutil.WriteFile(filepath.Join(dir, templateConfigFile), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadTemplateConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.NumCPU != 2 || config.Memory != 896 {
+		t.Errorf("Unexpected template %+v", config)
+	}
+}
+
+func TestRemoveTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runvm-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	k, lv, cleanup := newFakeHypervisor(t)
+	defer cleanup()
+	k.templateDir = dir
+	for _, name := range []string{"", "../x", "missing"} {
+		if err := k.RemoveTemplate(name); err == nil {
+			t.Errorf("Expected an error for %q", name)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "ci"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// A clone runs from the seed image of the template.
+	spec := testDomainSpec()
+	spec.SeedImage = SeedDiskImgPath(filepath.Join(dir, "ci"))
+	dom, err := newDomain(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domainXml, err := marshalDomain(dom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _ := lv.dial(k.uri)
+	if _, err := conn.DomainDefineXML(domainXml); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.RemoveTemplate("ci"); err == nil {
+		t.Fatal("Expected a template in use to be kept")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ci")); err != nil {
+		t.Fatalf("Expected the template in use to be kept, got %v", err)
+	}
+
+	lv.domain("c1").Undefine()
+	if err := k.RemoveTemplate("ci"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ci")); !os.IsNotExist(err) {
+		t.Errorf("Expected the template to be removed, got %v", err)
+	}
+}
+
+func TestUsesTemplate(t *testing.T) {
+	domainXml := `<disk type="file" device="cdrom"><source file="/var/lib/runvm/templates/ci/seed.img"></source></disk>`
+	if !usesTemplate(domainXml, "/var/lib/runvm/templates/ci") {
+		t.Error("Expected the clone to use template ci")
+	}
+	if usesTemplate(domainXml, "/var/lib/runvm/templates/c") {
+		t.Error("Expected the clone not to use template c")
+	}
+}
+
+func TestDestroyClone(t *testing.T) {
+	k, lv, cleanup := newFakeHypervisor(t)
+	defer cleanup()
+
+	for _, id := range []string{"c1", "c2"} {
+		dir, err := createQemuDir(k.root, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := shareSource(t, dir)
+		defer os.RemoveAll(filepath.Dir(file))
+		defer unmountShare(dir)
+		// The domain of c2 is gone already.
+		if id == "c1" {
+			defineRunning(t, lv, id)
+		}
+
+		if err := k.DestroyVM(id); err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		if err := os.RemoveAll(filepath.Join(k.root, id)); err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		if d := lv.domain(id); d != nil {
+			t.Errorf("%s: expected the clone to be undefined", id)
+		}
+		if _, err := os.Stat(file); err != nil {
+			t.Errorf("%s: expected the rootfs of the container to survive: %v", id, err)
+		}
+	}
+}
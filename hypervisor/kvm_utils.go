@@ -7,15 +7,14 @@ import (
 	"os/exec"
 	"strings"
 	"bufio"
-	"strconv"
-	"encoding/xml"
+	"encoding/json"
 	"path/filepath"
 	"errors"
 	"regexp"
-	"encoding/hex"
-	"crypto/sha1"
 	//"syscall"
 	//"runtime"
+
+	"github.com/vishvananda/netlink"
 )
 
 func DeltaDiskImgPath(diskPath string) string{
@@ -26,54 +25,101 @@ func SeedDiskImgPath(diskPath string) string{
 	return diskPath + "/seed.img"
 }
 
+// EnvPath sets the environment of the guest process from the KEY=value
+// pairs of the process spec, which are passed on unchanged. The guest
+// looks the process up in the PATH among them.
 func (k *VirtualMachineParams) EnvPath(envVars []string) {
-	envMap := make(map[string]string)
-	for _, element := range envVars {
-
+	k.Env = append([]string{}, envVars...)
+}
 
-		envVar := strings.Split(element, "=")
-		envVarName := envVar[0]
-		envVarValue := envVar[1]
+// processSpec is the process the guest executes, sent to it as JSON so
+// that arguments and environment reach it without any shell quoting.
+type processSpec struct {
+	Args     []string `json:"args"`
+	Env      []string `json:"env"`
+	Cwd      string   `json:"cwd"`
+	Terminal bool     `json:"terminal,omitempty"`
+}
 
-		envVarName = strings.TrimSpace(envVarName)
-		envVarValue = strings.TrimSpace(envVarValue)
-		envMap[envVarName] = envVarValue
-		//if envVarName == "PATH" {
-		//	k.Path = envVarValue
-		//	break
-		//}
+func (k *VirtualMachineParams) processSpec() ([]byte, error) {
+	spec := processSpec{
+		Args:     k.Args,
+		Env:      k.Env,
+		Cwd:      k.CwD,
+		Terminal: k.Terminal,
 	}
-	k.Env = envMap
-
+	if spec.Env == nil {
+		spec.Env = []string{}
+	}
+	return json.Marshal(spec)
 }
 
-func (k *VirtualMachineParams) CreateDeltaDiskImage() (string, error) {
+// execHelper runs in the guest. It chroots into the container rootfs and
+// execs the process described by process.json directly, with its output
+// on the application console. A terminal process gets the console as its
+// controlling terminal and reads its input from it, other processes have
+// no input and a raw console.
+const execHelper = `import fcntl
+import json
+import os
+import sys
+import termios
+import tty
+
+with open(sys.argv[1]) as f:
+    spec = json.load(f)
+
+if spec.get("terminal"):
+    os.setsid()
+    console = os.open("/dev/hvc1", os.O_RDWR)
+    fcntl.ioctl(console, termios.TIOCSCTTY, 0)
+    os.dup2(console, 0)
+else:
+    console = os.open("/dev/hvc1", os.O_RDWR | os.O_NOCTTY)
+    tty.setraw(console)
+    os.dup2(os.open("/dev/null", os.O_RDONLY), 0)
+os.dup2(console, 1)
+os.dup2(console, 2)
+
+env = {}
+for element in spec["env"]:
+    name, _, value = element.partition("=")
+    env[name] = value
+
+os.chroot(sys.argv[2])
+os.chdir(spec["cwd"] or "/")
+os.execvpe(spec["args"][0], spec["args"], env)
+`
+
+// CreateDeltaDiskImage creates the qcow2 overlay the guest runs from in
+// its disk directory, backed by the raw base image baseImage.
+func (k *VirtualMachineParams) CreateDeltaDiskImage(baseImage string) (string, error) {
 	deltaImagePath, err := exec.LookPath("qemu-img")
 	if err != nil {
 		return "", fmt.Errorf("qemu-img is not installed on your PATH. Please, install it to run isolated qemu container")
 	}
 
-	currentDir, err := os.Getwd()
+	deltaDisk := DeltaDiskImgPath(k.DiskDir)
+	err = exec.Command(deltaImagePath, "create", "-f", "qcow2", "-F", "raw", "-b", baseImage, deltaDisk).Run()
 	if err != nil {
-		return "", fmt.Errorf("Could not determine the current directory")
+		return "", fmt.Errorf("Could not execute qemu-img")
 	}
 
-	err = os.Chdir(k.DiskDir)
-	if err != nil {
-		return "", fmt.Errorf("Could not changed to directory %s", k.DiskDir)
-	}
+	return deltaDisk, nil
+}
 
-	err = exec.Command(deltaImagePath, "create", "-f", "qcow2", "-b", OriginalDiskPath, "disk.img").Run()
+// createOverlay creates a qcow2 image at path whose writes stay out of
+// the qcow2 image backing.
+func createOverlay(backing, path string) error {
+	qemuImgPath, err := exec.LookPath("qemu-img")
 	if err != nil {
-		return "", fmt.Errorf("Could not execute qemu-img")
+		return fmt.Errorf("qemu-img is not installed on your PATH. Please, install it to run isolated qemu container")
 	}
-
-	err = os.Chdir(currentDir)
+	err = exec.Command(qemuImgPath, "create", "-f", "qcow2", "-F", "qcow2", "-b", backing, path).Run()
 	if err != nil {
-		return "", fmt.Errorf("Could not changed to directory %s", currentDir)
+		return fmt.Errorf("Could not execute qemu-img")
 	}
-
-	return DeltaDiskImgPath(k.DiskDir), nil
+	return nil
 }
 
 func (k *VirtualMachineParams) CreateSeedImage() (string, error) {
@@ -95,12 +141,16 @@ runcmd:
  MOUNT_PLACEHOLDER
  - mkdir /cdrom
  - mount /dev/cdrom /cdrom
- - cp -p /cdrom/execute.sh /mnt/.
+ - mkdir -p /run/runvm
+ - cp -p /cdrom/process.json /cdrom/exec.py /run/runvm/.
  - cp -p /cdrom/resolv.conf /mnt/etc/.
  - cp -p /cdrom/hosts /mnt/etc/.
  - cp -p /cdrom/systemd-data  /etc/systemd/system/myscript.service
  - mount --bind /dev/ /mnt/dev
  - mount --bind /proc /mnt/proc
+ - cp -p /cdrom/agent.py /run/runvm/.
+ - cp -p /cdrom/agent.service /etc/systemd/system/runvm-agent.service
+ - systemctl --no-block start runvm-agent
  - systemctl enable myscript
  - service myscript start
 `
@@ -120,37 +170,16 @@ After=cloud-init.service
 
 [Service]
 Type=oneshot
-ExecStart=/usr/sbin/chroot /mnt /execute.sh
+ExecStart=/usr/bin/python3 /run/runvm/exec.py /run/runvm/process.json /mnt
 ExecStop=/sbin/poweroff -f
 
 [Install]
 WantedBy=multi-user.target
 `
 
-	scriptContent := `#!/bin/sh
-ENV_PLACEHOLDER
-cd %s
-%s > /dev/hvc1 2>&1
-`
-	var command string
-	if len(k.Args) > 0 {
-		args := []string{}
-		for _, arg := range k.Args {
-			if strings.Contains(arg, " ") {
-				args = append(args, fmt.Sprintf("'%s'", arg))
-			} else {
-				args = append(args, arg)
-			}
-		}
-		argsAsString := strings.Join(args, " ")
-		command = fmt.Sprintf("%s", argsAsString)
-
-	}
-
 	userDataString = fmt.Sprintf(userDataString, k.Id)
 
 	r := regexp.MustCompile("MOUNT_PLACEHOLDER")
-	m := regexp.MustCompile("/")
 
 	if len(k.Mounts) == 0 {
 		userDataString = r.ReplaceAllString(userDataString, "")
@@ -159,15 +188,10 @@ cd %s
 	} else {
 		var mountString string
 		var mountStringSlice []string
-		for _, destination := range k.Mounts {
+		for _, source := range k.mountSources() {
+			destination := k.Mounts[source]
 			mountStringSlice = append(mountStringSlice, " - mkdir -p /mnt" + destination)
-			mountLabel := m.ReplaceAllString(destination, "_")
-		        //mountLabel=  Digest::MD5.new.update(opts[:hostpath]).to_s[0,31]
-			h := sha1.New()
-			h.Write([]byte(mountLabel))
-			hashInBytes := h.Sum(nil)[:15	]
-			mountLabel = hex.EncodeToString(hashInBytes)
-			mountStringSlice = append(mountStringSlice, " - mount "+ mountLabel+" /mnt"+destination+" -t 9p -o trans=virtio")
+			mountStringSlice = append(mountStringSlice, " - mount "+ mountTag(destination)+" /mnt"+destination+" -t 9p -o trans=virtio")
 		}
 
 		mountString = strings.Join(mountStringSlice, "\n")
@@ -175,70 +199,47 @@ cd %s
 	}
 
 	systemdData := []byte(systemdString)
-	scriptDataString := fmt.Sprintf(scriptContent, k.CwD, command)
-
-	s := regexp.MustCompile("ENV_PLACEHOLDER")
-	var envVars []string
-	for envVar, envVal := range k.Env {
-		envVars = append(envVars, "export " + envVar +"="+envVal)
-	}
-	envString := strings.Join(envVars, "\n")
-	scriptDataString = s.ReplaceAllString(scriptDataString, envString)
-
-	scriptData := []byte(scriptDataString)
-	userData := []byte(userDataString)
-	metaData := []byte(fmt.Sprintf(metaDataString, k.NetInfo.IpAddr, k.NetInfo.NetMask, k.NetInfo.GateWay))
-
-	currentDir, err := os.Getwd()
+	processData, err := k.processSpec()
 	if err != nil {
-		return "", fmt.Errorf("Could not determine the current directory")
-	}
-
-	err = os.Chdir(k.DiskDir)
-	if err != nil {
-		return "", fmt.Errorf("Could not changed to directory %s", k.DiskDir)
-	}
-
-	writeErrorUserData := ioutil.WriteFile("user-data", userData, 0700)
-	if writeErrorUserData != nil {
-		return "", fmt.Errorf("Could not write user-data for %s", k.Id)
-	}
-
-	writeErrorMetaData := ioutil.WriteFile("meta-data", metaData, 0700)
-	if writeErrorMetaData != nil {
-		return "", fmt.Errorf("Could not write meta-data for %s", k.Id)
-	}
-
-	writeErrorSystemdData := ioutil.WriteFile("systemd-data", systemdData, 0700)
-	if writeErrorSystemdData != nil {
-		return "", fmt.Errorf("Could not write systemd-data for %s", k.Id)
+		return "", err
 	}
-
-	writeErrorScriptData := ioutil.WriteFile("execute.sh", scriptData, 0700)
-	if writeErrorScriptData != nil {
-		return "", fmt.Errorf("Could not write execute.sh for %s", k.Id)
-	}
-
-	writeErrorResolvConf := ioutil.WriteFile("resolv.conf", k.ResoveString, 0700)
-	if writeErrorResolvConf != nil {
-		return "", fmt.Errorf("Could not write resolv.conf for %s", k.Id)
+	if k.watchdog {
+		userDataString = armWatchdog(userDataString)
 	}
+	userData := []byte(userDataString)
+	metaData := []byte(fmt.Sprintf(metaDataString, k.NetInfo.IpAddr, k.NetInfo.NetMask, k.NetInfo.GateWay))
 
-	writeErrorHosts := ioutil.WriteFile("hosts", k.HostsString, 0700)
-	if writeErrorHosts != nil {
-		return "", fmt.Errorf("Could not write hosts for %s", k.Id)
+	// The files are written to the state dir and genisoimage runs there,
+	// leaving the working directory of runvm alone.
+	files := []struct {
+		name string
+		data []byte
+		mode os.FileMode
+	}{
+		{"user-data", userData, 0700},
+		{"meta-data", metaData, 0700},
+		{"systemd-data", systemdData, 0700},
+		{"process.json", processData, 0600},
+		{"exec.py", []byte(execHelper), 0700},
+		{"agent.py", []byte(agentHelper), 0700},
+		{"agent.service", []byte(fmt.Sprintf(agentService, " serve")), 0700},
+		{"resolv.conf", k.ResoveString, 0700},
+		{"hosts", k.HostsString, 0700},
+	}
+	args := []string{"-output", "seed.img", "-volid", "cidata", "-joliet", "-rock"}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(k.DiskDir, f.name), f.data, f.mode); err != nil {
+			return "", fmt.Errorf("Could not write %s for %s", f.name, k.Id)
+		}
+		args = append(args, f.name)
 	}
 
-	err = exec.Command(getisoimagePath, "-output", "seed.img", "-volid", "cidata", "-joliet", "-rock", "user-data", "meta-data", "systemd-data", "execute.sh", "resolv.conf", "hosts").Run()
-	if err != nil {
+	cmd := exec.Command(getisoimagePath, args...)
+	cmd.Dir = k.DiskDir
+	if err := cmd.Run(); err != nil {
 		return "", fmt.Errorf("Could not execute genisoimage")
 	}
 
-	err = os.Chdir(currentDir)
-	if err != nil {
-		return "", fmt.Errorf("Could not changed to directory %s", currentDir)
-	}
-
 	return SeedDiskImgPath(k.DiskDir), nil
 }
 
@@ -284,238 +285,44 @@ func isDir(filePath string) (bool, error) {
 
 
 
-func (k *VirtualMachineParams) DomainXml() (string, error) {
-	// TODO - read them from config.json
-
-	config, err := ParseConfig()
-	if err != nil {
-		return "", err
-	}
-
-	numCpu := config.NumCPU
-	if numCpu == 0 {
-		numCpu = NumCPU
-	}
-
-	defaultMaxCpus := config.DefaultMaxCpus
-	if defaultMaxCpus == 0 {
-		defaultMaxCpus = DefaultMaxCpus
-	}
-
-	defaultMaxMem := config.DefaultMaxMem
-	if defaultMaxMem == 0 {
-		defaultMaxMem = DefaultMaxMem
-	}
-
-	defaultMem := config.DefaultMem
-	if defaultMem == 0 {
-		defaultMem = DefaultMem
-	}
-
-	originalDiskPath := config.OriginalDiskPath
-	if originalDiskPath == "" {
-		originalDiskPath = OriginalDiskPath
-	}
-
+// newBaseConfig returns the sizing and base image of virtual machines
+// given by config.
+func newBaseConfig(config *Configuration) *vmBaseConfig {
 	baseCfg := &vmBaseConfig{
-		numCPU:           numCpu,
-		DefaultMaxCpus:   defaultMaxCpus,
-		DefaultMaxMem:    defaultMaxMem,
-		Memory:           defaultMem,
-		OriginalDiskPath: originalDiskPath,
-	}
-
-
-	// Domain XML Formation
-	dom := &domain{
-		Type: "kvm",
-		Name: k.Id,
-	}
-
-	dom.Memory.Unit = "MiB"
-	dom.Memory.Content = baseCfg.Memory
-
-	dom.VCpu.Current = strconv.Itoa(baseCfg.numCPU)
-	dom.VCpu.Content = baseCfg.numCPU
-
-	dom.OS.Supported = "yes"
-	dom.OS.Type.Content = "hvm"
-
-	acpiFeature := feature{
-		Acpi: acpi{},
-	}
-	dom.Features = append(dom.Features, acpiFeature)
-
-	dom.SecLabel.Type = "none"
-
-	dom.CPU.Mode = "host-passthrough"
-
-	dom.OnPowerOff = "destroy"
-	dom.OnReboot = "destroy"
-	dom.OnCrash = "destroy"
-
-	diskimage := disk{
-		Type:   "file",
-		Device: "disk",
-		Driver: diskdriver{
-			Name: "qemu",
-			Type: "qcow2",
-		},
-		Source: disksource{
-			File: DeltaDiskImgPath(k.DiskDir),
-		},
-		BackingStore: &backingstore{
-			Type:  "file",
-			Index: "1",
-			Format: diskformat{
-				Type: "raw",
-			},
-			Source: disksource{
-				File: baseCfg.OriginalDiskPath,
-			},
-		},
-		Target: disktarget{
-			Dev: "sda",
-			Bus: "scsi",
-		},
-	}
-	dom.Devices.Disks = append(dom.Devices.Disks, diskimage)
-
-	seedimage := disk{
-		Type:   "file",
-		Device: "cdrom",
-		Driver: diskdriver{
-			Name: "qemu",
-			Type: "raw",
-		},
-		Source: disksource{
-			File: SeedDiskImgPath(k.DiskDir),
-		},
-		Target: disktarget{
-			Dev: "sdb",
-			Bus: "scsi",
-		},
-		Readonly: &readonly{},
-	}
-	dom.Devices.Disks = append(dom.Devices.Disks, seedimage)
-
-	storageController := controller{
-		Type:  "scsi",
-		Model: "virtio-scsi",
-	}
-	dom.Devices.Controller = append(dom.Devices.Controller, storageController)
-
-	macAddress := k.NetInfo.MacAddr
-	if macAddress != "" {
-		networkInterface := nic{
-			Type: "direct",
-			//Mac: nicmac{
-			//	Address: macAddress,
-			//},
-			Source: sourceDev{
-				Dev: k.NetInfo.Bridge,
-				Mode: "passthrough",
-			},
-			Model: nicmodel{
-				Type: "virtio",
-			},
+		numCPU:           config.NumCPU,
+		DefaultMaxCpus:   config.DefaultMaxCpus,
+		DefaultMaxMem:    config.DefaultMaxMem,
+		Memory:           config.DefaultMem,
+		MemoryOverhead:   config.MemoryOverhead,
+		OriginalDiskPath: config.OriginalDiskPath,
+	}
+	if config.WatchdogModel != "" {
+		baseCfg.watchdog = &watchdog{Model: config.WatchdogModel, Action: config.WatchdogAction}
+		if config.CrashDump {
+			baseCfg.watchdog.Action = "pause"
 		}
-		dom.Devices.NetworkInterfaces = append(dom.Devices.NetworkInterfaces, networkInterface)
-
-	}
-
-	dom.Devices.Graphics = graphics{Type:"vnc", Port:"-1"}
-	fs := filesystem{
-		Type:       "mount",
-		Accessmode: "passthrough",
-		Source: fspath{
-			Dir : k.Rootfs,
-		},
-		Target: fspath{
-			Dir: "share_dir",
-		},
 	}
-	dom.Devices.Filesystems = append(dom.Devices.Filesystems, fs)
-
-	for source, destination := range k.Mounts {
-		m := regexp.MustCompile("/")
-		mountLabel := m.ReplaceAllString(destination, "_")
-		h := sha1.New()
-		h.Write([]byte(mountLabel))
-		hashInBytes := h.Sum(nil)[:15	]
-		mountLabel = hex.EncodeToString(hashInBytes)
-
-		isDestDir, err := isDir(source)
-		if err != nil {
-			return "", err
-		}
-
-		if !isDestDir{
-			source, err = filepath.Abs(filepath.Dir(source))
-			if err != nil {
-				return "", err
-			}
-
-			if _, ok := k.Mounts[source]; ok {
-				continue
-			}
-		}
-
-		fs := filesystem{
-			Type:       "mount",
-			Accessmode: "passthrough",
-			Source: fspath{
-				Dir : source,
-			},
-			Target: fspath{
-				Dir: mountLabel,
-			},
-		}
-		dom.Devices.Filesystems = append(dom.Devices.Filesystems, fs)
-	}
-
-	serialConsole := console{
-		Type: "unix",
-		Source: channsrc{
-			Mode: "bind",
-			Path: fmt.Sprintf("%s/serial.sock", k.DiskDir),
-		},
-		Target: constgt{
-			Type: "serial",
-			Port: "0",
-		},
-	}
-	dom.Devices.Consoles = append(dom.Devices.Consoles, serialConsole)
-	vmConsole := console{
-		Type: "unix",
-		Source: channsrc{
-			Mode: "bind",
-			Path: fmt.Sprintf("%s/arbritary.sock", k.DiskDir),
-		},
-		Target: constgt{
-			Type: "virtio",
-			Port: "1",
-		},
-	}
-	dom.Devices.Consoles = append(dom.Devices.Consoles, vmConsole)
+	baseCfg.crashDump = config.CrashDump
+	baseCfg.graphics = config.Graphics
+	return baseCfg
+}
 
-	appConsole := console{
-		Type: "unix",
-		Source: channsrc{
-			Mode: "bind",
-			Path: fmt.Sprintf("%s/app.sock", k.DiskDir),
+// networkInterface returns the interface of the guest on the host side
+// veth of the container.
+func (n NetInfo) networkInterface() nic {
+	return nic{
+		Type: "direct",
+		//Mac: nicmac{
+		//	Address: n.MacAddr,
+		//},
+		Source: sourceDev{
+			Dev:  n.Bridge,
+			Mode: "passthrough",
 		},
-		Target: constgt{
+		Model: nicmodel{
 			Type: "virtio",
-			Port: "2",
 		},
 	}
-	dom.Devices.Consoles = append(dom.Devices.Consoles, appConsole)
-	data, err := xml.Marshal(dom)
-	if err != nil {
-		return "", err
-	}
-	return string(data), nil
 }
 
 func ConsoleReader(reader *bufio.Reader, output chan string) {
@@ -548,12 +355,27 @@ func ConsoleReader(reader *bufio.Reader, output chan string) {
 	}
 }
 
-func createQemuDir(id string, err error) (string, error) {
-	qemuDirectoryPath := fmt.Sprintf("/var/run/docker-qemu/%s", id)
-	err = os.MkdirAll(qemuDirectoryPath, 0700)
+// StateDir returns the directory holding the disks, seed image, sockets
+// and logs of the virtual machine backing container id.
+func StateDir(root, id string) string {
+	return filepath.Join(root, id, "vm")
+}
+
+func createQemuDir(root, id string) (string, error) {
+	qemuDirectoryPath := StateDir(root, id)
+	err := os.MkdirAll(qemuDirectoryPath, 0700)
 	return qemuDirectoryPath, err
 }
 
+// removeLink deletes the host side veth created by netinfo.sh.
+func removeLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkDel(link)
+}
+
 
 func NetworkInfo(err error, networkNamespacePath string) (error, []string) {
 	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
@@ -561,7 +383,7 @@ func NetworkInfo(err error, networkNamespacePath string) (error, []string) {
 	cmdArgs := []string{networkNamespacePath}
 	cmdOut, err := exec.Command(cmdName, cmdArgs...).Output()
 	if err != nil {
-		fmt.Println(os.Stderr, "There was an error running the command: ", err)
+		fmt.Fprintln(os.Stderr, "There was an error running the command: ", err)
 
 	}
 	out := string(cmdOut)
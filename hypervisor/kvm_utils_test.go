@@ -1,6 +1,12 @@
 package hypervisor
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -18,12 +24,145 @@ func TestSeedDiskImgPath(t *testing.T) {
 	}
 }
 
+func TestStateDir(t *testing.T) {
+	stateDir := StateDir("/run/runvm", "abc")
+	if stateDir != "/run/runvm/abc/vm" {
+		t.Error("Expected /run/runvm/abc/vm, got ", stateDir)
+	}
+}
+
 func TestEnvPath(t *testing.T) {
 	vmParmas := new(VirtualMachineParams)
 	envVars := []string{"PATH=/abc", "GO=/mnt"}
 
 	vmParmas.EnvPath(envVars)
-	if vmParmas.Path != "/abc" {
-		t.Error("Expected /abc, got ", vmParmas.Path)
+	if !reflect.DeepEqual(vmParmas.Env, envVars) {
+		t.Errorf("Expected %q, got %q", envVars, vmParmas.Env)
+	}
+	envVars[0] = "PATH=/changed"
+	if vmParmas.Env[0] != "PATH=/abc" {
+		t.Error("Expected the environment to be copied, got ", vmParmas.Env)
+	}
+}
+
+func TestEnvPathKeepsValues(t *testing.T) {
+	vmParmas := new(VirtualMachineParams)
+	envVars := []string{"OPTS=-Dkey=value", "EMPTY=", " SPACED = value "}
+
+	vmParmas.EnvPath(envVars)
+	if !reflect.DeepEqual(vmParmas.Env, envVars) {
+		t.Errorf("Expected %q, got %q", envVars, vmParmas.Env)
+	}
+}
+
+func TestProcessSpecRoundTrip(t *testing.T) {
+	vmParmas := &VirtualMachineParams{
+		Args: []string{
+			"/bin/echo",
+			"it's",
+			`"double"`,
+			"$HOME",
+			"`id`",
+			"$(reboot)",
+			"a; rm -rf /",
+			"line\nbreak",
+			"carriage\rreturn",
+			"tab\tand \\ backslash",
+			"",
+		},
+		CwD: "/work dir/$x",
+	}
+	vmParmas.EnvPath([]string{"A=b=c", "QUOTE='\"", "CMD=`id`;$(id)", "NL=x\ny"})
+
+	data, err := vmParmas.processSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec processSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(spec.Args, vmParmas.Args) {
+		t.Errorf("Expected args %q, got %q", vmParmas.Args, spec.Args)
+	}
+	if !reflect.DeepEqual(spec.Env, vmParmas.Env) {
+		t.Errorf("Expected env %q, got %q", vmParmas.Env, spec.Env)
+	}
+	if spec.Cwd != vmParmas.CwD {
+		t.Errorf("Expected cwd %q, got %q", vmParmas.CwD, spec.Cwd)
+	}
+}
+
+func TestProcessSpecEmptyEnv(t *testing.T) {
+	vmParmas := &VirtualMachineParams{Args: []string{"true"}, CwD: "/"}
+	data, err := vmParmas.processSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"args":["true"],"env":[],"cwd":"/"}` {
+		t.Errorf("Expected an empty env list, got %s", data)
+	}
+}
+
+func TestCreateDeltaDiskImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runvm-delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// qemu-img records its arguments.
+	script := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "qemu-img"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	vmParams := VirtualMachineParams{DiskDir: dir}
+	disk, err := vmParams.CreateDeltaDiskImage("/images/base.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disk != DeltaDiskImgPath(dir) {
+		t.Errorf("Expected %s, got %s", DeltaDiskImgPath(dir), disk)
+	}
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "create -f qcow2 -F raw -b /images/base.img " + DeltaDiskImgPath(dir)
+	if got := strings.TrimSpace(string(args)); got != expected {
+		t.Errorf("Expected qemu-img %s, got %s", expected, got)
+	}
+}
+
+func TestCreateSeedImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runvm-seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer fakeImageTools(t, dir)()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vmParams := VirtualMachineParams{Id: "c1", DiskDir: dir, Args: []string{"/bin/true"}, CwD: "/"}
+	seed, err := vmParams.CreateSeedImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seed != SeedDiskImgPath(dir) {
+		t.Errorf("Expected %s, got %s", SeedDiskImgPath(dir), seed)
+	}
+	for _, f := range []string{seed, filepath.Join(dir, "user-data"), filepath.Join(dir, "process.json")} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("Expected %s to be created: %v", f, err)
+		}
+	}
+	if now, _ := os.Getwd(); now != wd {
+		t.Errorf("Expected the working directory to stay %s, got %s", wd, now)
 	}
 }
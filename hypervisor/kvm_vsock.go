@@ -0,0 +1,244 @@
+package hypervisor
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/libvirt/libvirt-go"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// PortForwardAnnotation is the OCI annotation listing the ports
+	// forwarded to a container for as long as it runs, see
+	// ParsePortForwards.
+	PortForwardAnnotation = "io.runvm.port-forward"
+
+	// agentForwardPort is the vsock port on which the guest agent relays
+	// forwarded connections to the ports of the container.
+	agentForwardPort = 1024
+
+	defaultForwardAddress = "127.0.0.1"
+)
+
+type vsockCID struct {
+	Auto    string `xml:"auto,attr,omitempty"`
+	Address string `xml:"address,attr,omitempty"`
+}
+
+// vsock is the vhost-vsock device of a guest. libvirt gives each guest a
+// context id (CID) of its own, through which the host reaches it even
+// without a network.
+type vsock struct {
+	Model string   `xml:"model,attr"`
+	CID   vsockCID `xml:"cid"`
+}
+
+func vsockDevice() *vsock {
+	return &vsock{Model: "virtio", CID: vsockCID{Auto: "yes"}}
+}
+
+// PortForward forwards connections to Address:HostPort on the host to
+// GuestPort of the container.
+type PortForward struct {
+	Address   string
+	HostPort  int
+	GuestPort int
+}
+
+func (f PortForward) String() string {
+	return fmt.Sprintf("%s:%d:%d", f.Address, f.HostPort, f.GuestPort)
+}
+
+// ParsePortForwards parses a comma separated list of port forwards, each
+// "[address:]hostport:guestport". The address defaults to 127.0.0.1.
+func ParsePortForwards(s string) ([]PortForward, error) {
+	var forwards []PortForward
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		parts := strings.Split(spec, ":")
+		f := PortForward{Address: defaultForwardAddress}
+		switch len(parts) {
+		case 2:
+		case 3:
+			f.Address, parts = parts[0], parts[1:]
+		default:
+			return nil, fmt.Errorf("invalid port forward %q, expected [address:]hostport:guestport", spec)
+		}
+		var err error
+		if f.HostPort, err = parsePort(parts[0]); err != nil {
+			return nil, fmt.Errorf("invalid port forward %q: %v", spec, err)
+		}
+		if f.GuestPort, err = parsePort(parts[1]); err != nil {
+			return nil, fmt.Errorf("invalid port forward %q: %v", spec, err)
+		}
+		forwards = append(forwards, f)
+	}
+	return forwards, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// vsockCIDOf returns the CID libvirt gave the guest in the live domain XML
+// domainXml.
+func vsockCIDOf(domainXml string) (uint32, error) {
+	var dom struct {
+		Vsock *vsock `xml:"devices>vsock"`
+	}
+	if err := xml.Unmarshal([]byte(domainXml), &dom); err != nil {
+		return 0, err
+	}
+	if dom.Vsock == nil || dom.Vsock.CID.Address == "" {
+		return 0, fmt.Errorf("guest has no vsock")
+	}
+	cid, err := strconv.ParseUint(dom.Vsock.CID.Address, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid vsock CID %q", dom.Vsock.CID.Address)
+	}
+	return uint32(cid), nil
+}
+
+func (k *KVMHypervisor) vsockCID(id string) (uint32, error) {
+	conn, err := k.connect()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	domain, err := conn.LookupDomainByName(k.domainName(id))
+	if err != nil {
+		return 0, newError(VMNotExists, id, err)
+	}
+	defer domain.Free()
+	domainXml, err := domain.GetXMLDesc(libvirt.DomainXMLFlags(0))
+	if err != nil {
+		return 0, err
+	}
+	return vsockCIDOf(domainXml)
+}
+
+// vsockConn is a connection to a vsock port of a guest.
+type vsockConn struct {
+	*os.File
+}
+
+func dialVsock(cid, port uint32) (*vsockConn, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: cid, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// A non-blocking file is served by the runtime poller, so that
+	// closing it interrupts pending reads.
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &vsockConn{os.NewFile(uintptr(fd), fmt.Sprintf("vsock:%d:%d", cid, port))}, nil
+}
+
+func (c *vsockConn) CloseWrite() error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = unix.Shutdown(int(fd), unix.SHUT_WR)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// DialGuest connects to port of the container in the virtual machine id,
+// through the guest agent.
+func (k *KVMHypervisor) DialGuest(id string, port int) (io.ReadWriteCloser, error) {
+	cid, err := k.vsockCID(id)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialVsock(cid, agentForwardPort)
+	if err != nil {
+		return nil, fmt.Errorf("connect to vm %s: %v", id, err)
+	}
+	if _, err := fmt.Fprintf(conn, "%d\n", port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The reply is read a byte at a time to leave what follows it to
+	// the caller.
+	var reply []byte
+	b := make([]byte, 1)
+	for len(reply) == 0 || reply[len(reply)-1] != '\n' {
+		if _, err := conn.Read(b); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("guest agent: %v", err)
+		}
+		reply = append(reply, b[0])
+	}
+	if r := strings.TrimSpace(string(reply)); r != "ok" {
+		conn.Close()
+		return nil, fmt.Errorf("guest agent: %s", r)
+	}
+	return conn, nil
+}
+
+// splice copies between a and b in both directions until both are done,
+// then closes them.
+func splice(a, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst, src io.ReadWriteCloser) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface {
+			CloseWrite() error
+		}); ok {
+			cw.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	<-done
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// ForwardPort relays the connections accepted on l to guestPort of the
+// container in the virtual machine id until l is closed.
+func (k *KVMHypervisor) ForwardPort(id string, l net.Listener, guestPort int) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			guest, err := k.DialGuest(id, guestPort)
+			if err != nil {
+				logrus.Warnf("forward %s to port %d of %s: %v", conn.RemoteAddr(), guestPort, id, err)
+				conn.Close()
+				return
+			}
+			splice(conn, guest)
+		}()
+	}
+}
@@ -0,0 +1,66 @@
+package hypervisor
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePortForwards(t *testing.T) {
+	forwards, err := ParsePortForwards("19100:9100, 0.0.0.0:8080:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []PortForward{
+		{Address: "127.0.0.1", HostPort: 19100, GuestPort: 9100},
+		{Address: "0.0.0.0", HostPort: 8080, GuestPort: 80},
+	}
+	if !reflect.DeepEqual(forwards, expected) {
+		t.Errorf("Expected %v, got %v", expected, forwards)
+	}
+	for _, s := range []string{"8080", "8080:0", "http:80", "a:b:8080:80"} {
+		if _, err := ParsePortForwards(s); err == nil {
+			t.Errorf("Expected %q to be refused", s)
+		}
+	}
+}
+
+func TestDomainXmlVsock(t *testing.T) {
+	vmParams := &VirtualMachineParams{Id: "c1", DiskDir: "/run/runvm/c1/vm"}
+	out, err := vmParams.domainXml(testBaseCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<vsock model="virtio"><cid auto="yes"></cid></vsock>`
+	if !strings.Contains(out, expected) {
+		t.Errorf("Expected %s in %s", expected, out)
+	}
+}
+
+func TestVsockCIDOf(t *testing.T) {
+	cid, err := vsockCIDOf(`<domain><devices><vsock model="virtio"><cid auto="yes" address="7"/></vsock></devices></domain>`)
+	if err != nil || cid != 7 {
+		t.Errorf("Expected CID 7, got %d %v", cid, err)
+	}
+	if _, err := vsockCIDOf(`<domain><devices></devices></domain>`); err == nil {
+		t.Error("Expected an error for a guest without vsock")
+	}
+}
+
+func TestSplice(t *testing.T) {
+	client, a := net.Pipe()
+	b, guest := net.Pipe()
+	go splice(a, b)
+	go func() {
+		client.Write([]byte("ping"))
+		client.Close()
+	}()
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(guest, got); err != nil || !bytes.Equal(got, []byte("ping")) {
+		t.Fatalf("Expected ping, got %q %v", got, err)
+	}
+	guest.Close()
+}
@@ -0,0 +1,46 @@
+package hypervisor
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// DefaultWatchdogModel is the emulated watchdog to give guests when
+	// they should have one.
+	DefaultWatchdogModel = "i6300esb"
+
+	// Watchdog actions, taken when the guest stops feeding its watchdog.
+	// As guests do not reboot, a reset stops the guest like poweroff
+	// does. dump saves the memory of the guest to the auto dump path of
+	// libvirt first.
+	WatchdogReset    = "reset"
+	WatchdogPoweroff = "poweroff"
+	WatchdogDump     = "dump"
+
+	// watchdogTimeout is the time in seconds a hung guest kernel is given
+	// before the watchdog fires.
+	watchdogTimeout = 30
+)
+
+type watchdog struct {
+	Model  string `xml:"model,attr"`
+	Action string `xml:"action,attr"`
+}
+
+// watchdogUserData is the cloud-config that lets systemd feed the
+// watchdog of the guest, arming it.
+const watchdogUserData = `write_files:
+ - path: /etc/systemd/system.conf.d/runvm-watchdog.conf
+   content: |
+     [Manager]
+     RuntimeWatchdogSec=%d
+`
+
+// armWatchdog adds the watchdog settings to the cloud-config userData.
+// systemd is re-executed first thing in runcmd so that it picks up the
+// file written before.
+func armWatchdog(userData string) string {
+	userData = strings.Replace(userData, "\nruncmd:\n", "\nruncmd:\n - systemctl daemon-reexec\n", 1)
+	return userData + fmt.Sprintf(watchdogUserData, watchdogTimeout)
+}
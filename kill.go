@@ -77,10 +77,11 @@ signal to the init process of the "ubuntu01" container:
 		if err := checkArgs(context, 2, maxArgs); err != nil {
 			return err
 		}
-		container, err := getContainer(context)
+		container, unlock, err := getLockedContainer(context)
 		if err != nil {
 			return err
 		}
+		defer unlock()
 
 		sigstr := context.Args().Get(1)
 		if sigstr == "" {
@@ -198,6 +198,16 @@ type Hooks struct {
 
 	// Poststop commands are executed after the container init process exits.
 	Poststop []Hook
+
+	// GuestBooted commands are executed once the guest of the container
+	// has booted and its network interfaces are up, again after every
+	// restart of the virtual machine.
+	GuestBooted []Hook
+
+	// WorkloadExited commands are executed after the virtual machine
+	// stopped because the process of the container exited, before the
+	// container is destroyed.
+	WorkloadExited []Hook
 }
 
 type Capabilities struct {
@@ -215,9 +225,11 @@ type Capabilities struct {
 
 func (hooks *Hooks) UnmarshalJSON(b []byte) error {
 	var state struct {
-		Prestart  []CommandHook
-		Poststart []CommandHook
-		Poststop  []CommandHook
+		Prestart       []CommandHook
+		Poststart      []CommandHook
+		Poststop       []CommandHook
+		GuestBooted    []CommandHook
+		WorkloadExited []CommandHook
 	}
 
 	if err := json.Unmarshal(b, &state); err != nil {
@@ -235,6 +247,8 @@ func (hooks *Hooks) UnmarshalJSON(b []byte) error {
 	hooks.Prestart = deserialize(state.Prestart)
 	hooks.Poststart = deserialize(state.Poststart)
 	hooks.Poststop = deserialize(state.Poststop)
+	hooks.GuestBooted = deserialize(state.GuestBooted)
+	hooks.WorkloadExited = deserialize(state.WorkloadExited)
 	return nil
 }
 
@@ -252,15 +266,40 @@ func (hooks Hooks) MarshalJSON() ([]byte, error) {
 		return serializableHooks
 	}
 
-	return json.Marshal(map[string]interface{}{
+	serialized := map[string]interface{}{
 		"prestart":  serialize(hooks.Prestart),
 		"poststart": serialize(hooks.Poststart),
 		"poststop":  serialize(hooks.Poststop),
-	})
+	}
+	// The virtual machine hooks are left out unless set.
+	if len(hooks.GuestBooted) > 0 {
+		serialized["guestbooted"] = serialize(hooks.GuestBooted)
+	}
+	if len(hooks.WorkloadExited) > 0 {
+		serialized["workloadexited"] = serialize(hooks.WorkloadExited)
+	}
+	return json.Marshal(serialized)
 }
 
 // HookState is the payload provided to a hook on execution.
-type HookState specs.State
+type HookState struct {
+	specs.State
+	// VM describes the virtual machine of the container once it exists.
+	VM *VMState `json:"vm,omitempty"`
+}
+
+// VMState describes the virtual machine running a container.
+type VMState struct {
+	// Domain is the name of the libvirt domain.
+	Domain string `json:"domain"`
+	// QemuPid is the pid of the QEMU process, 0 once it has exited.
+	QemuPid int `json:"qemuPid,omitempty"`
+	// IP is the address of the guest, empty without a network.
+	IP string `json:"ip,omitempty"`
+	// Sockets are the unix sockets of the virtual machine on the host,
+	// by name: "serial", "app", "agent", "attach" and "vnc".
+	Sockets map[string]string `json:"sockets,omitempty"`
+}
 
 type Hook interface {
 	// Run executes the hook with the provided state.
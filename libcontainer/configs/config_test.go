@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/harche/runvm/libcontainer/configs"
+	"github.com/opencontainers/runtime-spec/specs-go"
 )
 
 func TestUnmarshalHooks(t *testing.T) {
@@ -100,6 +101,69 @@ func TestMarshalUnmarshalHooks(t *testing.T) {
 	}
 }
 
+func TestMarshalUnmarshalVMHooks(t *testing.T) {
+	booted := configs.NewCommandHook(configs.Command{
+		Path: "/usr/libexec/net-up",
+		Args: []string{"net-up"},
+	})
+
+	hook := configs.Hooks{
+		GuestBooted: []configs.Hook{booted},
+	}
+	hooks, err := hook.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := `{"guestbooted":[{"path":"/usr/libexec/net-up","args":["net-up"],"env":null,"dir":"","timeout":null}],"poststart":null,"poststop":null,"prestart":null}`
+	if string(hooks) != h {
+		t.Errorf("Expected hooks %s to equal %s", string(hooks), h)
+	}
+
+	umMhook := configs.Hooks{}
+	if err := umMhook.UnmarshalJSON(hooks); err != nil {
+		t.Fatal(err)
+	}
+	if len(umMhook.GuestBooted) != 1 || !reflect.DeepEqual(umMhook.GuestBooted[0], booted) {
+		t.Errorf("Expected guestbooted hooks to be equal after mashaling -> unmarshaling them: %+v, %+v", umMhook.GuestBooted, booted)
+	}
+	if umMhook.WorkloadExited != nil {
+		t.Errorf("Expected no workloadexited hooks, got %+v", umMhook.WorkloadExited)
+	}
+}
+
+func TestHookStateMarshal(t *testing.T) {
+	state := configs.HookState{
+		State: specs.State{
+			Version: "1",
+			ID:      "1",
+			Pid:     1,
+			Bundle:  "/bundle",
+		},
+		VM: &configs.VMState{
+			Domain:  "1",
+			QemuPid: 42,
+			IP:      "10.0.0.2",
+		},
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	// The OCI state stays at the top level for existing hooks.
+	if decoded["id"] != "1" || decoded["bundle"] != "/bundle" {
+		t.Errorf("Expected the OCI state at the top level of %s", b)
+	}
+	vm, ok := decoded["vm"].(map[string]interface{})
+	if !ok || vm["domain"] != "1" || vm["qemuPid"] != float64(42) || vm["ip"] != "10.0.0.2" {
+		t.Errorf("Unexpected vm in %s", b)
+	}
+}
+
 func TestMarshalHooksWithUnexpectedType(t *testing.T) {
 	fHook := configs.NewFunctionHook(func(configs.HookState) error {
 		return nil
@@ -120,10 +184,12 @@ func TestMarshalHooksWithUnexpectedType(t *testing.T) {
 
 func TestFuncHookRun(t *testing.T) {
 	state := configs.HookState{
-		Version: "1",
-		ID:      "1",
-		Pid:     1,
-		Bundle:  "/bundle",
+		State: specs.State{
+			Version: "1",
+			ID:      "1",
+			Pid:     1,
+			Bundle:  "/bundle",
+		},
 	}
 
 	fHook := configs.NewFunctionHook(func(s configs.HookState) error {
@@ -138,10 +204,12 @@ func TestFuncHookRun(t *testing.T) {
 
 func TestCommandHookRun(t *testing.T) {
 	state := configs.HookState{
-		Version: "1",
-		ID:      "1",
-		Pid:     1,
-		Bundle:  "/bundle",
+		State: specs.State{
+			Version: "1",
+			ID:      "1",
+			Pid:     1,
+			Bundle:  "/bundle",
+		},
 	}
 	timeout := time.Second
 
@@ -161,10 +229,12 @@ func TestCommandHookRun(t *testing.T) {
 
 func TestCommandHookRunTimeout(t *testing.T) {
 	state := configs.HookState{
-		Version: "1",
-		ID:      "1",
-		Pid:     1,
-		Bundle:  "/bundle",
+		State: specs.State{
+			Version: "1",
+			ID:      "1",
+			Pid:     1,
+			Bundle:  "/bundle",
+		},
 	}
 	timeout := (10 * time.Millisecond)
 
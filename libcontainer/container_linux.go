@@ -27,6 +27,7 @@ import (
 	"github.com/harche/runvm/libcontainer/criurpc"
 	"github.com/harche/runvm/libcontainer/system"
 	"github.com/harche/runvm/libcontainer/utils"
+	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/syndtr/gocapability/capability"
 	"github.com/vishvananda/netlink/nl"
 )
@@ -278,10 +279,12 @@ func (c *linuxContainer) start(process *Process, isInit bool) error {
 
 		if c.config.Hooks != nil {
 			s := configs.HookState{
-				Version: c.config.Version,
-				ID:      c.id,
-				Pid:     parent.pid(),
-				Bundle:  utils.SearchLabels(c.config.Labels, "bundle"),
+				State: specs.State{
+					Version: c.config.Version,
+					ID:      c.id,
+					Pid:     parent.pid(),
+					Bundle:  utils.SearchLabels(c.config.Labels, "bundle"),
+				},
 			}
 			for i, hook := range c.config.Hooks.Poststart {
 				if err := hook.Run(s); err != nil {
@@ -1255,10 +1258,12 @@ func (c *linuxContainer) criuNotifications(resp *criurpc.CriuResp, process *Proc
 	case notify.GetScript() == "setup-namespaces":
 		if c.config.Hooks != nil {
 			s := configs.HookState{
-				Version: c.config.Version,
-				ID:      c.id,
-				Pid:     int(notify.GetPid()),
-				Bundle:  utils.SearchLabels(c.config.Labels, "bundle"),
+				State: specs.State{
+					Version: c.config.Version,
+					ID:      c.id,
+					Pid:     int(notify.GetPid()),
+					Bundle:  utils.SearchLabels(c.config.Labels, "bundle"),
+				},
 			}
 			for i, hook := range c.config.Hooks.Prestart {
 				if err := hook.Run(s); err != nil {
@@ -0,0 +1,128 @@
+// +build linux
+
+package libcontainer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultLockTimeout is how long a runvm process waits for the lock of a
+// container held by another one.
+const DefaultLockTimeout = 30 * time.Second
+
+// containerLocks are the locks of containers this process holds, by the
+// directory of the container. They are counted, so that code holding a
+// lock can call code that takes it again.
+var containerLocks = struct {
+	sync.Mutex
+	held map[string]*heldLock
+}{held: make(map[string]*heldLock)}
+
+type heldLock struct {
+	f     *os.File
+	count int
+}
+
+// LockTimeout returns an option func to configure how long a LinuxFactory
+// waits for the lock of a container.
+func LockTimeout(timeout time.Duration) func(*LinuxFactory) error {
+	return func(l *LinuxFactory) error {
+		l.LockTimeout = timeout
+		return nil
+	}
+}
+
+// flock takes the flock how on the directory dir, retrying until timeout.
+func flock(dir string, how int, timeout time.Duration) (*os.File, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	delay := 10 * time.Millisecond
+	for {
+		err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB)
+		if err == nil {
+			return f, nil
+		}
+		if err != unix.EWOULDBLOCK || time.Now().After(deadline) {
+			f.Close()
+			return nil, err
+		}
+		time.Sleep(delay)
+		if delay < 100*time.Millisecond {
+			delay *= 2
+		}
+	}
+}
+
+func lockError(id string, err error, timeout time.Duration) error {
+	switch {
+	case os.IsNotExist(err):
+		return newGenericError(fmt.Errorf("container %q does not exist", id), ContainerNotExists)
+	case err == unix.EWOULDBLOCK:
+		return newGenericError(fmt.Errorf("container %q is locked by another runvm process, gave up after %s", id, timeout), ContainerLocked)
+	default:
+		return newGenericError(err, SystemError)
+	}
+}
+
+// Lock takes the lock of the container id, so that no other runvm process
+// changes or loads it until Unlock is called.
+func (l *LinuxFactory) Lock(id string) error {
+	if err := l.validateID(id); err != nil {
+		return err
+	}
+	dir := filepath.Join(l.Root, id)
+	containerLocks.Lock()
+	defer containerLocks.Unlock()
+	if held, ok := containerLocks.held[dir]; ok {
+		held.count++
+		return nil
+	}
+	f, err := flock(dir, unix.LOCK_EX, l.LockTimeout)
+	if err != nil {
+		return lockError(id, err, l.LockTimeout)
+	}
+	containerLocks.held[dir] = &heldLock{f: f, count: 1}
+	return nil
+}
+
+// Unlock releases the lock of the container id taken by Lock.
+func (l *LinuxFactory) Unlock(id string) error {
+	dir := filepath.Join(l.Root, id)
+	containerLocks.Lock()
+	defer containerLocks.Unlock()
+	held, ok := containerLocks.held[dir]
+	if !ok {
+		return newGenericError(fmt.Errorf("container %q is not locked", id), SystemError)
+	}
+	if held.count--; held.count > 0 {
+		return nil
+	}
+	delete(containerLocks.held, dir)
+	return held.f.Close()
+}
+
+// lockShared waits until no other runvm process holds the lock of the
+// container in dir and keeps others from taking it until the returned func
+// is called. It does nothing while this process holds the lock.
+func (l *LinuxFactory) lockShared(dir, id string) (func(), error) {
+	containerLocks.Lock()
+	_, held := containerLocks.held[dir]
+	containerLocks.Unlock()
+	if held {
+		return func() {}, nil
+	}
+	f, err := flock(dir, unix.LOCK_SH, l.LockTimeout)
+	if err != nil {
+		return nil, lockError(id, err, l.LockTimeout)
+	}
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,270 @@
+// +build linux
+
+package libcontainer
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/harche/runvm/libcontainer/configs"
+)
+
+// The lock tests run the test binary again as other runvm processes would,
+// since the locks of one process are shared by all its factories.
+const (
+	lockHelperEnv    = "LIBCONTAINER_LOCK_HELPER"
+	lockHelperRoot   = "LIBCONTAINER_LOCK_ROOT"
+	lockHelperHold   = "hold"
+	lockHelperUpdate = "update"
+	lockHelperCreate = "create"
+)
+
+// TestLockHelperProcess is run by the lock tests in a process of its own.
+// "hold" takes the lock of container 1, reports it and holds it until
+// stdin is closed. "update" increments a counter in the directory of
+// container 1 under its lock. "create" creates container 2 and reports it.
+func TestLockHelperProcess(t *testing.T) {
+	mode := os.Getenv(lockHelperEnv)
+	if mode == "" {
+		return
+	}
+	factory, err := New(os.Getenv(lockHelperRoot), Cgroupfs, LockTimeout(time.Minute))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if mode == lockHelperCreate {
+		if _, err := factory.Create("2", &configs.Config{Rootfs: os.Getenv(lockHelperRoot)}); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("created")
+		os.Exit(0)
+	}
+	if err := factory.Lock("1"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	switch mode {
+	case lockHelperHold:
+		fmt.Println("locked")
+		ioutil.ReadAll(os.Stdin)
+	case lockHelperUpdate:
+		if err := incrementCounter(filepath.Join(os.Getenv(lockHelperRoot), "1", "counter")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	factory.Unlock("1")
+	os.Exit(0)
+}
+
+// incrementCounter increments the number in path in a way that loses
+// updates when it races.
+func incrementCounter(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	time.Sleep(10 * time.Millisecond)
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(n+1)), 0600)
+}
+
+func lockHelper(root, mode string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=TestLockHelperProcess")
+	cmd.Env = append(os.Environ(), lockHelperEnv+"="+mode, lockHelperRoot+"="+root)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+func newLockTestRoot(t *testing.T) string {
+	root, err := newTestRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "1"), 0700); err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	return root
+}
+
+func expectErrorCode(t *testing.T, err error, code ErrorCode) {
+	lerr, ok := err.(Error)
+	if !ok {
+		t.Fatalf("expected a libcontainer error with code %s, got %v", code, err)
+	}
+	if lerr.Code() != code {
+		t.Fatalf("expected error code %s but received %s: %v", code, lerr.Code(), err)
+	}
+}
+
+func TestLockParallelProcesses(t *testing.T) {
+	root := newLockTestRoot(t)
+	defer os.RemoveAll(root)
+
+	const processes = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, processes)
+	for i := 0; i < processes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := lockHelper(root, lockHelperUpdate).Run(); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(root, "1", "counter"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.TrimSpace(string(data)); n != strconv.Itoa(processes) {
+		t.Fatalf("expected %d updates under the lock, got %s", processes, n)
+	}
+}
+
+func TestCreateParallelProcesses(t *testing.T) {
+	root := newLockTestRoot(t)
+	defer os.RemoveAll(root)
+
+	const processes = 8
+	var wg sync.WaitGroup
+	outputs := make(chan string, processes)
+	for i := 0; i < processes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out, _ := lockHelper(root, lockHelperCreate).Output()
+			outputs <- strings.TrimSpace(string(out))
+		}()
+	}
+	wg.Wait()
+	close(outputs)
+	created := 0
+	for out := range outputs {
+		switch {
+		case out == "created":
+			created++
+		case !strings.Contains(out, "container with id exists"):
+			t.Errorf("expected the container to be created or found to exist, got %q", out)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("expected container 2 to be created once, got %d", created)
+	}
+}
+
+func TestLockContention(t *testing.T) {
+	root := newLockTestRoot(t)
+	defer os.RemoveAll(root)
+	if err := marshal(filepath.Join(root, "1", stateFilename), &State{BaseState: BaseState{ID: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	holder := lockHelper(root, lockHelperHold)
+	stdin, err := holder.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := holder.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := holder.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Wait()
+	defer stdin.Close()
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "locked\n" {
+		t.Fatalf("lock helper: %q, %v", line, err)
+	}
+
+	factory, err := New(root, Cgroupfs, LockTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = factory.Lock("1")
+	expectErrorCode(t, err, ContainerLocked)
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Fatalf("expected Lock to wait for the lock timeout, it gave up after %s", waited)
+	}
+	_, err = factory.Load("1")
+	expectErrorCode(t, err, ContainerLocked)
+
+	stdin.Close()
+	if err := holder.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if err := factory.Lock("1"); err != nil {
+		t.Fatalf("expected the lock once released, got %v", err)
+	}
+	if err := factory.Unlock("1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockReentrant(t *testing.T) {
+	root := newLockTestRoot(t)
+	defer os.RemoveAll(root)
+	if err := marshal(filepath.Join(root, "1", stateFilename), &State{BaseState: BaseState{ID: "1", InitProcessPid: 1024}}); err != nil {
+		t.Fatal(err)
+	}
+	factory, err := New(root, Cgroupfs, LockTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := New(root, Cgroupfs, LockTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := factory.Lock("1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Lock("1"); err != nil {
+		t.Fatalf("expected the lock to be taken again by the same process, got %v", err)
+	}
+	// Loading the container while holding its lock must not wait for it.
+	if _, err := factory.Load("1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Unlock("1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := factory.Unlock("1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := factory.Unlock("1"); err == nil {
+		t.Fatal("expected an error unlocking a container that is not locked")
+	}
+}
+
+func TestLockContainerNotExists(t *testing.T) {
+	root, err := newTestRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	factory, err := New(root, Cgroupfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectErrorCode(t, factory.Lock("nocontainer"), ContainerNotExists)
+	expectErrorCode(t, factory.Lock("../escape"), InvalidIdFormat)
+}
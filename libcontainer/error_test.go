@@ -14,6 +14,7 @@ func TestErrorCode(t *testing.T) {
 		ContainerNotRunning: "Container is not running",
 		ConsoleExists:       "Console exists for process",
 		ContainerNotPaused:  "Container is not paused",
+		ContainerLocked:     "Container is locked",
 		NoProcessOps:        "No process operations",
 	}
 
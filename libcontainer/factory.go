@@ -12,7 +12,9 @@ type Factory interface {
 	// The id must not already be in use by an existing container. Containers created using
 	// a factory with the same path (and filesystem) must have distinct ids.
 	//
-	// Returns the new container with a running process.
+	// Returns the new container with a running process. The container is
+	// returned locked, as by Lock, so that no other process sees it half
+	// created; the caller releases it with Unlock.
 	//
 	// errors:
 	// IdInUse - id is already in use by a container
@@ -28,9 +30,22 @@ type Factory interface {
 	//
 	// errors:
 	// Path does not exist
+	// ContainerLocked - another process held the lock past the lock timeout
 	// System error
 	Load(id string) (Container, error)
 
+	// Lock takes the lock of the container with the given id, which
+	// serializes the processes that change it, until Unlock is called. Load
+	// waits for a lock held by another process. Locks are counted, so that
+	// a process holding one may take it again.
+	//
+	// errors:
+	// ContainerNotExists - the container does not exist
+	// ContainerLocked - another process held the lock past the lock timeout
+	// System error
+	Lock(id string) error
+	Unlock(id string) error
+
 	// StartInitialization is an internal API to libcontainer used during the reexec of the
 	// container.
 	//
@@ -10,6 +10,7 @@ import (
 	"regexp"
 	"runtime/debug"
 	"strconv"
+	"time"
 
 	"github.com/docker/docker/pkg/mount"
 	"github.com/harche/runvm/libcontainer/cgroups"
@@ -118,10 +119,11 @@ func New(root string, options ...func(*LinuxFactory) error) (Factory, error) {
 		}
 	}
 	l := &LinuxFactory{
-		Root:      root,
-		InitArgs:  []string{"/proc/self/exe", "init"},
-		Validator: validate.New(),
-		CriuPath:  "criu",
+		Root:        root,
+		InitArgs:    []string{"/proc/self/exe", "init"},
+		Validator:   validate.New(),
+		CriuPath:    "criu",
+		LockTimeout: DefaultLockTimeout,
 	}
 	Cgroupfs(l)
 	for _, opt := range options {
@@ -150,6 +152,10 @@ type LinuxFactory struct {
 
 	// NewCgroupsManager returns an initialized cgroups manager for a single container.
 	NewCgroupsManager func(config *configs.Cgroup, paths map[string]string) cgroups.Manager
+
+	// LockTimeout is how long to wait for the lock of a container held by
+	// another process.
+	LockTimeout time.Duration
 }
 
 func (l *LinuxFactory) Create(id string, config *configs.Config) (Container, error) {
@@ -171,15 +177,20 @@ func (l *LinuxFactory) Create(id string, config *configs.Config) (Container, err
 		return nil, newGenericError(err, SystemError)
 	}
 	containerRoot := filepath.Join(l.Root, id)
-	if _, err := os.Stat(containerRoot); err == nil {
-		return nil, newGenericError(fmt.Errorf("container with id exists: %v", id), IdInUse)
-	} else if !os.IsNotExist(err) {
+	// Of the processes creating the same id, only the one whose mkdir
+	// succeeds goes on, and it locks the container right away.
+	if err := os.Mkdir(containerRoot, 0711); err != nil {
+		if os.IsExist(err) {
+			return nil, newGenericError(fmt.Errorf("container with id exists: %v", id), IdInUse)
+		}
 		return nil, newGenericError(err, SystemError)
 	}
-	if err := os.MkdirAll(containerRoot, 0711); err != nil {
-		return nil, newGenericError(err, SystemError)
+	if err := l.Lock(id); err != nil {
+		return nil, err
 	}
 	if err := os.Chown(containerRoot, uid, gid); err != nil {
+		l.Unlock(id)
+		os.RemoveAll(containerRoot)
 		return nil, newGenericError(err, SystemError)
 	}
 	if config.Rootless {
@@ -201,7 +212,15 @@ func (l *LinuxFactory) Load(id string) (Container, error) {
 	if l.Root == "" {
 		return nil, newGenericError(fmt.Errorf("invalid root"), ConfigInvalid)
 	}
+	if err := l.validateID(id); err != nil {
+		return nil, err
+	}
 	containerRoot := filepath.Join(l.Root, id)
+	unlock, err := l.lockShared(containerRoot, id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	state, err := l.loadState(containerRoot, id)
 	if err != nil {
 		return nil, err
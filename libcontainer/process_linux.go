@@ -17,6 +17,7 @@ import (
 	"github.com/harche/runvm/libcontainer/configs"
 	"github.com/harche/runvm/libcontainer/system"
 	"github.com/harche/runvm/libcontainer/utils"
+	"github.com/opencontainers/runtime-spec/specs-go"
 
 	"golang.org/x/sys/unix"
 )
@@ -296,10 +297,12 @@ func (p *initProcess) start() error {
 
 				if p.config.Config.Hooks != nil {
 					s := configs.HookState{
-						Version: p.container.config.Version,
-						ID:      p.container.id,
-						Pid:     p.pid(),
-						Bundle:  utils.SearchLabels(p.config.Config.Labels, "bundle"),
+						State: specs.State{
+							Version: p.container.config.Version,
+							ID:      p.container.id,
+							Pid:     p.pid(),
+							Bundle:  utils.SearchLabels(p.config.Config.Labels, "bundle"),
+						},
 					}
 					for i, hook := range p.config.Config.Hooks.Prestart {
 						if err := hook.Run(s); err != nil {
@@ -320,10 +323,12 @@ func (p *initProcess) start() error {
 			}
 			if p.config.Config.Hooks != nil {
 				s := configs.HookState{
-					Version: p.container.config.Version,
-					ID:      p.container.id,
-					Pid:     p.pid(),
-					Bundle:  utils.SearchLabels(p.config.Config.Labels, "bundle"),
+					State: specs.State{
+						Version: p.container.config.Version,
+						ID:      p.container.id,
+						Pid:     p.pid(),
+						Bundle:  utils.SearchLabels(p.config.Config.Labels, "bundle"),
+					},
 				}
 				for i, hook := range p.config.Config.Hooks.Prestart {
 					if err := hook.Run(s); err != nil {
@@ -5,6 +5,7 @@
 package specconv
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -242,7 +243,9 @@ func CreateLibcontainerConfig(opts *CreateOpts) (*configs.Config, error) {
 			Ambient:     spec.Process.Capabilities.Ambient,
 		}
 	}
-	createHooks(spec, config)
+	if err := createHooks(spec, config); err != nil {
+		return nil, err
+	}
 	config.MountLabel = spec.Linux.MountLabel
 	config.Version = specs.Version
 	return config, nil
@@ -773,7 +776,12 @@ func setupSeccomp(config *specs.LinuxSeccomp) (*configs.Seccomp, error) {
 	return newConfig, nil
 }
 
-func createHooks(rspec *specs.Spec, config *configs.Config) {
+// VMHooksAnnotation is the OCI annotation listing the hooks run at points
+// in the life of the virtual machine of a container, which the spec has no
+// field for, as in {"guestbooted": [<hook>...], "workloadexited": [...]}.
+const VMHooksAnnotation = "io.runvm.hooks"
+
+func createHooks(rspec *specs.Spec, config *configs.Config) error {
 	config.Hooks = &configs.Hooks{}
 	if rspec.Hooks != nil {
 
@@ -790,6 +798,24 @@ func createHooks(rspec *specs.Spec, config *configs.Config) {
 			config.Hooks.Poststop = append(config.Hooks.Poststop, configs.NewCommandHook(cmd))
 		}
 	}
+	if v, ok := rspec.Annotations[VMHooksAnnotation]; ok {
+		var vmHooks struct {
+			GuestBooted    []specs.Hook `json:"guestbooted"`
+			WorkloadExited []specs.Hook `json:"workloadexited"`
+		}
+		if err := json.Unmarshal([]byte(v), &vmHooks); err != nil {
+			return fmt.Errorf("invalid %s annotation: %v", VMHooksAnnotation, err)
+		}
+		for _, h := range vmHooks.GuestBooted {
+			cmd := createCommandHook(h)
+			config.Hooks.GuestBooted = append(config.Hooks.GuestBooted, configs.NewCommandHook(cmd))
+		}
+		for _, h := range vmHooks.WorkloadExited {
+			cmd := createCommandHook(h)
+			config.Hooks.WorkloadExited = append(config.Hooks.WorkloadExited, configs.NewCommandHook(cmd))
+		}
+	}
+	return nil
 }
 
 func createCommandHook(h specs.Hook) configs.Command {
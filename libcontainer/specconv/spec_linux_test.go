@@ -4,7 +4,9 @@ package specconv
 
 import (
 	"testing"
+	"time"
 
+	"github.com/harche/runvm/libcontainer/configs"
 	"github.com/harche/runvm/libcontainer/configs/validate"
 	"github.com/opencontainers/runtime-spec/specs-go"
 )
@@ -118,3 +120,27 @@ func TestRootlessSpecconvValidate(t *testing.T) {
 		t.Errorf("Expected specconv to produce valid rootless container config: %v", err)
 	}
 }
+
+func TestVMHooksAnnotation(t *testing.T) {
+	spec := &specs.Spec{
+		Annotations: map[string]string{
+			VMHooksAnnotation: `{"guestbooted": [{"path": "/bin/net-up", "args": ["net-up", "eth0"], "timeout": 5}], "workloadexited": [{"path": "/bin/collect"}]}`,
+		},
+	}
+	config := &configs.Config{}
+	if err := createHooks(spec, config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Hooks.GuestBooted) != 1 || len(config.Hooks.WorkloadExited) != 1 {
+		t.Fatalf("expected one guestbooted and one workloadexited hook, got %+v", config.Hooks)
+	}
+	cmd := config.Hooks.GuestBooted[0].(configs.CommandHook)
+	if cmd.Path != "/bin/net-up" || cmd.Timeout == nil || *cmd.Timeout != 5*time.Second {
+		t.Errorf("unexpected guestbooted hook %+v", cmd)
+	}
+
+	spec.Annotations[VMHooksAnnotation] = "[]"
+	if err := createHooks(spec, config); err == nil {
+		t.Error("expected an error for an invalid annotation")
+	}
+}
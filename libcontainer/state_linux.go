@@ -11,6 +11,7 @@ import (
 	"github.com/harche/runvm/libcontainer/configs"
 	"github.com/harche/runvm/libcontainer/utils"
 	"github.com/harche/runvm/hypervisor"
+	"github.com/opencontainers/runtime-spec/specs-go"
 
 	"golang.org/x/sys/unix"
 )
@@ -45,33 +46,41 @@ func destroy(c *linuxContainer) error {
 			logrus.Warn(err)
 		}
 	}
-	err := c.cgroupManager.Destroy()
+	//ISOLATED
+	hyperVisor, err := hypervisor.HypFactory(filepath.Dir(c.root))
+	if err != nil {
+		return err
+	}
+	// The state dir of the virtual machine is below the root of the
+	// container, so what the poststop hooks learn about it is read first.
+	vm, _ := hyperVisor.VMState(c.ID())
+	// QEMU runs from the state dir and in the cgroups of the container,
+	// both of which are only removed once the virtual machine is gone.
+	if err := hyperVisor.DestroyVM(c.ID()); err != nil {
+		return err
+	}
+
+	err = c.cgroupManager.Destroy()
 	if rerr := os.RemoveAll(c.root); err == nil {
 		err = rerr
 	}
 	c.initProcess = nil
-	if herr := runPoststopHooks(c); err == nil {
-		err = herr
+	if perr := runPoststopHooks(c, vm); err == nil {
+		err = perr
 	}
 	c.state = &stoppedState{c: c}
-
-	//ISOLATED
-	hyperVisor, err := hypervisor.HypFactory()
-	virtualMachine, err := hyperVisor.GetVM(c.ID())
-	if err == nil {
-		virtualMachine.Kill()
-		virtualMachine.Remove()
-	}
-
 	return err
 }
 
-func runPoststopHooks(c *linuxContainer) error {
+func runPoststopHooks(c *linuxContainer, vm *configs.VMState) error {
 	if c.config.Hooks != nil {
 		s := configs.HookState{
-			Version: c.config.Version,
-			ID:      c.id,
-			Bundle:  utils.SearchLabels(c.config.Labels, "bundle"),
+			State: specs.State{
+				Version: c.config.Version,
+				ID:      c.id,
+				Bundle:  utils.SearchLabels(c.config.Labels, "bundle"),
+			},
+			VM: vm,
 		}
 		for _, hook := range c.config.Hooks.Poststop {
 			if err := hook.Run(s); err != nil {
@@ -7,12 +7,14 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"syscall"
 	"text/tabwriter"
 	"time"
 
 	"encoding/json"
 
+	"github.com/harche/runvm/hypervisor"
 	"github.com/harche/runvm/libcontainer"
 	"github.com/harche/runvm/libcontainer/user"
 	"github.com/harche/runvm/libcontainer/utils"
@@ -42,6 +44,12 @@ type containerState struct {
 	Annotations map[string]string `json:"annotations,omitempty"`
 	// The owner of the state directory (the owner of the container).
 	Owner string `json:"owner"`
+	// Restarts are the restarts of the virtual machine by its restart
+	// policy.
+	Restarts []hypervisor.Restart `json:"restarts,omitempty"`
+	// Display is where the display of the virtual machine is served, if
+	// guests have one.
+	Display *hypervisor.Display `json:"display,omitempty"`
 }
 
 var listCommand = cli.Command{
@@ -58,7 +66,10 @@ To list containers created via the default "--root":
 
 EXAMPLE 2:
 To list containers created using a non-default value for "--root":
-       # runvm --root value list`,
+       # runvm --root value list
+
+What is left of virtual machines that no container owns is reported on
+standard error, see the gc command.`,
 	Flags: []cli.Flag{
 		cli.StringFlag{
 			Name:  "format, f",
@@ -74,10 +85,13 @@ To list containers created using a non-default value for "--root":
 		if err := checkArgs(context, 0, exactArgs); err != nil {
 			return err
 		}
-		s, err := getContainers(context)
+		s, unloaded, err := loadContainers(context)
 		if err != nil {
 			return err
 		}
+		if len(unloaded) == 0 {
+			reportOrphans(context, s)
+		}
 
 		if context.Bool("quiet") {
 			for _, item := range s {
@@ -114,43 +128,60 @@ To list containers created using a non-default value for "--root":
 }
 
 func getContainers(context *cli.Context) ([]containerState, error) {
+	s, _, err := loadContainers(context)
+	return s, err
+}
+
+// loadContainers returns the state of the containers under the root, and
+// the ids of those whose state could not be read, which are reported and
+// left out. Directories without a state file are not containers.
+func loadContainers(context *cli.Context) ([]containerState, []string, error) {
 	factory, err := loadFactory(context)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	root := context.GlobalString("root")
 	absRoot, err := filepath.Abs(root)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	list, err := ioutil.ReadDir(absRoot)
 	if err != nil {
 		fatal(err)
 	}
 
-	var s []containerState
+	var (
+		s        []containerState
+		unloaded []string
+	)
 	for _, item := range list {
-		if item.IsDir() {
+		if item.IsDir() && item.Name() != hypervisor.PoolDir {
 			// This cast is safe on Linux.
 			stat := item.Sys().(*syscall.Stat_t)
 			owner, err := user.LookupUid(int(stat.Uid))
 			if err != nil {
-				owner.Name = string(stat.Uid)
+				owner.Name = strconv.FormatUint(uint64(stat.Uid), 10)
 			}
 
 			container, err := factory.Load(item.Name())
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "load container %s: %v\n", item.Name(), err)
+				// Directories without a state are no container.
+				if lerr, ok := err.(libcontainer.Error); !ok || lerr.Code() != libcontainer.ContainerNotExists {
+					unloaded = append(unloaded, item.Name())
+				}
 				continue
 			}
 			containerStatus, err := container.Status()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "status for %s: %v\n", item.Name(), err)
+				unloaded = append(unloaded, item.Name())
 				continue
 			}
 			state, err := container.State()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "state for %s: %v\n", item.Name(), err)
+				unloaded = append(unloaded, item.Name())
 				continue
 			}
 			pid := state.BaseState.InitProcessPid
@@ -171,5 +202,5 @@ func getContainers(context *cli.Context) ([]containerState, error) {
 			})
 		}
 	}
-	return s, nil
+	return s, unloaded, nil
 }
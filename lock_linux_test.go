@@ -0,0 +1,157 @@
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/harche/runvm/libcontainer"
+	"github.com/harche/runvm/libcontainer/configs"
+	"github.com/harche/runvm/libcontainer/system"
+)
+
+// runvmTestMain makes the test binary run as runvm, so that the tests run
+// runvm commands in processes of their own.
+const runvmTestMain = "RUNVM_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runvmTestMain) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func runvmCommand(root string, args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], append([]string{"--root", root}, args...)...)
+	cmd.Env = append(os.Environ(), runvmTestMain+"=1")
+	return cmd
+}
+
+// runningContainer writes the state of container id running a sleep, as
+// runvm create leaves it. The returned channel is closed once the sleep
+// was killed.
+func runningContainer(t *testing.T, root, id string) <-chan struct{} {
+	sleep := exec.Command("sleep", "60")
+	if err := sleep.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		sleep.Wait()
+		close(exited)
+	}()
+	start, err := system.GetProcessStartTime(sleep.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := libcontainer.State{
+		BaseState: libcontainer.BaseState{
+			ID:                   id,
+			InitProcessPid:       sleep.Process.Pid,
+			InitProcessStartTime: start,
+			Config: configs.Config{
+				Rootfs:  "/",
+				Cgroups: &configs.Cgroup{Name: id, Resources: &configs.Resources{}},
+			},
+		},
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, id), 0711); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, id, "state.json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return exited
+}
+
+func TestKillDeleteParallel(t *testing.T) {
+	root, err := ioutil.TempDir("", "runvm-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for i := 0; i < 5; i++ {
+		exited := runningContainer(t, root, "c1")
+		commands := [][]string{{"kill", "c1", "KILL"}, {"delete", "--force", "c1"}, {"kill", "c1", "KILL"}, {"delete", "--force", "c1"}}
+		outputs := make([]string, len(commands))
+		errs := make([]error, len(commands))
+		var wg sync.WaitGroup
+		for j, args := range commands {
+			wg.Add(1)
+			go func(j int, args []string) {
+				defer wg.Done()
+				out, err := runvmCommand(root, args...).CombinedOutput()
+				outputs[j], errs[j] = string(out), err
+			}(j, args)
+		}
+		wg.Wait()
+
+		// Deletes succeed whatever came first, kills either signal the
+		// container or find it stopped or gone.
+		for j, args := range commands {
+			if errs[j] == nil {
+				continue
+			}
+			if args[0] == "delete" || !strings.Contains(outputs[j], "does not exist") && !strings.Contains(outputs[j], "process already finished") {
+				t.Errorf("runvm %s: %v: %s", strings.Join(args, " "), errs[j], outputs[j])
+			}
+		}
+		if _, err := os.Stat(filepath.Join(root, "c1")); !os.IsNotExist(err) {
+			t.Fatalf("Expected the container to be deleted, got %v", err)
+		}
+		select {
+		case <-exited:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Expected the init process of the container to be killed")
+		}
+	}
+}
+
+func TestDeleteWaitsForLock(t *testing.T) {
+	root, err := ioutil.TempDir("", "runvm-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	runningContainer(t, root, "c1")
+
+	// A runvm process holding the lock, such as a create under way, keeps
+	// delete from removing the container.
+	factory, err := libcontainer.New(root, libcontainer.Cgroupfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := factory.Lock("c1"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runvmCommand(root, "--lock-timeout", "100ms", "delete", "--force", "c1").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "locked by another runvm process") {
+		t.Errorf("Expected delete to give up on the locked container, got %v: %s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(root, "c1", "state.json")); err != nil {
+		t.Fatalf("Expected the locked container to be kept: %v", err)
+	}
+	if err := factory.Unlock("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runvmCommand(root, "delete", "--force", "c1").CombinedOutput(); err != nil {
+		t.Fatalf("Expected delete to succeed once the lock is released, got %v: %s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(root, "c1")); !os.IsNotExist(err) {
+		t.Errorf("Expected the container to be deleted, got %v", err)
+	}
+}
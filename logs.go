@@ -0,0 +1,130 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/harche/runvm/hypervisor"
+	"github.com/urfave/cli"
+)
+
+var logsCommand = cli.Command{
+	Name:  "logs",
+	Usage: "print the console output of a virtual machine",
+	ArgsUsage: `<container-id>
+
+Where "<container-id>" is the name for the instance of the container.
+
+Console logging must be enabled with "ConsoleLog" in the hypervisor
+configuration.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "follow, f",
+			Usage: "keep printing output as it is written until the container is deleted",
+		},
+		cli.BoolFlag{
+			Name:  "serial",
+			Usage: "print the serial console (kernel and cloud-init output) instead of the workload output",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if err := checkArgs(context, 1, exactArgs); err != nil {
+			return err
+		}
+		root, err := filepath.Abs(context.GlobalString("root"))
+		if err != nil {
+			return err
+		}
+		id := context.Args().First()
+		if _, err := os.Stat(filepath.Join(root, id)); err != nil {
+			return fmt.Errorf("container %s does not exist", id)
+		}
+		name := hypervisor.AppConsole
+		if context.Bool("serial") {
+			name = hypervisor.SerialConsole
+		}
+		path := hypervisor.ConsoleLogPath(hypervisor.StateDir(root, id), name)
+		files := hypervisor.ConsoleLogFiles(path)
+		for _, file := range files {
+			if err := copyFile(os.Stdout, file); err != nil {
+				return err
+			}
+		}
+		if !context.Bool("follow") {
+			return nil
+		}
+		return followLog(os.Stdout, path)
+	},
+}
+
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// followLog prints data appended to the log file at path, starting at its
+// current end. It reopens the file when it is rotated and returns once the
+// file is removed together with the container.
+func followLog(w io.Writer, path string) error {
+	var (
+		f      *os.File
+		offset int64
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	if fi, err := os.Stat(path); err == nil {
+		offset = fi.Size()
+	}
+	for {
+		if f == nil {
+			var err error
+			if f, err = os.Open(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if f != nil {
+				if _, err := f.Seek(offset, io.SeekStart); err != nil {
+					return err
+				}
+			}
+		}
+		if f != nil {
+			if _, err := io.Copy(w, f); err != nil {
+				return err
+			}
+			// A rotation renames the file away and creates a new one.
+			cur, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			latest, err := os.Stat(path)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if latest == nil || !os.SameFile(cur, latest) {
+				// Drain what was written before the rotation.
+				if _, err := io.Copy(w, f); err != nil {
+					return err
+				}
+				f.Close()
+				f, offset = nil, 0
+			}
+		}
+		if _, err := os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
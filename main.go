@@ -7,6 +7,8 @@ import (
 	"strings"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/harche/runvm/hypervisor"
+	"github.com/harche/runvm/libcontainer"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/urfave/cli"
 )
@@ -66,21 +68,41 @@ func main() {
 			Value: "criu",
 			Usage: "path to the criu binary used for checkpoint and restore",
 		},
+		cli.StringFlag{
+			Name:  "hypervisor-config",
+			Usage: "path to a hypervisor configuration file layered over " + hypervisor.SystemConfigFile,
+		},
+		cli.DurationFlag{
+			Name:  "lock-timeout",
+			Value: libcontainer.DefaultLockTimeout,
+			Usage: "how long to wait for a container another runvm process is changing",
+		},
 		cli.BoolFlag{
 			Name:  "systemd-cgroup",
 			Usage: "enable systemd cgroup support, expects cgroupsPath to be of form \"slice:prefix:name\" for e.g. \"system.slice:runc:434234\"",
 		},
 	}
 	app.Commands = []cli.Command{
+		attachCommand,
+		checkCommand,
 		checkpointCommand,
+		configCommand,
+		cpCommand,
 		createCommand,
 		deleteCommand,
+		dumpCommand,
 		eventsCommand,
 		execCommand,
+		gcCommand,
 		initCommand,
 		killCommand,
 		listCommand,
+		logsCommand,
+		metricsServerCommand,
+		monitorCommand,
 		pauseCommand,
+		poolCommand,
+		portForwardCommand,
 		psCommand,
 		restoreCommand,
 		resumeCommand,
@@ -88,6 +110,7 @@ func main() {
 		specCommand,
 		startCommand,
 		stateCommand,
+		templateCommand,
 		updateCommand,
 	}
 	app.Before = func(context *cli.Context) error {
@@ -109,6 +132,7 @@ func main() {
 		default:
 			return fmt.Errorf("unknown log-format %q", context.GlobalString("log-format"))
 		}
+		hypervisor.SetConfigFile(context.GlobalString("hypervisor-config"))
 		return nil
 	}
 	// If the command returns an error, cli takes upon itself to print
@@ -0,0 +1,292 @@
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/harche/runvm/hypervisor"
+	"github.com/harche/runvm/libcontainer"
+	"github.com/urfave/cli"
+	"golang.org/x/sys/unix"
+)
+
+var metricsServerCommand = cli.Command{
+	Name:  "metrics-server",
+	Usage: "serve the statistics of all containers to Prometheus",
+	ArgsUsage: `
+
+Where the containers are those under the given root, specified via the global
+option "--root".
+
+EXAMPLE:
+To serve the metrics on port 9200 of all host addresses:
+
+       # runvm metrics-server --listen :9200`,
+	Description: `The metrics-server command serves the cgroup, network and virtual machine
+statistics of every container on /metrics, in the Prometheus text format, until
+it is interrupted. The statistics are gathered when they are scraped and are
+labelled with the id and bundle of their container.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "listen",
+			Usage: "where to serve the metrics: unix:///path/to/socket or [host]:port",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if err := checkArgs(context, 0, exactArgs); err != nil {
+			return err
+		}
+		l, err := metricsListener(context.String("listen"))
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		hyperVisor, err := loadHypervisor(context)
+		if err != nil {
+			return err
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			var buf bytes.Buffer
+			if _, err := collectMetrics(context, hyperVisor).WriteTo(&buf); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+			w.Write(buf.Bytes())
+		})
+		served := make(chan error, 1)
+		go func() {
+			served <- http.Serve(l, mux)
+		}()
+		s := make(chan os.Signal, 1)
+		signal.Notify(s, unix.SIGINT, unix.SIGTERM)
+		select {
+		case <-s:
+			return nil
+		case err := <-served:
+			return err
+		}
+	},
+}
+
+// metricsListener listens on addr, unix:///path/to/socket or [host]:port.
+func metricsListener(addr string) (net.Listener, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("--listen is required")
+	}
+	if strings.HasPrefix(addr, "unix://") {
+		return net.Listen("unix", strings.TrimPrefix(addr, "unix://"))
+	}
+	return net.Listen("tcp", addr)
+}
+
+// metricSample is a value of a metric with its label names and values.
+type metricSample struct {
+	labels []string
+	value  float64
+}
+
+// metricFamily is a metric with all its samples, which the text format
+// wants together.
+type metricFamily struct {
+	name    string
+	typ     string
+	help    string
+	samples []metricSample
+}
+
+// metrics are the metric families of a scrape, in the order they were
+// first added.
+type metrics struct {
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+func newMetrics() *metrics {
+	return &metrics{byName: make(map[string]*metricFamily)}
+}
+
+// add adds a sample of the metric name, of type typ ("gauge" or "counter"),
+// labelled with the pairs of label names and values in labels.
+func (m *metrics) add(name, typ, help string, value float64, labels ...string) {
+	f, ok := m.byName[name]
+	if !ok {
+		f = &metricFamily{name: name, typ: typ, help: help}
+		m.byName[name] = f
+		m.families = append(m.families, f)
+	}
+	f.samples = append(f.samples, metricSample{labels: labels, value: value})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WriteTo writes m in the Prometheus text format.
+func (m *metrics) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	for _, f := range m.families {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, s := range f.samples {
+			buf.WriteString(f.name)
+			if len(s.labels) > 0 {
+				buf.WriteByte('{')
+				for i := 0; i+1 < len(s.labels); i += 2 {
+					if i > 0 {
+						buf.WriteByte(',')
+					}
+					fmt.Fprintf(&buf, "%s=\"%s\"", s.labels[i], labelEscaper.Replace(s.labels[i+1]))
+				}
+				buf.WriteByte('}')
+			}
+			fmt.Fprintf(&buf, " %s\n", strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+	return buf.WriteTo(w)
+}
+
+// labels returns the label pairs of a sample of the container item, its id
+// and bundle followed by extra.
+func labels(item containerState, extra ...string) []string {
+	return append([]string{"id", item.ID, "bundle", item.Bundle}, extra...)
+}
+
+// collectMetrics gathers the statistics of the containers under the root.
+// Containers whose statistics cannot be read are logged and skipped.
+func collectMetrics(context *cli.Context, h hypervisor.Hypervisor) *metrics {
+	m := newMetrics()
+	s, err := getContainers(context)
+	if err != nil {
+		logrus.Errorf("listing containers: %v", err)
+		return m
+	}
+	factory, err := loadFactory(context)
+	if err != nil {
+		logrus.Errorf("loading containers: %v", err)
+		return m
+	}
+	for _, item := range s {
+		m.add("runvm_container_info", "gauge", "Container status, always 1.", 1, labels(item, "status", item.Status)...)
+		if item.Status == libcontainer.Stopped.String() {
+			continue
+		}
+		container, err := factory.Load(item.ID)
+		if err != nil {
+			logrus.Warnf("load container %s: %v", item.ID, err)
+			continue
+		}
+		if ls, err := container.Stats(); err != nil {
+			logrus.Warnf("stats of %s: %v", item.ID, err)
+		} else {
+			addContainerMetrics(m, item, ls)
+		}
+		if ds, err := h.DomainStats(item.ID); err != nil {
+			logrus.Warnf("domain stats of %s: %v", item.ID, err)
+		} else {
+			addDomainMetrics(m, item, ds)
+		}
+		if restarts, err := h.Restarts(item.ID); err == nil {
+			m.add("runvm_vm_restarts_total", "counter", "Restarts of the virtual machine by its restart policy.", float64(len(restarts)), labels(item)...)
+		}
+	}
+	return m
+}
+
+const nanosecondsPerSecond = 1e9
+
+// addContainerMetrics adds the cgroup and network interface statistics of
+// the container item.
+func addContainerMetrics(m *metrics, item containerState, ls *libcontainer.Stats) {
+	if cg := ls.CgroupStats; cg != nil {
+		cpu := cg.CpuStats
+		m.add("runvm_container_cpu_usage_seconds_total", "counter", "CPU time used by the container.", float64(cpu.CpuUsage.TotalUsage)/nanosecondsPerSecond, labels(item)...)
+		m.add("runvm_container_cpu_user_seconds_total", "counter", "CPU time used by the container in user mode.", float64(cpu.CpuUsage.UsageInUsermode)/nanosecondsPerSecond, labels(item)...)
+		m.add("runvm_container_cpu_kernel_seconds_total", "counter", "CPU time used by the container in kernel mode.", float64(cpu.CpuUsage.UsageInKernelmode)/nanosecondsPerSecond, labels(item)...)
+		for i, usage := range cpu.CpuUsage.PercpuUsage {
+			m.add("runvm_container_cpu_usage_per_cpu_seconds_total", "counter", "CPU time used by the container on each CPU.", float64(usage)/nanosecondsPerSecond, labels(item, "cpu", strconv.Itoa(i))...)
+		}
+		m.add("runvm_container_cpu_throttling_periods_total", "counter", "Enforcement periods of the CPU quota of the container.", float64(cpu.ThrottlingData.Periods), labels(item)...)
+		m.add("runvm_container_cpu_throttled_periods_total", "counter", "Enforcement periods in which the container was throttled.", float64(cpu.ThrottlingData.ThrottledPeriods), labels(item)...)
+		m.add("runvm_container_cpu_throttled_seconds_total", "counter", "Time the container was throttled for.", float64(cpu.ThrottlingData.ThrottledTime)/nanosecondsPerSecond, labels(item)...)
+
+		memory := cg.MemoryStats
+		m.add("runvm_container_memory_usage_bytes", "gauge", "Memory used by the container.", float64(memory.Usage.Usage), labels(item)...)
+		m.add("runvm_container_memory_max_usage_bytes", "gauge", "Most memory ever used by the container.", float64(memory.Usage.MaxUsage), labels(item)...)
+		m.add("runvm_container_memory_limit_bytes", "gauge", "Memory limit of the container.", float64(memory.Usage.Limit), labels(item)...)
+		m.add("runvm_container_memory_failcnt_total", "counter", "Times the container hit its memory limit.", float64(memory.Usage.Failcnt), labels(item)...)
+		m.add("runvm_container_memory_cache_bytes", "gauge", "Page cache of the container.", float64(memory.Cache), labels(item)...)
+		m.add("runvm_container_memory_swap_usage_bytes", "gauge", "Memory and swap used by the container.", float64(memory.SwapUsage.Usage), labels(item)...)
+		m.add("runvm_container_memory_kernel_usage_bytes", "gauge", "Kernel memory used by the container.", float64(memory.KernelUsage.Usage), labels(item)...)
+
+		m.add("runvm_container_pids_current", "gauge", "Processes in the container.", float64(cg.PidsStats.Current), labels(item)...)
+		m.add("runvm_container_pids_limit", "gauge", "Process limit of the container, 0 if unlimited.", float64(cg.PidsStats.Limit), labels(item)...)
+
+		for _, e := range cg.BlkioStats.IoServiceBytesRecursive {
+			m.add("runvm_container_blkio_service_bytes_total", "counter", "Bytes transferred to and from block devices.", float64(e.Value), labels(item, "device", fmt.Sprintf("%d:%d", e.Major, e.Minor), "op", e.Op)...)
+		}
+		for _, e := range cg.BlkioStats.IoServicedRecursive {
+			m.add("runvm_container_blkio_serviced_total", "counter", "I/O operations on block devices.", float64(e.Value), labels(item, "device", fmt.Sprintf("%d:%d", e.Major, e.Minor), "op", e.Op)...)
+		}
+
+		pageSizes := make([]string, 0, len(cg.HugetlbStats))
+		for pageSize := range cg.HugetlbStats {
+			pageSizes = append(pageSizes, pageSize)
+		}
+		sort.Strings(pageSizes)
+		for _, pageSize := range pageSizes {
+			hugetlb := cg.HugetlbStats[pageSize]
+			m.add("runvm_container_hugetlb_usage_bytes", "gauge", "Huge pages used by the container.", float64(hugetlb.Usage), labels(item, "pagesize", pageSize)...)
+			m.add("runvm_container_hugetlb_failcnt_total", "counter", "Times the container hit its huge page limit.", float64(hugetlb.Failcnt), labels(item, "pagesize", pageSize)...)
+		}
+	}
+
+	for _, iface := range ls.Interfaces {
+		l := labels(item, "interface", iface.Name)
+		m.add("runvm_container_network_receive_bytes_total", "counter", "Bytes received by the network interface.", float64(iface.RxBytes), l...)
+		m.add("runvm_container_network_receive_packets_total", "counter", "Packets received by the network interface.", float64(iface.RxPackets), l...)
+		m.add("runvm_container_network_receive_errors_total", "counter", "Receive errors of the network interface.", float64(iface.RxErrors), l...)
+		m.add("runvm_container_network_receive_dropped_total", "counter", "Received packets dropped by the network interface.", float64(iface.RxDropped), l...)
+		m.add("runvm_container_network_transmit_bytes_total", "counter", "Bytes sent by the network interface.", float64(iface.TxBytes), l...)
+		m.add("runvm_container_network_transmit_packets_total", "counter", "Packets sent by the network interface.", float64(iface.TxPackets), l...)
+		m.add("runvm_container_network_transmit_errors_total", "counter", "Transmit errors of the network interface.", float64(iface.TxErrors), l...)
+		m.add("runvm_container_network_transmit_dropped_total", "counter", "Sent packets dropped by the network interface.", float64(iface.TxDropped), l...)
+	}
+}
+
+// addDomainMetrics adds the libvirt statistics of the virtual machine of
+// the container item.
+func addDomainMetrics(m *metrics, item containerState, ds *hypervisor.DomainStats) {
+	m.add("runvm_vm_state", "gauge", "State of the libvirt domain, always 1.", 1, labels(item, "state", ds.State)...)
+	m.add("runvm_vm_vcpus", "gauge", "Virtual CPUs of the virtual machine.", float64(ds.VCpus), labels(item)...)
+	m.add("runvm_vm_cpu_seconds_total", "counter", "CPU time used by the virtual machine.", float64(ds.CpuTime)/nanosecondsPerSecond, labels(item)...)
+	m.add("runvm_vm_memory_max_bytes", "gauge", "Boot memory of the virtual machine.", float64(ds.MaxMem), labels(item)...)
+	m.add("runvm_vm_memory_bytes", "gauge", "Memory of the virtual machine.", float64(ds.Memory), labels(item)...)
+	if b := ds.Balloon; b != nil {
+		m.add("runvm_vm_balloon_actual_bytes", "gauge", "Memory the balloon leaves to the guest.", float64(b.Actual), labels(item)...)
+		m.add("runvm_vm_balloon_unused_bytes", "gauge", "Memory unused by the guest.", float64(b.Unused), labels(item)...)
+		m.add("runvm_vm_balloon_available_bytes", "gauge", "Memory available to the guest.", float64(b.Available), labels(item)...)
+		m.add("runvm_vm_balloon_usable_bytes", "gauge", "Memory the guest can use without swapping.", float64(b.Usable), labels(item)...)
+		m.add("runvm_vm_rss_bytes", "gauge", "Host memory used by QEMU.", float64(b.Rss), labels(item)...)
+		m.add("runvm_vm_swap_in_bytes_total", "counter", "Memory swapped in by the guest.", float64(b.SwapIn), labels(item)...)
+		m.add("runvm_vm_swap_out_bytes_total", "counter", "Memory swapped out by the guest.", float64(b.SwapOut), labels(item)...)
+		m.add("runvm_vm_major_faults_total", "counter", "Major page faults of the guest.", float64(b.MajorFaults), labels(item)...)
+		m.add("runvm_vm_minor_faults_total", "counter", "Minor page faults of the guest.", float64(b.MinorFaults), labels(item)...)
+	}
+	for _, d := range ds.Disks {
+		l := labels(item, "device", d.Device)
+		m.add("runvm_vm_disk_read_bytes_total", "counter", "Bytes read from the disk.", float64(d.ReadBytes), l...)
+		m.add("runvm_vm_disk_read_requests_total", "counter", "Read requests to the disk.", float64(d.ReadRequests), l...)
+		m.add("runvm_vm_disk_write_bytes_total", "counter", "Bytes written to the disk.", float64(d.WriteBytes), l...)
+		m.add("runvm_vm_disk_write_requests_total", "counter", "Write requests to the disk.", float64(d.WriteRequests), l...)
+	}
+}
@@ -0,0 +1,342 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/harche/runvm/hypervisor"
+	"github.com/harche/runvm/libcontainer"
+	"github.com/harche/runvm/libcontainer/configs"
+	"github.com/harche/runvm/libcontainer/utils"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/urfave/cli"
+)
+
+var monitorCommand = cli.Command{
+	Name:   "monitor",
+	Usage:  `follow the virtual machine of a detached container (do not call it outside of runvm)`,
+	Hidden: true,
+	Action: func(context *cli.Context) error {
+		if err := checkArgs(context, 1, exactArgs); err != nil {
+			return err
+		}
+		factory, err := loadFactory(context)
+		if err != nil {
+			return err
+		}
+		container, err := factory.Load(context.Args().First())
+		if err != nil {
+			return err
+		}
+		hyperVisor, err := loadHypervisor(context)
+		if err != nil {
+			return err
+		}
+		events, stop, err := hyperVisor.Watch(container.ID())
+		if err != nil {
+			return err
+		}
+		defer stop()
+		// The virtual machine may have stopped before we subscribed.
+		if !vmRunning(hyperVisor, container.ID()) {
+			workloadExited(hyperVisor, container)
+			destroyLocked(factory, container)
+			return nil
+		}
+		forwards := annotatedPortForwards(hyperVisor, container)
+		stopBalloon := make(chan struct{})
+		go balanceMemory(hyperVisor, container.ID(), stopBalloon)
+		serveConsoles := func() {
+			if err := hyperVisor.ServeConsoles(container.ID()); err != nil {
+				logrus.Warnf("console of %s: %v", container.ID(), err)
+			}
+		}
+		go serveConsoles()
+		// The console of a restarted virtual machine is served anew.
+		err = superviseVM(hyperVisor, factory, container, events, stop, func() {
+			go serveConsoles()
+		})
+		if err != nil {
+			logrus.Error(err)
+		}
+		close(stopBalloon)
+		closeListeners(forwards)
+		destroyLocked(factory, container)
+		return nil
+	},
+}
+
+// superviseVM follows the virtual machine of container through events,
+// which stop unsubscribes from, until it stops for good. A virtual machine
+// that fails is dumped and restarted as the restart policy of container
+// allows. started is called whenever the virtual machine starts. It
+// returns nil once the virtual machine stopped on its own and the
+// workloadexited hooks ran; the caller destroys the container either way.
+// The monitor of a detached container and an attached runvm share it.
+func superviseVM(h hypervisor.Hypervisor, factory libcontainer.Factory, container libcontainer.Container, events <-chan hypervisor.Event, stop func(), started func()) error {
+	policy, err := restartPolicy(h, container)
+	if err != nil {
+		return err
+	}
+	for {
+		go guestBooted(h, container)
+		failure, err := followVM(factory, container, events, started)
+		stop()
+		if err != nil {
+			return err
+		}
+		if failure == "" {
+			workloadExited(h, container)
+			return nil
+		}
+		captureCrash(h, container.ID(), failure)
+		if events, stop, err = restartVM(h, container, policy, failure); err != nil {
+			return err
+		}
+	}
+}
+
+// followVM mirrors the events of the virtual machine onto its container
+// until the virtual machine stops or fails, calling started when it
+// starts. It returns why the virtual machine failed, or "" if it stopped
+// on its own.
+func followVM(factory libcontainer.Factory, container libcontainer.Container, events <-chan hypervisor.Event, started func()) (string, error) {
+	for e := range events {
+		switch e.Type {
+		case hypervisor.EventCrashed, hypervisor.EventWatchdog:
+			// The guest is stopping, or kept for its crash dump.
+			logrus.Warnf("vm %s %s", e.ID, e.Type)
+			return e.Type.String(), nil
+		case hypervisor.EventStarted:
+			logrus.Debugf("vm %s %s", e.ID, e.Type)
+			started()
+		default:
+			if err := handleVMEvent(factory, container, e); err != nil {
+				return "", err
+			}
+		}
+	}
+	return "", nil
+}
+
+// captureCrash dumps the virtual machine id after it failed when crash
+// dumps are enabled.
+func captureCrash(h hypervisor.Hypervisor, id, failure string) {
+	if !h.DumpsOnCrash() {
+		return
+	}
+	dir, err := h.DumpVM(id, failure)
+	if err != nil {
+		logrus.Errorf("crash dump of vm %s: %v", id, err)
+		return
+	}
+	logrus.Warnf("vm %s %s, dumped to %s", id, failure, dir)
+}
+
+// restartVM restarts the virtual machine of container after it failed if
+// policy allows it, and returns the events of the restarted virtual
+// machine.
+func restartVM(h hypervisor.Hypervisor, container libcontainer.Container, policy hypervisor.RestartPolicy, failure string) (<-chan hypervisor.Event, func(), error) {
+	id := container.ID()
+	restarts, err := h.Restarts(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !policy.Allows(len(restarts)) {
+		return nil, nil, fmt.Errorf("virtual machine %s %s after %d restarts, restart policy %s", id, failure, len(restarts), policy)
+	}
+	state, err := container.State()
+	if err != nil {
+		return nil, nil, err
+	}
+	events, stop, err := h.Watch(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := h.RestartVM(id, state.CgroupPaths, failure); err != nil {
+		stop()
+		return nil, nil, err
+	}
+	logrus.Infof("restarted vm %s after %s", id, failure)
+	return events, stop, nil
+}
+
+// restartPolicy returns the restart policy of container, from its
+// hypervisor.RestartPolicyAnnotation or else that of h.
+func restartPolicy(h hypervisor.Hypervisor, container libcontainer.Container) (hypervisor.RestartPolicy, error) {
+	_, annotations := utils.Annotations(container.Config().Labels)
+	value, ok := annotations[hypervisor.RestartPolicyAnnotation]
+	if !ok {
+		return h.RestartPolicy(), nil
+	}
+	policy, err := hypervisor.ParseRestartPolicy(value)
+	if err != nil {
+		return policy, fmt.Errorf("restart policy of %s: %v", container.ID(), err)
+	}
+	return policy, nil
+}
+
+// balanceMemory runs the balloon policy of the virtual machine id every
+// hypervisor.BalloonPeriod seconds until stop is closed.
+func balanceMemory(h hypervisor.Hypervisor, id string, stop <-chan struct{}) {
+	ticker := time.NewTicker(hypervisor.BalloonPeriod * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := h.BalanceMemory(id); err != nil {
+				logrus.Debugf("balloon of %s: %v", id, err)
+			}
+		}
+	}
+}
+
+// guestBooted runs the guestbooted hooks of container once the guest of
+// its virtual machine has booted.
+func guestBooted(h hypervisor.Hypervisor, container libcontainer.Container) {
+	hooks := container.Config().Hooks
+	if hooks == nil || len(hooks.GuestBooted) == 0 {
+		return
+	}
+	if err := h.WaitBooted(container.ID()); err != nil {
+		logrus.Warnf("guestbooted hooks of %s: %v", container.ID(), err)
+		return
+	}
+	runVMHooks(h, container, "guestbooted", hooks.GuestBooted)
+}
+
+// workloadExited runs the workloadexited hooks of container after its
+// virtual machine stopped on its own.
+func workloadExited(h hypervisor.Hypervisor, container libcontainer.Container) {
+	if hooks := container.Config().Hooks; hooks != nil {
+		runVMHooks(h, container, "workloadexited", hooks.WorkloadExited)
+	}
+}
+
+// runVMHooks runs the kind hooks of container with the state of its
+// virtual machine. A failing hook is only logged, as the virtual machine
+// is past the point where it could fail the start of the container.
+func runVMHooks(h hypervisor.Hypervisor, container libcontainer.Container, kind string, hooks []configs.Hook) {
+	if len(hooks) == 0 {
+		return
+	}
+	config := container.Config()
+	s := configs.HookState{
+		State: specs.State{
+			Version: config.Version,
+			ID:      container.ID(),
+			Bundle:  utils.SearchLabels(config.Labels, "bundle"),
+		},
+	}
+	if state, err := container.State(); err == nil {
+		s.Pid = state.InitProcessPid
+	}
+	vm, err := h.VMState(container.ID())
+	if err != nil {
+		logrus.Warnf("%s hooks of %s: %v", kind, container.ID(), err)
+	}
+	s.VM = vm
+	for i, hook := range hooks {
+		if err := hook.Run(s); err != nil {
+			logrus.Warnf("running %s hook %d of %s: %v", kind, i, container.ID(), err)
+			return
+		}
+	}
+}
+
+// handleVMEvent mirrors a lifecycle change of the virtual machine onto its
+// container. Once the virtual machine has stopped the caller destroys the
+// container, which runs the poststop hooks and removes the VM. Crashes and
+// watchdog events are handled by followVM.
+func handleVMEvent(factory libcontainer.Factory, container libcontainer.Container, e hypervisor.Event) error {
+	logrus.Debugf("vm %s %s", e.ID, e.Type)
+	if e.Type == hypervisor.EventPaused || e.Type == hypervisor.EventResumed {
+		unlock, err := lockContainer(factory, container.ID())
+		if err != nil {
+			// The runvm process holding the lock changes the container
+			// itself.
+			logrus.Warnf("vm %s %s: %v", e.ID, e.Type, err)
+			return nil
+		}
+		defer unlock()
+	}
+	status, err := container.Status()
+	if err != nil {
+		return err
+	}
+	switch e.Type {
+	case hypervisor.EventPaused:
+		if status == libcontainer.Running {
+			return container.Pause()
+		}
+	case hypervisor.EventResumed:
+		if status == libcontainer.Paused {
+			return container.Resume()
+		}
+	}
+	return nil
+}
+
+// destroyLocked destroys container under its lock. The container is
+// destroyed even if the lock cannot be taken, as its virtual machine is
+// gone.
+func destroyLocked(factory libcontainer.Factory, container libcontainer.Container) {
+	unlock, err := lockContainer(factory, container.ID())
+	if err != nil {
+		logrus.Warnf("destroy %s: %v", container.ID(), err)
+	} else {
+		defer unlock()
+	}
+	destroy(container)
+}
+
+// monitorArgs returns the command line of the monitor process for
+// container id.
+func monitorArgs(context *cli.Context, id string) []string {
+	return append(globalArgs(context), "monitor", id)
+}
+
+// globalArgs returns the global options of runvm that locate its state and
+// logs, to be carried over to the runvm processes it starts.
+func globalArgs(context *cli.Context) []string {
+	root, err := filepath.Abs(context.GlobalString("root"))
+	if err != nil {
+		root = context.GlobalString("root")
+	}
+	args := []string{
+		"--root", root,
+		"--log", context.GlobalString("log"),
+		"--log-format", context.GlobalString("log-format"),
+		"--lock-timeout", context.GlobalDuration("lock-timeout").String(),
+	}
+	if context.GlobalBool("debug") {
+		args = append(args, "--debug")
+	}
+	if file := context.GlobalString("hypervisor-config"); file != "" {
+		if abs, err := filepath.Abs(file); err == nil {
+			file = abs
+		}
+		args = append(args, "--hypervisor-config", file)
+	}
+	return args
+}
+
+// startDetached launches runvm with args in its own session, as for the
+// monitor process, so that it keeps running after runvm returns. Its stdio
+// is left unset so that it does not hold on to the caller's pipes.
+func startDetached(args []string) error {
+	cmd := exec.Command("/proc/self/exe", args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
@@ -13,10 +13,11 @@ var pauseCommand = cli.Command{
 		if err := checkArgs(context, 1, exactArgs); err != nil {
 			return err
 		}
-		container, err := getContainer(context)
+		container, unlock, err := getLockedContainer(context)
 		if err != nil {
 			return err
 		}
+		defer unlock()
 		if err := container.Pause(); err != nil {
 			return err
 		}
@@ -34,10 +35,11 @@ var resumeCommand = cli.Command{
 		if err := checkArgs(context, 1, exactArgs); err != nil {
 			return err
 		}
-		container, err := getContainer(context)
+		container, unlock, err := getLockedContainer(context)
 		if err != nil {
 			return err
 		}
+		defer unlock()
 		if err := container.Resume(); err != nil {
 			return err
 		}
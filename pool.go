@@ -0,0 +1,55 @@
+// +build linux
+
+package main
+
+import (
+	"github.com/harche/runvm/hypervisor"
+	"github.com/urfave/cli"
+)
+
+var poolCommand = cli.Command{
+	Name:  "pool",
+	Usage: "manage the pool of booted, idle virtual machines",
+	Description: `Containers whose resources fit one of the "PoolClasses" of the hypervisor
+configuration start in an idle virtual machine of the pool instead of
+booting one of their own. The pool is only used when "PoolSize" is set.`,
+	Subcommands: []cli.Command{
+		{
+			Name:  "fill",
+			Usage: "boot idle virtual machines until every pool class is full",
+			Action: func(context *cli.Context) error {
+				if err := checkArgs(context, 0, exactArgs); err != nil {
+					return err
+				}
+				hyperVisor, err := loadHypervisor(context)
+				if err != nil {
+					return err
+				}
+				return hyperVisor.FillPool()
+			},
+		},
+		{
+			Name:  "drain",
+			Usage: "remove all idle virtual machines of the pool",
+			Action: func(context *cli.Context) error {
+				if err := checkArgs(context, 0, exactArgs); err != nil {
+					return err
+				}
+				hyperVisor, err := loadHypervisor(context)
+				if err != nil {
+					return err
+				}
+				return hyperVisor.DrainPool()
+			},
+		},
+	},
+}
+
+// poolRefillArgs returns the command line that refills the pool of h, or
+// nil if the pool is not refilled automatically.
+func poolRefillArgs(context *cli.Context, h hypervisor.Hypervisor) []string {
+	if !h.PoolAutoRefill() {
+		return nil
+	}
+	return append(globalArgs(context), "pool", "fill")
+}
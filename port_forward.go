@@ -0,0 +1,120 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/harche/runvm/hypervisor"
+	"github.com/harche/runvm/libcontainer"
+	"github.com/harche/runvm/libcontainer/utils"
+	"github.com/urfave/cli"
+	"golang.org/x/sys/unix"
+)
+
+var portForwardCommand = cli.Command{
+	Name:  "port-forward",
+	Usage: "forward host ports to ports of a container",
+	ArgsUsage: `<container-id> [address:]<hostport>:<guestport>...
+
+Where "<container-id>" is the name for the instance of the container, and
+each forward listens on <address>, 127.0.0.1 by default, and <hostport> of
+the host.
+
+EXAMPLE:
+To reach the metrics port 9100 of container app1 on port 19100 of the host:
+
+       # runvm port-forward app1 19100:9100`,
+	Description: `The port-forward command relays the connections made to host ports to ports of
+the container until it is interrupted. Connections go over the vsock of the
+virtual machine, so they work for containers without a network. Ports
+forwarded for as long as a container runs are set with the
+"` + hypervisor.PortForwardAnnotation + `" annotation instead.`,
+	Action: func(context *cli.Context) error {
+		if err := checkArgs(context, 2, minArgs); err != nil {
+			return err
+		}
+		forwards, err := hypervisor.ParsePortForwards(strings.Join(context.Args().Tail(), ","))
+		if err != nil {
+			return err
+		}
+		container, err := getContainer(context)
+		if err != nil {
+			return err
+		}
+		status, err := container.Status()
+		if err != nil {
+			return err
+		}
+		if status == libcontainer.Stopped {
+			return fmt.Errorf("container %s is not running", container.ID())
+		}
+		hyperVisor, err := loadHypervisor(context)
+		if err != nil {
+			return err
+		}
+		listeners, err := startPortForwards(hyperVisor, container.ID(), forwards)
+		if err != nil {
+			return err
+		}
+		defer closeListeners(listeners)
+		for _, f := range forwards {
+			fmt.Printf("Forwarding from %s to port %d\n", net.JoinHostPort(f.Address, strconv.Itoa(f.HostPort)), f.GuestPort)
+		}
+		s := make(chan os.Signal, 1)
+		signal.Notify(s, unix.SIGINT, unix.SIGTERM)
+		<-s
+		return nil
+	},
+}
+
+// startPortForwards listens on the host side of forwards and relays the
+// connections to the virtual machine id until the listeners are closed.
+func startPortForwards(h hypervisor.Hypervisor, id string, forwards []hypervisor.PortForward) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, f := range forwards {
+		l, err := net.Listen("tcp", net.JoinHostPort(f.Address, strconv.Itoa(f.HostPort)))
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, l)
+		go func(l net.Listener, guestPort int) {
+			h.ForwardPort(id, l, guestPort)
+		}(l, f.GuestPort)
+	}
+	return listeners, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// annotatedPortForwards starts the port forwards of container set by its
+// hypervisor.PortForwardAnnotation.
+func annotatedPortForwards(h hypervisor.Hypervisor, container libcontainer.Container) []net.Listener {
+	_, annotations := utils.Annotations(container.Config().Labels)
+	value, ok := annotations[hypervisor.PortForwardAnnotation]
+	if !ok {
+		return nil
+	}
+	forwards, err := hypervisor.ParsePortForwards(value)
+	if err != nil {
+		logrus.Warnf("port forwards of %s: %v", container.ID(), err)
+		return nil
+	}
+	listeners, err := startPortForwards(h, container.ID(), forwards)
+	if err != nil {
+		logrus.Warnf("port forwards of %s: %v", container.ID(), err)
+		return nil
+	}
+	return listeners
+}
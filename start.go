@@ -21,10 +21,11 @@ your host.`,
 		if err := checkArgs(context, 1, exactArgs); err != nil {
 			return err
 		}
-		container, err := getContainer(context)
+		container, unlock, err := getLockedContainer(context)
 		if err != nil {
 			return err
 		}
+		defer unlock()
 		status, err := container.Status()
 		if err != nil {
 			return err
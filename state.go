@@ -50,6 +50,16 @@ instance of a container.`,
 			Created:        state.BaseState.Created,
 			Annotations:    annotations,
 		}
+		if hyperVisor, err := loadHypervisor(context); err == nil {
+			if cs.Restarts, err = hyperVisor.Restarts(cs.ID); err != nil {
+				return err
+			}
+			if containerStatus != libcontainer.Stopped {
+				if cs.Display, err = hyperVisor.Display(cs.ID); err != nil {
+					return err
+				}
+			}
+		}
 		data, err := json.MarshalIndent(cs, "", "  ")
 		if err != nil {
 			return err
@@ -0,0 +1,58 @@
+// +build linux
+
+package main
+
+import (
+	"github.com/urfave/cli"
+)
+
+var templateCommand = cli.Command{
+	Name:  "template",
+	Usage: "manage the templates virtual machines are cloned from",
+	Description: `A template is a virtual machine saved right before it would start a
+container. Containers with the "io.runvm.template" annotation set to the
+name of a template are restored from it instead of booting, and must fit
+its size.`,
+	Subcommands: []cli.Command{
+		{
+			Name:      "create",
+			Usage:     "boot a virtual machine and save it as a template",
+			ArgsUsage: "<name>",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "cpus",
+					Usage: "number of vCPUs of the template (default from the hypervisor configuration)",
+				},
+				cli.IntFlag{
+					Name:  "memory",
+					Usage: "memory of the template in MiB (default from the hypervisor configuration)",
+				},
+			},
+			Action: func(context *cli.Context) error {
+				if err := checkArgs(context, 1, exactArgs); err != nil {
+					return err
+				}
+				hyperVisor, err := loadHypervisor(context)
+				if err != nil {
+					return err
+				}
+				return hyperVisor.CreateTemplate(context.Args().First(), context.Int("cpus"), context.Int("memory"))
+			},
+		},
+		{
+			Name:      "rm",
+			Usage:     "remove a template no container is cloned from",
+			ArgsUsage: "<name>",
+			Action: func(context *cli.Context) error {
+				if err := checkArgs(context, 1, exactArgs); err != nil {
+					return err
+				}
+				hyperVisor, err := loadHypervisor(context)
+				if err != nil {
+					return err
+				}
+				return hyperVisor.RemoveTemplate(context.Args().First())
+			},
+		},
+	},
+}
@@ -5,11 +5,14 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/coreos/go-systemd/activation"
@@ -24,7 +27,6 @@ import (
 
 	"golang.org/x/sys/unix"
 	"strings"
-	"time"
 	"io/ioutil"
 )
 
@@ -47,7 +49,19 @@ func loadFactory(context *cli.Context) (libcontainer.Factory, error) {
 			return nil, fmt.Errorf("systemd cgroup flag passed, but systemd support for managing cgroups is not available")
 		}
 	}
-	return libcontainer.New(abs, cgroupManager, libcontainer.CriuPath(context.GlobalString("criu")))
+	return libcontainer.New(abs, cgroupManager,
+		libcontainer.CriuPath(context.GlobalString("criu")),
+		libcontainer.LockTimeout(context.GlobalDuration("lock-timeout")))
+}
+
+// loadHypervisor returns the configured hypervisor, keeping virtual machine
+// artifacts under the global state root.
+func loadHypervisor(context *cli.Context) (hypervisor.Hypervisor, error) {
+	abs, err := filepath.Abs(context.GlobalString("root"))
+	if err != nil {
+		return nil, err
+	}
+	return hypervisor.HypFactory(abs)
 }
 
 // getContainer returns the specified container instance by loading it from state
@@ -64,6 +78,47 @@ func getContainer(context *cli.Context) (libcontainer.Container, error) {
 	return factory.Load(id)
 }
 
+// getLockedContainer loads the specified container with its lock held, so
+// that no other runvm process changes it until unlock is called.
+func getLockedContainer(context *cli.Context) (libcontainer.Container, func(), error) {
+	id := context.Args().First()
+	if id == "" {
+		return nil, nil, errEmptyID
+	}
+	factory, err := loadFactory(context)
+	if err != nil {
+		return nil, nil, err
+	}
+	unlock, err := lockContainer(factory, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	container, err := factory.Load(id)
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+	return container, unlock, nil
+}
+
+// lockContainer takes the lock of container id until the returned func is
+// called.
+func lockContainer(factory libcontainer.Factory, id string) (func(), error) {
+	if err := factory.Lock(id); err != nil {
+		return nil, err
+	}
+	return unlocker(factory, id), nil
+}
+
+// unlocker returns the func releasing the lock of container id.
+func unlocker(factory libcontainer.Factory, id string) func() {
+	return func() {
+		if err := factory.Unlock(id); err != nil {
+			logrus.Warn(err)
+		}
+	}
+}
+
 func fatalf(t string, v ...interface{}) {
 	fatal(fmt.Errorf(t, v...))
 }
@@ -198,7 +253,9 @@ func isRootless() bool {
 	return os.Geteuid() != 0
 }
 
-func createContainer(context *cli.Context, id string, spec *specs.Spec) (libcontainer.Container, error) {
+// createContainer creates the container id in factory, which returns it
+// locked.
+func createContainer(context *cli.Context, factory libcontainer.Factory, id string, spec *specs.Spec) (libcontainer.Container, error) {
 	config, err := specconv.CreateLibcontainerConfig(&specconv.CreateOpts{
 		CgroupName:       id,
 		UseSystemdCgroup: context.GlobalBool("systemd-cgroup"),
@@ -210,11 +267,6 @@ func createContainer(context *cli.Context, id string, spec *specs.Spec) (libcont
 	if err != nil {
 		return nil, err
 	}
-
-	factory, err := loadFactory(context)
-	if err != nil {
-		return nil, err
-	}
 	return factory.Create(id, config)
 }
 
@@ -227,12 +279,18 @@ type runner struct {
 	pidFile         string
 	consoleSocket   string
 	container       libcontainer.Container
+	factory         libcontainer.Factory
+	unlock          func()
 	action          CtAct
 	notifySocket    *notifySocket
 	criuOpts        *libcontainer.CriuOpts
+	hypervisor      hypervisor.Hypervisor
+	monitorArgs     []string
+	refillArgs      []string
 }
 
 func (r *runner) run(config *specs.Process) (int, error) {
+	defer r.release()
 	if err := r.checkTerminal(config); err != nil {
 		r.destroy()
 		return -1, err
@@ -249,8 +307,7 @@ func (r *runner) run(config *specs.Process) (int, error) {
 		for sig := range c {
 			//ISOLATED
 			fmt.Println(sig)
-			hyperVisor, err := hypervisor.HypFactory()
-			virtualMachine, err := hyperVisor.GetVM(r.container.ID())
+			virtualMachine, err := r.hypervisor.GetVM(r.container.ID())
 			if err == nil {
 				virtualMachine.Kill()
 			}
@@ -334,16 +391,16 @@ func (r *runner) run(config *specs.Process) (int, error) {
 	}
 
 
-	hyperVisor, err := hypervisor.HypFactory()
-
 	vmParams := new(hypervisor.VirtualMachineParams)
 	vmParams.Id = r.container.ID()
 	vmParams.Detach = r.detach
 	vmParams.Args = config.Args
 	vmParams.EnvPath(config.Env)
 	vmParams.CwD = config.Cwd
+	vmParams.Terminal = config.Terminal
 
 	vmParams.NetworkNSPath = containerState.NamespacePaths[configs.NEWNET]
+	vmParams.CgroupPaths = containerState.CgroupPaths
 
 	pid, err := process.Pid()
 	if err != nil {
@@ -359,12 +416,30 @@ func (r *runner) run(config *specs.Process) (int, error) {
 	}
 
 	vmParams.Rootfs = r.container.Config().Rootfs
+	vmParams.ProcessLabel = r.container.Config().ProcessLabel
+	vmParams.MountLabel = r.container.Config().MountLabel
+	vmParams.AppArmorProfile = r.container.Config().AppArmorProfile
+	_, annotations := utils.Annotations(r.container.Config().Labels)
+	vmParams.Template = annotations[hypervisor.TemplateAnnotation]
+	if cgroup := r.container.Config().Cgroups; cgroup != nil && cgroup.Resources != nil {
+		vmParams.CpusetCpus = cgroup.Resources.CpusetCpus
+		vmParams.CpusetMems = cgroup.Resources.CpusetMems
+		vmParams.CpuQuota = cgroup.Resources.CpuQuota
+		vmParams.CpuPeriod = cgroup.Resources.CpuPeriod
+		vmParams.MemoryLimit = cgroup.Resources.Memory
+		vmParams.MemoryReservation = cgroup.Resources.MemoryReservation
+		vmParams.HugepageLimits = cgroup.Resources.HugetlbLimit
+	}
 
 	mountPoints := make(map[string]string)
+	mountRelabels := make(map[string]string)
 	skipHostFile := false
 	for _, mount := range r.container.Config().Mounts {
 		if strings.HasPrefix(mount.Source, "/") && len(mount.PropagationFlags) == 0 {
 			mountPoints[mount.Source] = mount.Destination
+			if mount.Relabel != "" {
+				mountRelabels[mount.Source] = mount.Relabel
+			}
 		}
 
 		if strings.HasSuffix(mount.Source, "resolv.conf") {
@@ -382,54 +457,152 @@ func (r *runner) run(config *specs.Process) (int, error) {
 	}
 
 	vmParams.Mounts = mountPoints
+	vmParams.MountRelabels = mountRelabels
 
-	lauchVM := make(chan bool)
+	// Subscribe before the domain is defined so that no lifecycle event
+	// can be missed.
+	events, stopWatch, err := r.hypervisor.Watch(vmParams.Id)
+	if err != nil {
+		r.destroy()
+		return -1, err
+	}
+	defer stopWatch()
+
+	launchVM := make(chan error, 1)
 	go func() {
-		_, err = hyperVisor.CreateVM(*vmParams)
-		if err != nil {
-			lauchVM <- false
-		}
-		lauchVM <- true
+		_, err := r.hypervisor.CreateVM(*vmParams)
+		launchVM <- err
 	}()
-	time.Sleep(time.Second*2)
-
-
-	for {
-		procCmdlineFile, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline")
 
-		if err != nil {
-			break
+	if detach {
+		if err := <-launchVM; err != nil {
+			r.destroy()
+			return -1, err
 		}
-
-		if _, err := os.Stat("/var/run/libvirt/qemu/"+vmParams.Id+".pid"); os.IsNotExist(err) {
+		// Hand the virtual machine over to a monitor process which
+		// outlives us and cleans up once the virtual machine stops.
+		stopWatch()
+		if err := startDetached(r.monitorArgs); err != nil {
 			r.destroy()
-			break
+			return -1, err
 		}
+		r.refillPool()
+		return 0, nil
+	}
 
-		if len(procCmdlineFile) == 0 {
+	// An attached runvm lasts as long as the container, so it holds the
+	// lock only while it creates it.
+	r.release()
+	// CreateVM prints the console until the virtual machine stops, so the
+	// balloon, the port forwards and the pool refill start once the domain
+	// runs. The forwards last until the container exits, across restarts.
+	stopBalloon := make(chan struct{})
+	defer close(stopBalloon)
+	var (
+		forwardsMu sync.Mutex
+		forwards   []net.Listener
+	)
+	defer func() {
+		forwardsMu.Lock()
+		closeListeners(forwards)
+		forwardsMu.Unlock()
+	}()
+	booted := false
+	started := func() {
+		if booted {
+			go printConsole(r.hypervisor, vmParams.Id)
+			return
+		}
+		booted = true
+		go balanceMemory(r.hypervisor, vmParams.Id, stopBalloon)
+		forwardsMu.Lock()
+		forwards = annotatedPortForwards(r.hypervisor, r.container)
+		forwardsMu.Unlock()
+		r.refillPool()
+	}
+	supervised := make(chan error, 1)
+	go func() {
+		supervised <- superviseVM(r.hypervisor, r.factory, r.container, events, stopWatch, started)
+	}()
+	for {
+		select {
+		case err := <-launchVM:
+			if err != nil {
+				r.destroy()
+				return -1, err
+			}
+			launchVM = nil
+		case err := <-supervised:
 			r.destroy()
-			break
+			if err != nil {
+				return -1, err
+			}
+			return status, nil
 		}
-
-		time.Sleep(time.Second*1)
 	}
+}
 
-	if !<-lauchVM{
-		r.destroy()
-		return -1, err
+// printConsole prints the application console of the virtual machine id
+// after it was restarted, as CreateVM did before, until the virtual machine
+// stops.
+func printConsole(h hypervisor.Hypervisor, id string) {
+	go func() {
+		if err := h.ServeConsoles(id); err != nil {
+			logrus.Warnf("console of %s: %v", id, err)
+		}
+	}()
+	// The relay replays what the guest printed before we attached.
+	var (
+		console *hypervisor.ConsoleAttachment
+		err     error
+	)
+	for i := 0; i < 100; i++ {
+		if console, err = h.AttachConsole(id); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
+	if err != nil {
+		logrus.Warnf("console of %s: %v", id, err)
+		return
+	}
+	defer console.Close()
+	io.Copy(os.Stdout, console)
+}
 
+// refillPool tops up the pool of idle virtual machines in the background
+// when it is refilled automatically.
+func (r *runner) refillPool() {
+	if r.refillArgs == nil {
+		return
+	}
+	if err := startDetached(r.refillArgs); err != nil {
+		logrus.Warnf("refill pool: %v", err)
+	}
+}
 
-	if detach {
-		return 0, nil
+// vmRunning asks the hypervisor whether the virtual machine backing
+// container id is still alive.
+func vmRunning(h hypervisor.Hypervisor, id string) bool {
+	vm, err := h.GetVM(id)
+	if err != nil {
+		return false
 	}
-	r.destroy()
-	return status, err
+	running, err := vm.IsRunning()
+	return err == nil && running
 }
 
 func (r *runner) destroy() {
 	if r.shouldDestroy {
-		destroy(r.container)
+		destroyLocked(r.factory, r.container)
+	}
+}
+
+// release gives up the lock of the container taken to create it.
+func (r *runner) release() {
+	if r.unlock != nil {
+		r.unlock()
+		r.unlock = nil
 	}
 }
 
@@ -482,10 +655,29 @@ func startContainer(context *cli.Context, spec *specs.Spec, action CtAct, criuOp
 		notifySocket.setupSpec(context, spec)
 	}
 
-	container, err := createContainer(context, id, spec)
+	hyperVisor, err := loadHypervisor(context)
+	if err != nil {
+		return -1, err
+	}
+	// A restart policy that does not parse is refused before anything is
+	// created, rather than found out once the virtual machine fails.
+	if value, ok := spec.Annotations[hypervisor.RestartPolicyAnnotation]; ok {
+		if _, err := hypervisor.ParseRestartPolicy(value); err != nil {
+			return -1, fmt.Errorf("invalid %s annotation: %v", hypervisor.RestartPolicyAnnotation, err)
+		}
+	}
+
+	factory, err := loadFactory(context)
+	if err != nil {
+		return -1, err
+	}
+	// The container is locked from the moment its directory exists, so
+	// that no other runvm process races with its creation.
+	container, err := createContainer(context, factory, id, spec)
 	if err != nil {
 		return -1, err
 	}
+	unlock := unlocker(factory, id)
 
 	if notifySocket != nil {
 		notifySocket.setupSocket()
@@ -500,6 +692,8 @@ func startContainer(context *cli.Context, spec *specs.Spec, action CtAct, criuOp
 		enableSubreaper: !context.Bool("no-subreaper"),
 		shouldDestroy:   true,
 		container:       container,
+		factory:         factory,
+		unlock:          unlock,
 		listenFDs:       listenFDs,
 		notifySocket:    notifySocket,
 		consoleSocket:   context.String("console-socket"),
@@ -508,6 +702,9 @@ func startContainer(context *cli.Context, spec *specs.Spec, action CtAct, criuOp
 		preserveFDs:     context.Int("preserve-fds"),
 		action:          action,
 		criuOpts:        criuOpts,
+		hypervisor:      hyperVisor,
+		monitorArgs:     monitorArgs(context, id),
+		refillArgs:      poolRefillArgs(context, hyperVisor),
 	}
 	return r.run(spec.Process)
 }